@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"crypto/tls"
+	"io"
 	"net/http"
 	"time"
 
@@ -13,6 +14,8 @@ import (
 	"github.com/zgs225/rmfakecloud/internal/hwr"
 	"github.com/zgs225/rmfakecloud/internal/storage"
 	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+	"github.com/zgs225/rmfakecloud/internal/storage/s3"
 	"github.com/zgs225/rmfakecloud/internal/ui"
 
 	"github.com/gin-gonic/gin"
@@ -26,6 +29,25 @@ const (
 	Version15      = 15
 )
 
+// storageBackend where the documents and the sync15 blobs are kept
+type storageBackend interface {
+	storage.DocumentStorer
+	storage.MetadataStorer
+	storage.BlobStorage
+	storage.BlobCollector
+	storage.BlobChecker
+	storage.UsageTracker
+	storage.TrashStorer
+	storage.VersionStorer
+	GetTree(uid string) (*models.HashTree, error)
+	UpdateBlobDocument(uid string, tree *models.HashTree, doc *models.HashDoc) error
+	RemoveBlobDocuments(uid string, tree *models.HashTree, docIDs ...string) error
+	Export(uid, docid string, format storage.ExportFormat, options storage.ExportOptions) (io.ReadCloser, error)
+	RootHistory(uid string) ([]storage.RootGeneration, error)
+	GetTreeAt(uid string, generation int64) (*models.HashTree, error)
+	RestoreRoot(uid string, generation int64) (int64, error)
+}
+
 // App web app
 type App struct {
 	router        *gin.Engine
@@ -35,9 +57,16 @@ type App struct {
 	userStorer    storage.UserStorer
 	metaStorer    storage.MetadataStorer
 	blobStorer    storage.BlobStorage
+	blobCollector storage.BlobCollector
+	quota         *storage.Quota
 	hub           *hub.Hub
 	codeConnector CodeConnector
 	hwrClient     *hwr.HWRClient
+	trash         trashPurger
+	layout        layoutMigrator
+	// documents the version checks of the sync 1.0 metadata, shared with the ui
+	documents *storage.DocumentLocks
+	quit      chan struct{}
 }
 
 // Start starts the app
@@ -59,6 +88,16 @@ func (app *App) Start() {
 		app.router.SetTrustedProxies(nil)
 	}
 
+	go app.migrateLayout()
+
+	if app.cfg.GCInterval > 0 {
+		go app.collectGarbage(app.cfg.GCInterval)
+	}
+
+	if app.cfg.TrashRetention > 0 {
+		go app.purgeTrash(app.cfg.TrashRetention)
+	}
+
 	app.srv = &http.Server{
 		Addr:      ":" + app.cfg.Port,
 		Handler:   app.router,
@@ -83,6 +122,7 @@ func (app *App) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	// app.hub.Stop()
+	close(app.quit)
 	if err := app.srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server Shutdown:", err)
 	}
@@ -96,6 +136,16 @@ func NewApp(cfg *config.Config) App {
 	}
 
 	fsStorage := fs.NewStorage(cfg)
+	var backend storageBackend = fsStorage
+	if cfg.S3 != nil {
+		s3Storage, err := s3.NewStorage(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Documents will be saved in the bucket: ", cfg.S3.Bucket)
+		backend = s3Storage
+	}
+
 	usrs, err := fsStorage.GetUsers()
 
 	if err != nil {
@@ -107,6 +157,8 @@ func NewApp(cfg *config.Config) App {
 		//TODO: not thread safe
 		cfg.CreateFirstUser = true
 	}
+	quota := storage.NewQuota(fsStorage, backend, cfg.DefaultQuota)
+	documents := storage.NewDocumentLocks()
 	ntfHub := hub.NewHub()
 	codeConnector := NewCodeConnector()
 	router := gin.Default()
@@ -132,19 +184,25 @@ func NewApp(cfg *config.Config) App {
 	app := App{
 		router:        router,
 		cfg:           cfg,
-		docStorer:     fsStorage,
+		docStorer:     backend,
 		userStorer:    fsStorage,
-		metaStorer:    fsStorage,
-		blobStorer:    fsStorage,
+		metaStorer:    backend,
+		blobStorer:    backend,
+		blobCollector: backend,
+		quota:         quota,
 		hub:           ntfHub,
 		codeConnector: codeConnector,
 		hwrClient: &hwr.HWRClient{
 			Cfg: cfg,
 		},
+		layout:    fsStorage,
+		documents: documents,
+		quit:      make(chan struct{}),
 	}
-	uiApp := ui.New(cfg, fsStorage, codeConnector, ntfHub, fsStorage, fsStorage)
+	uiApp := ui.New(cfg, fsStorage, codeConnector, ntfHub, backend, backend, quota, documents)
+	app.trash = uiApp
 
-	storageapp := fs.NewApp(cfg, fsStorage)
+	storageapp := fs.NewApp(cfg, backend, backend, quota)
 
 	app.registerRoutes(router)
 	storageapp.RegisterRoutes(router)
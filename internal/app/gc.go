@@ -0,0 +1,36 @@
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// collectGarbage periodically removes the unreferenced sync15 blobs of all users
+func (app *App) collectGarbage(interval time.Duration) {
+	log.Info("Collecting unreferenced blobs every: ", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			users, err := app.userStorer.GetUsers()
+			if err != nil {
+				log.Error("[gc] cannot list users ", err)
+				continue
+			}
+			for _, u := range users {
+				if !u.Sync15 {
+					continue
+				}
+				_, err = app.blobCollector.CollectGarbage(u.ID, app.cfg.GCKeepRoots, false)
+				if err != nil {
+					log.Error("[gc] ", u.ID, " ", err)
+				}
+			}
+		case <-app.quit:
+			return
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/mail"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -193,13 +194,23 @@ type metapayload struct {
 	FileName string `json:"file_name"`
 }
 
-func extFromContentType(contentType string) (string, error) {
+// extFromContentType the extension of the upload, archives sent as
+// octet-stream are recognized by the extension of the file name
+func extFromContentType(contentType, fileName string) (string, error) {
 	switch contentType {
 
 	case "application/epub+zip":
 		return models.EpubFileExt, nil
 	case "application/pdf":
 		return models.PdfFileExt, nil
+	case "application/zip", "application/x-zip-compressed":
+		if path.Ext(fileName) == models.RmDocFileExt {
+			return models.RmDocFileExt, nil
+		}
+		return models.ZipFileExt, nil
+	}
+	if ext := path.Ext(fileName); models.IsDocumentArchive(ext) {
+		return ext, nil
 	}
 	return "", fmt.Errorf("unsupported content type %s", contentType)
 }
@@ -244,12 +255,15 @@ func (app *App) uploadDoc(c *gin.Context) {
 		return
 	}
 	contentType := file.Header.Get("Content-Type")
-	ext, err := extFromContentType(contentType)
+	ext, err := extFromContentType(contentType, m.FileName)
 	if err != nil {
 		log.Error(handlerLog, err)
 		badReq(c, "unsupported content type")
 		return
 	}
+	if !common.CheckQuota(c, app.quota, uid, file.Size) {
+		return
+	}
 
 	f, err := file.Open()
 	if err != nil {
@@ -264,7 +278,7 @@ func (app *App) uploadDoc(c *gin.Context) {
 		internalError(c, "cant upload document")
 		return
 	}
-	fileName := m.FileName + ext
+	fileName := strings.TrimSuffix(m.FileName, ext) + ext
 	log.Info("Uploading: ", fileName)
 
 	err = saveUpload(app, syncVer, uid, deviceID, fileName, f)
@@ -318,16 +332,19 @@ func (app *App) uploadDocV2(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	ext, err := extFromContentType(contentType[0])
+	ext, err := extFromContentType(contentType[0], m.FileName)
 	if err != nil {
 		log.Error(handlerLog, err)
 		badReq(c, "unsupported content type")
 		return
 	}
 
+	if !common.CheckQuota(c, app.quota, uid, c.Request.ContentLength) {
+		return
+	}
 	f := c.Request.Body
 
-	fileName := m.FileName + ext
+	fileName := strings.TrimSuffix(m.FileName, ext) + ext
 	log.Info("Uploading: ", fileName)
 
 	err = saveUpload(app, syncVer, uid, deviceID, fileName, f)
@@ -351,7 +368,9 @@ func saveUpload(app *App, syncVer int, uid, deviceID, fileName string, f io.Read
 		app.hub.NotifySync(uid, deviceID)
 	} else {
 		log.Info("sync 10 upload")
+		docs := app.documents.Lock(uid)
 		d, err := app.docStorer.CreateDocument(uid, fileName, "", f)
+		docs.Unlock()
 		if err != nil {
 			return err
 		}
@@ -522,6 +541,9 @@ func (app *App) deleteDocument(c *gin.Context) {
 		return
 	}
 
+	docs := app.documents.Lock(uid)
+	defer docs.Unlock()
+
 	result := []messages.StatusResponse{}
 	for _, r := range req {
 		doc, err := app.metaStorer.GetMetadata(uid, r.ID)
@@ -558,6 +580,9 @@ func (app *App) updateStatus(c *gin.Context) {
 		badReq(c, err.Error())
 		return
 	}
+	docs := app.documents.Lock(uid)
+	defer docs.Unlock()
+
 	result := []messages.StatusResponse{}
 	for _, doc := range req {
 		log.Info("Id: ", doc.ID, " Name: ", doc.VissibleName)
@@ -565,12 +590,22 @@ func (app *App) updateStatus(c *gin.Context) {
 		message := ""
 
 		ok := false
-		err := app.metaStorer.UpdateMetadata(uid, &doc)
+		stored, err := app.storedVersion(uid, doc.ID)
+		if err == nil {
+			err = docs.CheckVersion(doc.ID, deviceID, stored, doc.Version)
+			if err != nil {
+				log.Warn(handlerLog, "status of ", doc.ID, " rejected: ", err)
+				result = append(result, messages.StatusResponse{ID: doc.ID, Success: false, Message: err.Error(), Version: doc.Version})
+				continue
+			}
+			err = app.metaStorer.UpdateMetadata(uid, &doc)
+		}
 		if err != nil {
 			message = internalErrorMessage
 			log.Error(err)
 		} else {
 			ok = true
+			docs.Release(doc.ID, doc.Version)
 
 			ntf := hub.DocumentNotification{
 				ID:      doc.ID,
@@ -625,7 +660,7 @@ func (app *App) blobStorageDownload(c *gin.Context) {
 		return
 	}
 
-	url, exp, err := app.blobStorer.GetBlobURL(uid, req.RelativePath, "read")
+	url, exp, err := app.blobStorer.GetBlobURL(uid, req.RelativePath, "read", "")
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -655,7 +690,8 @@ func (app *App) blobStorageUpload(c *gin.Context) {
 		log.Info("--- Initial Sync ---")
 	}
 	uid := c.GetString(userIDKey)
-	url, exp, err := app.blobStorer.GetBlobURL(uid, req.RelativePath, "write")
+	deviceID := c.GetString(deviceIDKey)
+	url, exp, err := app.blobStorer.GetBlobURL(uid, req.RelativePath, "write", deviceID)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -767,6 +803,7 @@ func (app *App) integrations(c *gin.Context) {
 }
 func (app *App) uploadRequest(c *gin.Context) {
 	uid := c.GetString(userIDKey)
+	deviceID := c.GetString(deviceIDKey)
 	var req []messages.UploadRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		log.Errorf("could not bind %v", err)
@@ -774,6 +811,9 @@ func (app *App) uploadRequest(c *gin.Context) {
 		return
 	}
 
+	docs := app.documents.Lock(uid)
+	defer docs.Unlock()
+
 	response := []messages.UploadResponse{}
 
 	for _, r := range req {
@@ -787,6 +827,23 @@ func (app *App) uploadRequest(c *gin.Context) {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		stored, err := app.storedVersion(uid, documentID)
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		err = docs.ReserveUpload(documentID, deviceID, stored, r.Version, exp)
+		if err != nil {
+			log.Warn(handlerLog, "upload of ", documentID, " rejected: ", err)
+			response = append(response, messages.UploadResponse{
+				ID:      documentID,
+				Message: err.Error(),
+				Success: false,
+				Version: r.Version,
+			})
+			continue
+		}
 		log.Debugln("StorageUrl: ", url)
 		dr := messages.UploadResponse{
 			BlobURLPut:        url,
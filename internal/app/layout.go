@@ -0,0 +1,19 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// layoutMigrator moves the stored files into the current layout of the data dir
+type layoutMigrator interface {
+	MigrateLayout() error
+}
+
+// migrateLayout migrates the data dir in the background, the files stay
+// available while they are moved
+func (app *App) migrateLayout() {
+	err := app.layout.MigrateLayout()
+	if err != nil {
+		log.Error("[layout] cannot migrate the data dir, will retry on the next start: ", err)
+	}
+}
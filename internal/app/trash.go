@@ -0,0 +1,45 @@
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval how often the expired trash is purged
+const trashPurgeInterval = time.Hour
+
+// trashPurger purges the trash of a user
+type trashPurger interface {
+	PurgeTrash(uid string, sync15 bool, before time.Time) (int, error)
+}
+
+// purgeTrash periodically purges the documents trashed longer than the retention
+func (app *App) purgeTrash(retention time.Duration) {
+	log.Info("Purging documents trashed for longer than: ", retention)
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			users, err := app.userStorer.GetUsers()
+			if err != nil {
+				log.Error("[trash] cannot list users ", err)
+				continue
+			}
+			before := time.Now().Add(-retention)
+			for _, u := range users {
+				purged, err := app.trash.PurgeTrash(u.ID, u.Sync15, before)
+				if err != nil {
+					log.Error("[trash] ", u.ID, " ", err)
+				}
+				if purged > 0 {
+					log.Info("[trash] purged ", purged, " documents of ", u.ID)
+				}
+			}
+		case <-app.quit:
+			return
+		}
+	}
+}
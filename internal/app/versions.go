@@ -0,0 +1,20 @@
+package app
+
+import (
+	"errors"
+	"os"
+
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+// storedVersion the version of the document on the server, 0 when it is new
+func (app *App) storedVersion(uid, id string) (int, error) {
+	doc, err := app.metaStorer.GetMetadata(uid, id)
+	if err == nil {
+		return doc.Version, nil
+	}
+	if os.IsNotExist(err) || errors.Is(err, storage.ErrorNotFound) {
+		return 0, nil
+	}
+	return 0, err
+}
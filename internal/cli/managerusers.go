@@ -3,10 +3,15 @@ package cli
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/config"
 	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
 	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/migration"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+	"github.com/zgs225/rmfakecloud/internal/storage/s3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -34,6 +39,7 @@ func (cli *Cli) SetUser(args []string) {
 	pass := userParam.String("p", "", "password")
 	admin := userParam.Bool("a", false, "isadmmin")
 	sync15 := userParam.Bool("s", false, "should the user use the new sync")
+	quota := userParam.String("q", "", "storage quota, eg. 5G (0: default, -1: unlimited)")
 
 	userParam.Parse(args)
 	if *username == "" {
@@ -61,6 +67,12 @@ func (cli *Cli) SetUser(args []string) {
 	}
 	usr.IsAdmin = *admin
 	usr.Sync15 = *sync15
+	if *quota != "" {
+		usr.Quota, err = config.ParseSize(*quota)
+		if err != nil {
+			log.Fatal("invalid quota: ", err)
+		}
+	}
 
 	err = cli.storage.UpdateUser(usr)
 	if err != nil {
@@ -69,18 +81,253 @@ func (cli *Cli) SetUser(args []string) {
 	log.Info("Updated/created the user")
 }
 
+// CollectGarbage removes the unreferenced sync15 blobs
+func (cli *Cli) CollectGarbage(args []string) {
+	gcParam := flag.NewFlagSet("gc", flag.ExitOnError)
+	username := gcParam.String("u", "", "username (default: all sync15 users)")
+	keep := gcParam.Int("k", cli.storage.Cfg.GCKeepRoots, "number of historical roots to keep")
+	dryRun := gcParam.Bool("n", false, "dry run, only report what would be removed")
+
+	gcParam.Parse(args)
+
+	var uids []string
+	if *username != "" {
+		uids = append(uids, *username)
+	} else {
+		users, err := cli.storage.GetUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			if u.Sync15 {
+				uids = append(uids, u.ID)
+			}
+		}
+	}
+
+	for _, uid := range uids {
+		report, err := cli.backend.CollectGarbage(uid, *keep, *dryRun)
+		if err != nil {
+			log.Error(uid, ": ", err)
+			continue
+		}
+		verb := "removed"
+		if *dryRun {
+			verb = "reclaimable"
+		}
+		fmt.Printf("%s\tscanned: %d\treferenced: %d\t%s: %d blobs, %d bytes\n",
+			uid, report.Scanned, report.Referenced, verb, len(report.Unreferenced), report.ReclaimableBytes)
+	}
+}
+
+// CheckBlobs verifies the sync15 blobs and optionally repairs them
+func (cli *Cli) CheckBlobs(args []string) {
+	fsckParam := flag.NewFlagSet("fsck", flag.ExitOnError)
+	username := fsckParam.String("u", "", "username (default: all sync15 users)")
+	repair := fsckParam.Bool("r", false, "quarantine the corrupt blobs and rebuild the cached tree")
+
+	fsckParam.Parse(args)
+
+	var uids []string
+	if *username != "" {
+		uids = append(uids, *username)
+	} else {
+		users, err := cli.storage.GetUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			if u.Sync15 {
+				uids = append(uids, u.ID)
+			}
+		}
+	}
+
+	for _, uid := range uids {
+		report, err := cli.backend.CheckBlobs(uid, *repair)
+		if err != nil {
+			log.Error(uid, ": ", err)
+			continue
+		}
+		status := "ok"
+		if !report.Healthy() {
+			status = "errors"
+		}
+		fmt.Printf("%s\t%s\tgeneration: %d\tdocuments: %d\tblobs: %d\tstale cache: %t\n",
+			uid, status, report.Generation, report.Documents, report.Scanned, report.StaleCache)
+		for _, problems := range []struct {
+			kind    string
+			entries []string
+		}{
+			{"corrupt", report.Corrupt},
+			{"dangling", report.Dangling},
+			{"size mismatch", report.SizeMismatch},
+			{"unparsable", report.Unparsable},
+			{"quarantined", report.Quarantined},
+		} {
+			for _, e := range problems.entries {
+				fmt.Printf("\t%s: %s\n", problems.kind, e)
+			}
+		}
+		if report.CacheRebuilt {
+			fmt.Println("\tcached tree rebuilt")
+		}
+	}
+}
+
+// RootHistory lists, inspects and restores the sync15 root generations
+func (cli *Cli) RootHistory(args []string) {
+	historyParam := flag.NewFlagSet("history", flag.ExitOnError)
+	username := historyParam.String("u", "", "username")
+	generation := historyParam.Int64("g", 0, "list the documents of this generation")
+	restore := historyParam.Bool("r", false, "restore the generation (-g) as a new one")
+
+	historyParam.Parse(args)
+	if *username == "" {
+		historyParam.PrintDefaults()
+		return
+	}
+
+	if *generation == 0 {
+		history, err := cli.backend.RootHistory(*username)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, h := range history {
+			device := h.DeviceID
+			if device == "" {
+				device = "-"
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\n", h.Generation, h.Timestamp.Format(time.RFC3339), h.Hash, device)
+		}
+		return
+	}
+
+	if *restore {
+		newGen, err := cli.backend.RestoreRoot(*username, *generation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Restored generation %d as %d, the devices will resync", *generation, newGen)
+		return
+	}
+
+	tree, err := cli.backend.GetTreeAt(*username, *generation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range tree.Docs {
+		fmt.Printf("%s\t%s\t%s\t%s\n", d.EntryName, d.CollectionType, d.Parent, d.DocumentName)
+	}
+}
+
+// backend maintenance of the documents and the sync15 blobs
+type backend interface {
+	migration.DocumentStorer
+	migration.BlobStorer
+	CollectGarbage(uid string, keepRoots int, dryRun bool) (*storage.GarbageReport, error)
+	CheckBlobs(uid string, repair bool) (*storage.FsckReport, error)
+	RootHistory(uid string) ([]storage.RootGeneration, error)
+	GetTreeAt(uid string, generation int64) (*models.HashTree, error)
+	RestoreRoot(uid string, generation int64) (int64, error)
+}
+
+// Migrate converts the documents of a user to the other sync version and switches the user
+func (cli *Cli) Migrate(args []string) {
+	migrateParam := flag.NewFlagSet("migrate", flag.ExitOnError)
+	username := migrateParam.String("u", "", "username")
+	to := migrateParam.Int("to", 15, "the target sync version, 10 or 15")
+
+	migrateParam.Parse(args)
+	if *username == "" || (*to != 10 && *to != 15) {
+		migrateParam.PrintDefaults()
+		return
+	}
+
+	usr, err := cli.storage.GetUser(*username)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var report *storage.MigrationReport
+	if *to == 15 {
+		report, err = migration.ToSync15(usr.ID, cli.backend, cli.backend)
+	} else {
+		report, err = migration.ToSync10(usr.ID, cli.backend, cli.backend, storage.NewDocumentLocks())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usr.Sync15 = report.Sync15
+	err = cli.storage.UpdateUser(usr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\tmigrated: %d\tskipped: %d\n", usr.ID, report.Migrated, len(report.Skipped))
+}
+
+// Encrypt wraps the data keys with the current master key and encrypts the
+// files not encrypted with the current data key
+func (cli *Cli) Encrypt(args []string) {
+	encryptParam := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	username := encryptParam.String("u", "", "username (default: all users)")
+	newKey := encryptParam.Bool("k", false, "generate a new data key and re-encrypt the files with it")
+
+	encryptParam.Parse(args)
+
+	if len(cli.storage.Cfg.EncryptionKey) == 0 {
+		log.Fatal("no master key configured")
+	}
+
+	var uids []string
+	if *username != "" {
+		uids = append(uids, *username)
+	} else {
+		users, err := cli.storage.GetUsers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			uids = append(uids, u.ID)
+		}
+	}
+
+	for _, uid := range uids {
+		err := cli.storage.RotateKeys(uid, *newKey)
+		if err != nil {
+			log.Error(uid, ": ", err)
+			continue
+		}
+		count, err := cli.storage.EncryptUser(uid)
+		if err != nil {
+			log.Error(uid, ": ", err)
+			continue
+		}
+		fmt.Printf("%s	encrypted: %d files\n", uid, count)
+	}
+}
+
 // Cli cli interface
 type Cli struct {
 	storage *fs.FileSystemStorage
+	backend backend
 }
 
 // New creates
 func New(cfg *config.Config) *Cli {
-	storage := &fs.FileSystemStorage{
-		Cfg: cfg,
+	storage := fs.NewStorage(cfg)
+	var b backend = storage
+	if cfg.S3 != nil {
+		s3Storage, err := s3.NewStorage(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b = s3Storage
 	}
 	return &Cli{
 		storage: storage,
+		backend: b,
 	}
 
 }
@@ -95,6 +342,16 @@ func (cli *Cli) Handle(args []string) bool {
 			cli.SetUser(otherarg)
 		case "listusers":
 			cli.ListUsers(otherarg)
+		case "gc":
+			cli.CollectGarbage(otherarg)
+		case "fsck":
+			cli.CheckBlobs(otherarg)
+		case "history":
+			cli.RootHistory(otherarg)
+		case "migrate":
+			cli.Migrate(otherarg)
+		case "encrypt":
+			cli.Encrypt(otherarg)
 		case "rmuser":
 		default:
 			log.Warn("unknown command: ", cmd)
@@ -109,5 +366,10 @@ func Usage() string {
 	return `Commands:
 	setuser		create users / reset passwords
 	listusers	list available users
+	gc		remove unreferenced sync15 blobs
+	fsck		verify / repair the sync15 blobs
+	history		list / restore previous sync15 generations
+	migrate		move the documents of a user between sync10 and sync15
+	encrypt		encrypt the existing files / rotate the keys
 `
 }
@@ -2,11 +2,15 @@ package common
 
 import (
 	"errors"
+	"io"
+	"net/http"
 	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
 )
 
 var signingMethod = jwt.SigningMethodHS256
@@ -62,3 +66,54 @@ func ParamS(param string, c *gin.Context) string {
 	p := c.Param(param)
 	return Sanitize(p)
 }
+
+// CheckQuota aborts the request when the upload does not fit in the user's quota,
+// with 507 when there is no space left and 413 when the upload is too large.
+// The body of an upload of unknown size is aborted once it uses up the space left
+func CheckQuota(c *gin.Context, quota *storage.Quota, uid string, size int64) bool {
+	err := quota.Check(uid, size)
+	if err == nil && size < 0 {
+		var used, limit int64
+		used, limit, err = quota.Usage(uid)
+		if err == nil && limit > 0 {
+			c.Request.Body = &quotaReader{ReadCloser: c.Request.Body, c: c, left: limit - used}
+		}
+	}
+	switch err {
+	case nil:
+		return true
+	case storage.ErrorQuotaExceeded:
+		c.AbortWithStatusJSON(http.StatusInsufficientStorage, gin.H{"error": err.Error()})
+	case storage.ErrorTooLarge:
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	default:
+		log.Error("cannot check the quota of ", uid, ": ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+	return false
+}
+
+// quotaReader a body of unknown size, aborting the request with 507 when it
+// is larger than the space left
+type quotaReader struct {
+	io.ReadCloser
+	c    *gin.Context
+	left int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.left < 0 {
+		return 0, storage.ErrorQuotaExceeded
+	}
+	// one byte more tells a body filling the space left from a larger one
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		r.c.AbortWithStatusJSON(http.StatusInsufficientStorage, gin.H{"error": storage.ErrorQuotaExceeded.Error()})
+		return n, storage.ErrorQuotaExceeded
+	}
+	return n, err
+}
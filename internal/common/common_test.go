@@ -1,6 +1,16 @@
 package common
 
-import "testing"
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
 
 func Test_sanitized(t *testing.T) {
 	tests := []struct {
@@ -28,3 +38,44 @@ func Test_sanitized(t *testing.T) {
 		})
 	}
 }
+
+type testUsers struct {
+	storage.UserStorer
+	quota int64
+}
+
+func (u *testUsers) GetUser(uid string) (*model.User, error) {
+	return &model.User{ID: uid, Quota: u.quota}, nil
+}
+
+type testUsage int64
+
+func (u testUsage) GetUsage(uid string) (int64, error) {
+	return int64(u), nil
+}
+
+func TestCheckQuotaUnknownSize(t *testing.T) {
+	quota := storage.NewQuota(&testUsers{quota: 100}, testUsage(90), 0)
+	for _, tt := range []struct {
+		body   string
+		status int
+	}{
+		{body: strings.Repeat("x", 10), status: http.StatusOK},
+		{body: strings.Repeat("x", 11), status: http.StatusInsufficientStorage},
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+		c.Request.ContentLength = -1
+		if !CheckQuota(c, quota, "test", c.Request.ContentLength) {
+			t.Fatal("the upload was rejected before it was read")
+		}
+		_, err := ioutil.ReadAll(c.Request.Body)
+		if tt.status == http.StatusOK && err != nil {
+			t.Errorf("%d bytes: %v", len(tt.body), err)
+		}
+		if tt.status != http.StatusOK && (err != storage.ErrorQuotaExceeded || w.Code != tt.status) {
+			t.Errorf("%d bytes: expected %d, got %d %v", len(tt.body), tt.status, w.Code, err)
+		}
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"net/mail"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/email"
 	log "github.com/sirupsen/logrus"
@@ -29,6 +32,13 @@ const (
 	// DefaultHost fake url
 	DefaultHost = "local.appspot.com"
 
+	// DefaultGCKeepRoots number of historical roots whose blobs are kept
+	DefaultGCKeepRoots = 10
+	// DefaultTreeCacheSize number of users whose sync15 trees are kept in memory
+	DefaultTreeCacheSize = 100
+	// DefaultDocumentVersions number of previous versions kept of each sync 1.0 document
+	DefaultDocumentVersions = 5
+
 	// EnvLogLevel environment variable for the log level
 	EnvLogLevel = "LOGLEVEL"
 	// EnvLogFormat type of log format
@@ -72,8 +82,64 @@ const (
 	EnvLogFile     = "RM_LOGFILE"
 	envHTTPSCookie = "RM_HTTPS_COOKIE"
 	envTrustProxy  = "RM_TRUST_PROXY"
+
+	// envS3Bucket store the documents in this s3 bucket instead of the DataDir
+	envS3Bucket = "RM_S3_BUCKET"
+	// envS3Endpoint the url of the s3 compatible service
+	envS3Endpoint = "RM_S3_ENDPOINT"
+	// envS3Region the region of the bucket
+	envS3Region    = "RM_S3_REGION"
+	envS3AccessKey = "RM_S3_ACCESS_KEY"
+	envS3SecretKey = "RM_S3_SECRET_KEY"
+	// envS3Presign hand the devices presigned urls for the blobs
+	envS3Presign = "RM_S3_PRESIGN"
+
+	// envGCInterval how often to collect unreferenced sync15 blobs
+	envGCInterval = "RM_GC_INTERVAL"
+	// envGCKeepRoots how many historical roots to keep the blobs of
+	envGCKeepRoots = "RM_GC_KEEP_ROOTS"
+
+	// envDefaultQuota the storage limit of the users without their own
+	envDefaultQuota = "RM_DEFAULT_QUOTA"
+
+	// envTrashRetention how long trashed documents are kept
+	envTrashRetention = "RM_TRASH_RETENTION"
+
+	// envDocumentVersions how many previous versions of the sync 1.0 documents to keep
+	envDocumentVersions = "RM_DOCUMENT_VERSIONS"
+
+	// envTreeCacheSize how many users' sync15 trees to keep in memory
+	envTreeCacheSize = "RM_TREE_CACHE_SIZE"
+
+	// envSharedBlobs keep the sync15 blobs stored by several users only once
+	envSharedBlobs = "RM_SHARED_BLOBS"
+
+	// envCompressBlobs compress the stored blobs and documents
+	envCompressBlobs = "RM_COMPRESS_BLOBS"
+
+	// envMergeRoots merge concurrent sync15 root updates which changed different documents
+	envMergeRoots = "RM_MERGE_ROOTS"
+
+	// envEncryptionKey the master key which wraps the data keys of the users,
+	// base64 encoded 32 bytes
+	envEncryptionKey = "RM_ENCRYPTION_KEY"
+	// envPreviousEncryptionKeys the master keys replaced by a rotation, comma separated
+	envPreviousEncryptionKeys = "RM_ENCRYPTION_PREVIOUS_KEYS"
+	// encryptionKeySize the size of the master keys
+	encryptionKeySize = 32
 )
 
+// S3Config s3 compatible object storage
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Presign the devices get the blobs directly from the bucket
+	Presign bool
+}
+
 // Config config
 type Config struct {
 	Port              string
@@ -90,6 +156,27 @@ type Config struct {
 	HWRHmac           string
 	HTTPSCookie       bool
 	TrustProxy        bool
+	S3                *S3Config
+	GCInterval        time.Duration
+	GCKeepRoots       int
+	// DefaultQuota storage limit in bytes of the users without their own, 0 is unlimited
+	DefaultQuota int64
+	// TrashRetention trashed documents are purged after it, 0 keeps them
+	TrashRetention time.Duration
+	// DocumentVersions the previous versions kept of each sync 1.0 document, 0 keeps none
+	DocumentVersions int
+	// TreeCacheSize the number of users whose sync15 trees are kept in memory
+	TreeCacheSize int
+	// SharedBlobs the sync15 blobs are hard links to a store shared by the users
+	SharedBlobs bool
+	// CompressBlobs the blobs and documents are stored compressed
+	CompressBlobs bool
+	// MergeRoots a root uploaded on top of an older generation is merged when possible
+	MergeRoots bool
+	// EncryptionKey the master key, the files of the users are encrypted when set
+	EncryptionKey []byte
+	// PreviousEncryptionKeys older master keys, still used to unwrap the data keys
+	PreviousEncryptionKeys [][]byte
 }
 
 // Verify verify
@@ -196,6 +283,87 @@ func FromEnv() *Config {
 
 	trustProxy, _ := strconv.ParseBool(os.Getenv(envTrustProxy))
 
+	var s3Cfg *S3Config
+	if bucket := os.Getenv(envS3Bucket); bucket != "" {
+		presign, _ := strconv.ParseBool(os.Getenv(envS3Presign))
+		s3Cfg = &S3Config{
+			Endpoint:  os.Getenv(envS3Endpoint),
+			Region:    os.Getenv(envS3Region),
+			Bucket:    bucket,
+			AccessKey: os.Getenv(envS3AccessKey),
+			SecretKey: os.Getenv(envS3SecretKey),
+			Presign:   presign,
+		}
+		if s3Cfg.Endpoint == "" {
+			s3Cfg.Endpoint = "https://s3.amazonaws.com"
+		}
+		if s3Cfg.Region == "" {
+			s3Cfg.Region = "us-east-1"
+		}
+	}
+
+	var gcInterval time.Duration
+	if gc := os.Getenv(envGCInterval); gc != "" {
+		gcInterval, err = time.ParseDuration(gc)
+		if err != nil {
+			log.Fatal(envGCInterval, " is not a duration: ", err)
+		}
+	}
+	gcKeepRoots := DefaultGCKeepRoots
+	if keep := os.Getenv(envGCKeepRoots); keep != "" {
+		gcKeepRoots, err = strconv.Atoi(keep)
+		if err != nil {
+			log.Fatal(envGCKeepRoots, " is not a number: ", err)
+		}
+	}
+
+	var defaultQuota int64
+	if quota := os.Getenv(envDefaultQuota); quota != "" {
+		defaultQuota, err = ParseSize(quota)
+		if err != nil {
+			log.Fatal(envDefaultQuota, " is not a size: ", err)
+		}
+	}
+
+	var trashRetention time.Duration
+	if retention := os.Getenv(envTrashRetention); retention != "" {
+		trashRetention, err = time.ParseDuration(retention)
+		if err != nil {
+			log.Fatal(envTrashRetention, " is not a duration: ", err)
+		}
+	}
+
+	documentVersions := DefaultDocumentVersions
+	if versions := os.Getenv(envDocumentVersions); versions != "" {
+		documentVersions, err = strconv.Atoi(versions)
+		if err != nil || documentVersions < 0 {
+			log.Fatal(envDocumentVersions, " is not a number: ", versions)
+		}
+	}
+
+	treeCacheSize := DefaultTreeCacheSize
+	if size := os.Getenv(envTreeCacheSize); size != "" {
+		treeCacheSize, err = strconv.Atoi(size)
+		if err != nil {
+			log.Fatal(envTreeCacheSize, " is not a number: ", err)
+		}
+	}
+
+	sharedBlobs, _ := strconv.ParseBool(os.Getenv(envSharedBlobs))
+	compressBlobs, _ := strconv.ParseBool(os.Getenv(envCompressBlobs))
+	mergeRoots, _ := strconv.ParseBool(os.Getenv(envMergeRoots))
+
+	var encryptionKey []byte
+	if key := os.Getenv(envEncryptionKey); key != "" {
+		encryptionKey = parseEncryptionKey(envEncryptionKey, key)
+	}
+	var previousEncryptionKeys [][]byte
+	if keys := os.Getenv(envPreviousEncryptionKeys); keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			previousEncryptionKeys = append(previousEncryptionKeys, parseEncryptionKey(envPreviousEncryptionKeys, strings.TrimSpace(key)))
+		}
+	}
+
 	cfg := Config{
 		Port:              port,
 		StorageURL:        uploadURL,
@@ -209,10 +377,53 @@ func FromEnv() *Config {
 		HWRHmac:           os.Getenv(envHwrHmac),
 		HTTPSCookie:       httpsCookie,
 		TrustProxy:        trustProxy,
+		S3:                s3Cfg,
+		GCInterval:        gcInterval,
+		GCKeepRoots:       gcKeepRoots,
+		DefaultQuota:      defaultQuota,
+		TrashRetention:    trashRetention,
+		DocumentVersions:  documentVersions,
+		TreeCacheSize:     treeCacheSize,
+		SharedBlobs:       sharedBlobs,
+		CompressBlobs:     compressBlobs,
+		MergeRoots:        mergeRoots,
+
+		EncryptionKey:          encryptionKey,
+		PreviousEncryptionKeys: previousEncryptionKeys,
 	}
 	return &cfg
 }
 
+// parseEncryptionKey decodes a base64 master key
+func parseEncryptionKey(env, key string) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		log.Fatal(env, " is not base64: ", err)
+	}
+	if len(decoded) != encryptionKeySize {
+		log.Fatalf("%s has to be %d bytes, not %d", env, encryptionKeySize, len(decoded))
+	}
+	return decoded
+}
+
+// ParseSize parses a size in bytes, with an optional K, M, G or T suffix (powers of 1024)
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(size, unit) {
+			size = strings.TrimSuffix(size, unit)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
 // EnvVars env vars usage
 func EnvVars() string {
 	return fmt.Sprintf(`
@@ -234,6 +445,43 @@ General:
 	%s Send auth cookie only via https
 	%s	Trust the proxy for X-Forwarded-For/X-Real-IP (set only if behind a proxy)
 
+S3 compatible object storage (instead of %s):
+	%s	Bucket to store the documents in
+	%s	Service url (default: https://s3.amazonaws.com)
+	%s	Region (default: us-east-1)
+	%s
+	%s
+	%s	Let the devices access the blobs with presigned urls
+
+Sync 1.5 garbage collection:
+	%s	How often to remove unreferenced blobs, eg. 24h (default: disabled)
+	%s	Number of historical roots to keep (default: %d)
+
+Quotas:
+	%s	Storage limit per user, eg. 5G (default: unlimited)
+
+Trash:
+	%s	Purge trashed documents after, eg. 720h (default: never)
+
+Document versions:
+	%s	Number of previous versions kept of each sync 1.0 document, 0 keeps none (default: %d)
+
+Caching:
+	%s	Number of users whose sync 1.5 trees are kept in memory (default: %d)
+
+Deduplication:
+	%s	Store the sync 1.5 blobs shared by several users only once (default: false)
+
+Compression:
+	%s	Compress the blobs and documents written to the data dir (default: false)
+
+Sync 1.5 conflicts:
+	%s	Merge the roots uploaded concurrently by two devices when they changed different documents (default: false)
+
+Encryption:
+	%s	Master key encrypting the files of the users, base64 of 32 bytes, e.g. openssl rand -base64 32
+	%s	Master keys replaced by a rotation, comma separated
+
 Emails, smtp:
 	%s
 	%s
@@ -261,6 +509,37 @@ myScript hwr (needs a developer account):
 		envHTTPSCookie,
 		envTrustProxy,
 
+		envDataDir,
+		envS3Bucket,
+		envS3Endpoint,
+		envS3Region,
+		envS3AccessKey,
+		envS3SecretKey,
+		envS3Presign,
+
+		envGCInterval,
+		envGCKeepRoots,
+		DefaultGCKeepRoots,
+
+		envDefaultQuota,
+
+		envTrashRetention,
+
+		envDocumentVersions,
+		DefaultDocumentVersions,
+
+		envTreeCacheSize,
+		DefaultTreeCacheSize,
+
+		envSharedBlobs,
+
+		envCompressBlobs,
+
+		envMergeRoots,
+
+		envEncryptionKey,
+		envPreviousEncryptionKeys,
+
 		envSMTPServer,
 		envSMTPUsername,
 		envSMTPPassword,
@@ -49,7 +49,9 @@ type User struct {
 	UpdatedAt     time.Time
 	IsAdmin       bool
 	// Sync15 if the user should use this sync type (which uses a lot less bandwidth)
-	Sync15       bool
+	Sync15 bool
+	// Quota the storage limit in bytes, 0 uses the default quota and -1 is unlimited
+	Quota        int64
 	Integrations []IntegrationConfig
 }
 
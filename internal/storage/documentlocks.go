@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pendingUpload a version a device was given an upload url for, the
+// document is reserved for it until it updates the status or the url expires
+type pendingUpload struct {
+	version  int
+	deviceID string
+	expires  time.Time
+}
+
+// UserDocuments the sync 1.0 uploads in progress of a user, the version
+// checks and the metadata writes of the user are made with it locked
+type UserDocuments struct {
+	mu      sync.Mutex
+	locks   *DocumentLocks
+	uid     string
+	uploads map[string]pendingUpload
+	// holders the requests holding or waiting for the lock, counted under
+	// the lock of DocumentLocks
+	holders int
+}
+
+// DocumentLocks serializes the sync 1.0 metadata checks and updates of each
+// user, so that the devices and the web ui writing concurrently do not
+// overwrite each other
+type DocumentLocks struct {
+	mu    sync.Mutex
+	users map[string]*UserDocuments
+}
+
+// NewDocumentLocks the locks of the documents of all users
+func NewDocumentLocks() *DocumentLocks {
+	return &DocumentLocks{users: map[string]*UserDocuments{}}
+}
+
+// Lock the documents of the user, unlock them once the metadata is written
+func (l *DocumentLocks) Lock(uid string) *UserDocuments {
+	l.mu.Lock()
+	docs, ok := l.users[uid]
+	if !ok {
+		docs = &UserDocuments{locks: l, uid: uid, uploads: map[string]pendingUpload{}}
+		l.users[uid] = docs
+	}
+	docs.holders++
+	l.mu.Unlock()
+	docs.mu.Lock()
+	return docs
+}
+
+// Unlock the documents, they are forgotten once nobody waits for them and
+// no upload is in progress
+func (u *UserDocuments) Unlock() {
+	now := time.Now()
+	for id, pending := range u.uploads {
+		if now.After(pending.expires) {
+			delete(u.uploads, id)
+		}
+	}
+	l := u.locks
+	l.mu.Lock()
+	u.holders--
+	if u.holders == 0 && len(u.uploads) == 0 {
+		delete(l.users, u.uid)
+	}
+	l.mu.Unlock()
+	u.mu.Unlock()
+}
+
+// reservedBy the other device uploading the document, if any
+func (u *UserDocuments) reservedBy(id, deviceID string, now time.Time) (pendingUpload, bool) {
+	pending, ok := u.uploads[id]
+	if !ok {
+		return pending, false
+	}
+	if now.After(pending.expires) {
+		delete(u.uploads, id)
+		return pending, false
+	}
+	return pending, pending.deviceID != deviceID
+}
+
+// ReserveUpload checks the version a device wants to upload and reserves
+// the document for it until the url expires
+func (u *UserDocuments) ReserveUpload(id, deviceID string, stored, version int, expires time.Time) error {
+	err := u.CheckVersion(id, deviceID, stored, version)
+	if err != nil {
+		return err
+	}
+	u.uploads[id] = pendingUpload{version: version, deviceID: deviceID, expires: expires}
+	return nil
+}
+
+// CheckVersion the version has to be newer than the stored one, and than
+// the one another device is uploading
+func (u *UserDocuments) CheckVersion(id, deviceID string, stored, version int) error {
+	if version <= stored {
+		return fmt.Errorf("version %d is not newer than the version %d on the server", version, stored)
+	}
+	if pending, ok := u.reservedBy(id, deviceID, time.Now()); ok && pending.version >= version {
+		return fmt.Errorf("version %d is being uploaded by another device", pending.version)
+	}
+	return nil
+}
+
+// Release the reservation of the document once the version is stored
+func (u *UserDocuments) Release(id string, version int) {
+	if pending, ok := u.uploads[id]; ok && pending.version <= version {
+		delete(u.uploads, id)
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+// countUsers counts the users having locks
+func countUsers(l *DocumentLocks) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.users)
+}
+
+func TestDocumentVersionChecks(t *testing.T) {
+	locks := NewDocumentLocks()
+	expires := time.Now().Add(time.Minute)
+
+	docs := locks.Lock("user")
+	defer docs.Unlock()
+
+	if err := docs.ReserveUpload("doc", "tablet1", 5, 5, expires); err == nil {
+		t.Error("a stale upload was accepted")
+	}
+	if err := docs.ReserveUpload("doc", "tablet1", 5, 6, expires); err != nil {
+		t.Fatal(err)
+	}
+	// the same version from another device while it is uploaded
+	if err := docs.ReserveUpload("doc", "tablet2", 5, 6, expires); err == nil {
+		t.Error("a concurrent upload was accepted")
+	}
+	if err := docs.CheckVersion("doc", "tablet2", 5, 6); err == nil {
+		t.Error("a concurrent status was accepted")
+	}
+	if err := docs.CheckVersion("doc", "tablet1", 5, 6); err != nil {
+		t.Error(err)
+	}
+	docs.Release("doc", 6)
+	if err := docs.CheckVersion("doc", "tablet2", 6, 6); err == nil {
+		t.Error("a stale status was accepted")
+	}
+	if err := docs.ReserveUpload("doc", "tablet2", 6, 7, expires); err != nil {
+		t.Error(err)
+	}
+
+	// the reservation ends with the upload url
+	if err := docs.ReserveUpload("other", "tablet1", 0, 1, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := docs.ReserveUpload("other", "tablet2", 0, 1, expires); err != nil {
+		t.Error("an expired upload still reserves the document: ", err)
+	}
+}
+
+func TestDocumentLocksArePruned(t *testing.T) {
+	locks := NewDocumentLocks()
+
+	docs := locks.Lock("user")
+	if err := docs.ReserveUpload("doc", "tablet1", 0, 1, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	docs.Unlock()
+	if countUsers(locks) != 1 {
+		t.Fatal("the user was forgotten during an upload")
+	}
+
+	docs = locks.Lock("user")
+	docs.Release("doc", 1)
+	docs.Unlock()
+	if countUsers(locks) != 0 {
+		t.Error("the user is kept without uploads")
+	}
+
+	// an expired upload does not keep the user
+	docs = locks.Lock("other")
+	if err := docs.ReserveUpload("doc", "tablet1", 0, 1, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	docs.Unlock()
+	if countUsers(locks) != 0 {
+		t.Error("the user is kept with an expired upload")
+	}
+}
+
+func TestDocumentLocksSerializeTheUser(t *testing.T) {
+	locks := NewDocumentLocks()
+	docs := locks.Lock("user")
+
+	locked := make(chan struct{})
+	go func() {
+		other := locks.Lock("user")
+		other.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the documents were locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	docs.Unlock()
+	<-locked
+	if countUsers(locks) != 0 {
+		t.Error("the user is kept once unlocked")
+	}
+}
@@ -0,0 +1,429 @@
+package exporter
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+
+	pdf "github.com/unidoc/unipdf/v3/model"
+	"github.com/unidoc/unipdf/v3/render"
+	"golang.org/x/image/vector"
+)
+
+// The formats the documents are exported to
+const (
+	FormatPDF = "pdf"
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+const (
+	// DefaultDPI the resolution of the png pages and of the backgrounds of the svg pages
+	DefaultDPI = 150
+	// MaxDPI bounds the size of the rendered pages
+	MaxDPI = 600
+	// discSegments the sides of the polygons approximating the round caps
+	discSegments = 16
+)
+
+// ErrorUnsupportedFormat the document cannot be exported to the format
+var ErrorUnsupportedFormat = errors.New("unsupported export format")
+
+// ErrorNoPages none of the pages of the document is selected by the options
+var ErrorNoPages = errors.New("no pages selected")
+
+// IsFormat whether the documents can be exported to the format
+func IsFormat(format string) bool {
+	switch format {
+	case FormatPDF, FormatPNG, FormatSVG:
+		return true
+	}
+	return false
+}
+
+// ImageGenerator renders the pages as png or svg images, the strokes over
+// the page of the pdf or a white page
+type ImageGenerator struct {
+	pdfReader *pdf.PdfReader
+}
+
+// imagePage a page to render, its size in points
+type imagePage struct {
+	number     int
+	width      float64
+	height     float64
+	background *pdf.PdfPage
+	strokes    []stroke
+}
+
+// Generate writes the image of a single page, or a zip with one per page
+// named by the number of the page in the document
+func (g *ImageGenerator) Generate(a *MyArchive, output io.Writer, format string, dpi int, options PdfGeneratorOptions) error {
+	if format != FormatPNG && format != FormatSVG {
+		return ErrorUnsupportedFormat
+	}
+	pages, err := g.pages(a, &options)
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return ErrorNoPages
+	}
+	if len(pages) == 1 {
+		return g.writePage(output, &pages[0], format, dpi)
+	}
+
+	z := zip.NewWriter(output)
+	for i := range pages {
+		w, err := z.Create(fmt.Sprintf("page-%03d.%s", pages[i].number, format))
+		if err != nil {
+			return err
+		}
+		err = g.writePage(w, &pages[i], format, dpi)
+		if err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// pages the selected pages of the notebook, or of the pdf when it has no
+// annotations
+func (g *ImageGenerator) pages(a *MyArchive, options *PdfGeneratorOptions) ([]imagePage, error) {
+	pdfPages := 0
+	if a.PayloadReader != nil {
+		reader, err := openPdf(a.PayloadReader)
+		if err != nil {
+			return nil, err
+		}
+		g.pdfReader = reader
+		pdfPages, err = reader.GetNumPages()
+		if err != nil {
+			return nil, err
+		}
+	}
+	count := len(a.Pages)
+	if count == 0 {
+		count = pdfPages
+	}
+
+	pages := make([]imagePage, 0, count)
+	for i := 0; i < count; i++ {
+		hasContent := i < len(a.Pages) && a.Pages[i].Data != nil
+		if !options.selected(i+1, hasContent) {
+			continue
+		}
+		page := imagePage{
+			number: i + 1,
+			width:  rmPageSize[0],
+			height: rmPageSize[1],
+		}
+		if i < pdfPages {
+			background, err := g.pdfReader.GetPage(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			mbox, err := background.GetMediaBox()
+			if err != nil {
+				return nil, err
+			}
+			page.width = mbox.Urx - mbox.Llx
+			page.height = mbox.Ury - mbox.Lly
+			if !options.AnnotationsOnly {
+				page.background = background
+			}
+		}
+		if i < len(a.Pages) {
+			page.strokes = pageStrokes(a.Pages[i].Data)
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+func (g *ImageGenerator) writePage(w io.Writer, page *imagePage, format string, dpi int) error {
+	if format == FormatSVG {
+		return writeSVG(w, page, dpi)
+	}
+	img, err := renderPage(page, dpi)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// renderBackground the page of the pdf at the width in pixels, on white
+func renderBackground(page *imagePage, width, height int) (*image.NRGBA, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	if page.background == nil {
+		return img, nil
+	}
+	device := render.NewImageDevice()
+	device.OutputWidth = width
+	background, err := device.Render(page.background)
+	if err != nil {
+		return nil, err
+	}
+	draw.Draw(img, img.Bounds(), background, background.Bounds().Min, draw.Over)
+	return img, nil
+}
+
+// pixelSize the size of the page in pixels at the resolution
+func pixelSize(page *imagePage, dpi int) (int, int) {
+	return int(math.Ceil(page.width * float64(dpi) / 72)), int(math.Ceil(page.height * float64(dpi) / 72))
+}
+
+// renderPage rasterizes the strokes over the background of the page
+func renderPage(page *imagePage, dpi int) (*image.NRGBA, error) {
+	width, height := pixelSize(page, dpi)
+	img, err := renderBackground(page, width, height)
+	if err != nil {
+		return nil, err
+	}
+	scale := deviceScale(page.width, page.height) * float64(dpi) / 72
+	for _, s := range page.strokes {
+		rasterizeStroke(img, s, scale)
+	}
+	return img, nil
+}
+
+// flattenSteps the length in pixels of the lines approximating the curves
+const flattenSteps = 2
+
+// rasterizeStroke draws the runs of the stroke as segments with round joins
+// and caps. The coverage of the runs is merged before the stroke is drawn, so
+// that translucent strokes do not darken where the segments overlap
+func rasterizeStroke(dst *image.NRGBA, s stroke, scale float64) {
+	runs := make([][]vec, len(s.runs))
+	radiuses := make([]float64, len(s.runs))
+	bounds := image.Rectangle{}
+	for i, r := range s.runs {
+		runs[i] = flatten(r.segments, scale)
+		radiuses[i] = math.Max(r.width*scale/2, 0.5)
+		bounds = bounds.Union(pointsBounds(runs[i], radiuses[i]))
+	}
+	bounds = bounds.Intersect(dst.Bounds())
+	if bounds.Empty() {
+		return
+	}
+
+	mask := image.NewAlpha(bounds)
+	for i, r := range s.runs {
+		runBounds := pointsBounds(runs[i], radiuses[i]).Intersect(bounds)
+		if runBounds.Empty() {
+			continue
+		}
+		coverage := rasterizeRun(runs[i], radiuses[i], runBounds)
+		opacity := uint16(math.Round(r.opacity * 0xff))
+		for y := runBounds.Min.Y; y < runBounds.Max.Y; y++ {
+			for x := runBounds.Min.X; x < runBounds.Max.X; x++ {
+				a := uint8(uint16(coverage.AlphaAt(x, y).A) * opacity / 0xff)
+				if a > mask.AlphaAt(x, y).A {
+					mask.SetAlpha(x, y, color.Alpha{a})
+				}
+			}
+		}
+	}
+	if s.highlight {
+		multiply(dst, mask, s.color)
+		return
+	}
+	draw.DrawMask(dst, bounds, image.NewUniform(s.color), image.Point{}, mask, bounds.Min, draw.Over)
+}
+
+// flatten the points of the curves of the run, in pixels
+func flatten(segments []segment, scale float64) []vec {
+	points := []vec{segments[0].p0.scale(scale)}
+	for _, s := range segments {
+		steps := int(math.Ceil(s.length() * scale / flattenSteps))
+		if steps < 1 {
+			steps = 1
+		}
+		if steps > 32 {
+			steps = 32
+		}
+		for i := 1; i <= steps; i++ {
+			points = append(points, s.at(float64(i)/float64(steps)).scale(scale))
+		}
+	}
+	return points
+}
+
+// pointsBounds the pixels covered by the points, of the radius
+func pointsBounds(points []vec, radius float64) image.Rectangle {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range points {
+		minX, minY = math.Min(minX, p.x), math.Min(minY, p.y)
+		maxX, maxY = math.Max(maxX, p.x), math.Max(maxY, p.y)
+	}
+	return image.Rect(
+		int(math.Floor(minX-radius)), int(math.Floor(minY-radius)),
+		int(math.Ceil(maxX+radius)), int(math.Ceil(maxY+radius)),
+	)
+}
+
+// rasterizeRun the coverage of the segments of the run, the rasterizer only
+// covers the bounds
+func rasterizeRun(points []vec, radius float64, bounds image.Rectangle) *image.Alpha {
+	ox, oy := float64(bounds.Min.X), float64(bounds.Min.Y)
+	r := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+	var px, py float64
+	for i, p := range points {
+		x, y := p.x-ox, p.y-oy
+		addDisc(r, x, y, radius)
+		if i > 0 {
+			addSegment(r, px, py, x, y, radius)
+		}
+		px, py = x, y
+	}
+	coverage := image.NewAlpha(bounds)
+	r.Draw(coverage, bounds, image.Opaque, image.Point{})
+	return coverage
+}
+
+// multiply blends the color with what it covers, as a highlighter
+func multiply(dst *image.NRGBA, mask *image.Alpha, c color.NRGBA) {
+	b := mask.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := float64(mask.AlphaAt(x, y).A) / 0xff
+			if a == 0 {
+				continue
+			}
+			under := dst.NRGBAAt(x, y)
+			blend := func(u, v uint8) uint8 {
+				return uint8(math.Round(float64(u)*(1-a) + float64(u)*float64(v)/0xff*a))
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{blend(under.R, c.R), blend(under.G, c.G), blend(under.B, c.B), under.A})
+		}
+	}
+}
+
+// addSegment adds the rectangle around the segment
+func addSegment(r *vector.Rasterizer, x0, y0, x1, y1, radius float64) {
+	dx, dy := x1-x0, y1-y0
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return
+	}
+	nx, ny := -dy/length*radius, dx/length*radius
+	addPolygon(r, [][2]float64{
+		{x0 + nx, y0 + ny},
+		{x1 + nx, y1 + ny},
+		{x1 - nx, y1 - ny},
+		{x0 - nx, y0 - ny},
+	})
+}
+
+// addDisc adds a polygon approximating the disc
+func addDisc(r *vector.Rasterizer, x, y, radius float64) {
+	points := make([][2]float64, discSegments)
+	for i := range points {
+		angle := 2 * math.Pi * float64(i) / discSegments
+		points[i] = [2]float64{x + radius*math.Cos(angle), y + radius*math.Sin(angle)}
+	}
+	addPolygon(r, points)
+}
+
+// addPolygon adds the polygon clockwise, the rasterizer sums the coverage of
+// the polygons and those in the other direction would cancel it out
+func addPolygon(r *vector.Rasterizer, points [][2]float64) {
+	var area float64
+	for i := range points {
+		j := (i + 1) % len(points)
+		area += points[i][0]*points[j][1] - points[j][0]*points[i][1]
+	}
+	if area < 0 {
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	r.MoveTo(float32(points[0][0]), float32(points[0][1]))
+	for _, p := range points[1:] {
+		r.LineTo(float32(p[0]), float32(p[1]))
+	}
+	r.ClosePath()
+}
+
+// writeSVG writes the strokes as paths, the background of a pdf page is
+// embedded as a png at the resolution
+func writeSVG(w io.Writer, page *imagePage, dpi int) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%spt\" height=\"%spt\" viewBox=\"0 0 %s %s\">\n",
+		svgNumber(page.width), svgNumber(page.height), svgNumber(page.width), svgNumber(page.height))
+
+	if page.background != nil {
+		width, height := pixelSize(page, dpi)
+		background, err := renderBackground(page, width, height)
+		if err != nil {
+			return err
+		}
+		var encoded bytes.Buffer
+		err = png.Encode(&encoded, background)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "<image x=\"0\" y=\"0\" width=\"%s\" height=\"%s\" href=\"data:image/png;base64,%s\"/>\n",
+			svgNumber(page.width), svgNumber(page.height), base64.StdEncoding.EncodeToString(encoded.Bytes()))
+	} else {
+		fmt.Fprintf(out, "<rect width=\"%s\" height=\"%s\" fill=\"#ffffff\"/>\n", svgNumber(page.width), svgNumber(page.height))
+	}
+
+	fmt.Fprintf(out, "<g transform=\"scale(%s)\" fill=\"none\" stroke-linecap=\"round\" stroke-linejoin=\"round\">\n",
+		svgNumber(deviceScale(page.width, page.height)))
+	for _, s := range page.strokes {
+		for i, r := range s.runs {
+			writeSVGRun(out, r, s, s.roundCaps(i))
+		}
+	}
+	out.WriteString("</g>\n</svg>\n")
+	return out.Flush()
+}
+
+// writeSVGRun writes the curves of the run as a path
+func writeSVGRun(out *bufio.Writer, r run, s stroke, roundCaps bool) {
+	out.WriteString("<path d=\"")
+	fmt.Fprintf(out, "M%s %s", svgNumber(r.segments[0].p0.x), svgNumber(r.segments[0].p0.y))
+	for _, seg := range r.segments {
+		if seg.dot() {
+			// a dot, drawn by the round caps
+			fmt.Fprintf(out, " L%s %s", svgNumber(seg.p1.x), svgNumber(seg.p1.y))
+			continue
+		}
+		fmt.Fprintf(out, " C%s %s %s %s %s %s",
+			svgNumber(seg.c1.x), svgNumber(seg.c1.y), svgNumber(seg.c2.x), svgNumber(seg.c2.y), svgNumber(seg.p1.x), svgNumber(seg.p1.y))
+	}
+	fmt.Fprintf(out, "\" stroke=\"%s\" stroke-width=\"%s\"", svgColor(s.color), svgNumber(r.width))
+	if r.opacity < 1 {
+		fmt.Fprintf(out, " stroke-opacity=\"%s\"", svgNumber(r.opacity))
+	}
+	if !roundCaps {
+		out.WriteString(" stroke-linecap=\"butt\"")
+	}
+	if s.highlight {
+		out.WriteString(" style=\"mix-blend-mode:multiply\"")
+	}
+	out.WriteString("/>\n")
+}
+
+// svgNumber the number with at most 2 decimals
+func svgNumber(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func svgColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,240 @@
+package exporter
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+	"github.com/unidoc/unipdf/v3/creator"
+)
+
+// testNotebook a notebook with a black horizontal line on each page
+func testNotebook(pages int) *MyArchive {
+	a := &MyArchive{}
+	for i := 0; i < pages; i++ {
+		line := rm.Line{BrushType: rm.FinelinerV5, BrushColor: rm.Black, BrushSize: rm.Medium}
+		for x := 200; x <= 1200; x += 100 {
+			line.Points = append(line.Points, rm.Point{X: float32(x), Y: 900, Width: 20})
+		}
+		a.Pages = append(a.Pages, archive.Page{Data: &rm.Rm{Version: rm.V5, Layers: []rm.Layer{{Lines: []rm.Line{line}}}}})
+	}
+	return a
+}
+
+// allPages the options of the default exports
+var allPages = PdfGeneratorOptions{AllPages: true}
+
+func TestExportPNG(t *testing.T) {
+	var out bytes.Buffer
+	err := Export(testNotebook(1), FormatPNG, 72, allPages, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 445 || img.Bounds().Dy() != 594 {
+		t.Errorf("wrong size %v", img.Bounds())
+	}
+	scale := deviceScale(445, 594)
+	dark := func(x, y float64) bool {
+		r, g, b, _ := img.At(int(x*scale), int(y*scale)).RGBA()
+		return r < 0x4000 && g < 0x4000 && b < 0x4000
+	}
+	if !dark(700, 900) {
+		t.Error("the line is not drawn")
+	}
+	if dark(700, 1000) || dark(100, 900) {
+		t.Error("drawn outside of the line")
+	}
+}
+
+func TestExportPagesZipped(t *testing.T) {
+	var out bytes.Buffer
+	err := Export(testNotebook(2), FormatSVG, DefaultDPI, allPages, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z.File) != 2 || z.File[1].Name != "page-002.svg" {
+		t.Fatalf("wrong pages %v", z.File)
+	}
+	f, err := z.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svg := string(content)
+	if !strings.Contains(svg, `<path d="M200 900 C216.67 900 266.67 900 300 900`) || !strings.Contains(svg, `stroke="#000000" stroke-width="20"`) {
+		t.Errorf("the line is not in the svg:\n%s", svg)
+	}
+
+	if err = Export(testNotebook(1), "jpg", DefaultDPI, allPages, &out); err != ErrorUnsupportedFormat {
+		t.Error("exported to an unsupported format ", err)
+	}
+}
+
+func TestExportSelectedPages(t *testing.T) {
+	a := testNotebook(4)
+	// a page without annotations
+	a.Pages[1].Data = nil
+
+	var out bytes.Buffer
+	err := Export(a, FormatSVG, DefaultDPI, PdfGeneratorOptions{Pages: []int{1, 2, 4}}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z.File) != 2 || z.File[0].Name != "page-001.svg" || z.File[1].Name != "page-004.svg" {
+		t.Fatalf("wrong pages %v", z.File)
+	}
+
+	out.Reset()
+	err = Export(a, FormatPNG, 72, PdfGeneratorOptions{AllPages: true, Pages: []int{2}}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = png.Decode(&out); err != nil {
+		t.Error("a single page is not exported as an image ", err)
+	}
+
+	err = Export(a, FormatPNG, 72, PdfGeneratorOptions{AllPages: true, Pages: []int{5}}, &out)
+	if err != ErrorNoPages {
+		t.Error("exported a page the document does not have ", err)
+	}
+}
+
+func TestExportPdfPages(t *testing.T) {
+	a := testNotebook(3)
+	a.Pages[2].Data = nil
+	countPages := func(options PdfGeneratorOptions) int {
+		var out bytes.Buffer
+		generator := PdfGenerator{}
+		err := generator.Generate(a, &out, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := openPdf(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, err := reader.GetNumPages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	if count := countPages(allPages); count != 3 {
+		t.Errorf("exported %d pages instead of all", count)
+	}
+	if count := countPages(PdfGeneratorOptions{}); count != 2 {
+		t.Errorf("exported %d pages instead of the annotated ones", count)
+	}
+	if count := countPages(PdfGeneratorOptions{AllPages: true, AddPageNumbers: true, Pages: []int{2, 3}}); count != 2 {
+		t.Errorf("exported %d pages instead of the selected ones", count)
+	}
+}
+
+// testPdf a pdf with a blue page
+func testPdf(t *testing.T) []byte {
+	c := creator.New()
+	c.SetPageSize(rmPageSize)
+	c.NewPage()
+	background := c.NewRectangle(0, 0, rmPageSize[0], rmPageSize[1])
+	background.SetFillColor(creator.ColorRGBFrom8bit(0, 0, 0xff))
+	background.SetBorderWidth(0)
+	err := c.Draw(background)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document bytes.Buffer
+	err = c.Write(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return document.Bytes()
+}
+
+func TestExportPNGOverPdf(t *testing.T) {
+	a := testNotebook(1)
+	a.PayloadReader = NewSeekCloser(testPdf(t))
+	var out bytes.Buffer
+	err := Export(a, FormatPNG, 72, allPages, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale := deviceScale(rmPageSize[0], rmPageSize[1])
+	if r, g, b, _ := img.At(int(100*scale), int(100*scale)).RGBA(); r > 0x1000 || g > 0x1000 || b < 0xf000 {
+		t.Errorf("the background is not drawn %x %x %x", r, g, b)
+	}
+	if r, g, b, _ := img.At(int(700*scale), int(900*scale)).RGBA(); r > 0x4000 || g > 0x4000 || b > 0x4000 {
+		t.Errorf("the line is not drawn over the background %x %x %x", r, g, b)
+	}
+}
+
+func TestExportAnnotationsOnly(t *testing.T) {
+	a := testNotebook(1)
+	a.PayloadReader = NewSeekCloser(testPdf(t))
+	var out bytes.Buffer
+	err := Export(a, FormatPNG, 72, PdfGeneratorOptions{AllPages: true, AnnotationsOnly: true}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale := deviceScale(rmPageSize[0], rmPageSize[1])
+	if r, g, b, _ := img.At(int(100*scale), int(100*scale)).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("the background is drawn %x %x %x", r, g, b)
+	}
+	if r, g, b, _ := img.At(int(700*scale), int(900*scale)).RGBA(); r > 0x4000 || g > 0x4000 || b > 0x4000 {
+		t.Errorf("the line is not drawn %x %x %x", r, g, b)
+	}
+}
+
+func TestCheckPages(t *testing.T) {
+	a := testNotebook(3)
+	a.Pages[1].Data = nil
+	if err := CheckPages(a, PdfGeneratorOptions{Pages: []int{2}}); err != ErrorNoPages {
+		t.Error("selected a page without annotations ", err)
+	}
+	if err := CheckPages(a, PdfGeneratorOptions{AllPages: true, Pages: []int{2}}); err != nil {
+		t.Error(err)
+	}
+	if err := CheckPages(a, PdfGeneratorOptions{AllPages: true, Pages: []int{4}}); err != ErrorNoPages {
+		t.Error("selected a page the document does not have ", err)
+	}
+
+	pdfOnly := &MyArchive{PayloadReader: NewSeekCloser(testPdf(t))}
+	if err := CheckPages(pdfOnly, PdfGeneratorOptions{}); err != ErrorNoPages {
+		t.Error("selected a page of the pdf without annotations ", err)
+	}
+	if err := CheckPages(pdfOnly, PdfGeneratorOptions{AllPages: true, Pages: []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Export(pdfOnly, FormatPNG, 72, PdfGeneratorOptions{AllPages: true, Pages: []int{1}}, &out); err != nil {
+		t.Error("the pdf is not rewound after the check ", err)
+	}
+}
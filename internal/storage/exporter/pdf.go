@@ -4,12 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/juruen/rmapi/encoding/rm"
 	"github.com/sirupsen/logrus"
-	"github.com/unidoc/unipdf/v3/annotator"
 	"github.com/unidoc/unipdf/v3/contentstream"
-	"github.com/unidoc/unipdf/v3/contentstream/draw"
 	"github.com/unidoc/unipdf/v3/core"
 	"github.com/unidoc/unipdf/v3/creator"
 	pdf "github.com/unidoc/unipdf/v3/model"
@@ -31,18 +30,37 @@ type PdfGenerator struct {
 type PdfGeneratorOptions struct {
 	AddPageNumbers  bool
 	AllPages        bool
-	AnnotationsOnly bool //export the annotations without the background/pdf
+	AnnotationsOnly bool  //export the annotations without the background/pdf
+	Pages           []int //the numbers of the pages to export, all when empty
 }
 
-func normalized(p1 rm.Point, ratioX float64) (float64, float64) {
-	return float64(p1.X) * ratioX, float64(p1.Y) * ratioX
+// selected whether the page, numbered from 1, is exported
+func (o *PdfGeneratorOptions) selected(pageNum int, hasContent bool) bool {
+	// do not add a page when there are no annotations
+	if !o.AllPages && !hasContent {
+		return false
+	}
+	if len(o.Pages) == 0 {
+		return true
+	}
+	for _, p := range o.Pages {
+		if p == pageNum {
+			return true
+		}
+	}
+	return false
+}
+
+// wholePdf whether the options export the pdf as it is
+func (o *PdfGeneratorOptions) wholePdf() bool {
+	return o.AllPages && len(o.Pages) == 0 && !o.AnnotationsOnly && !o.AddPageNumbers
 }
 
 func (p *PdfGenerator) Generate(zip *MyArchive, output io.Writer, options PdfGeneratorOptions) (err error) {
 
 	p.options = options
 
-	if len(zip.Pages) == 0 {
+	if len(zip.Pages) == 0 && (zip.PayloadReader == nil || p.options.wholePdf()) {
 		if zip.PayloadReader != nil {
 			_, err := io.Copy(output, zip.PayloadReader)
 			return err
@@ -55,23 +73,51 @@ func (p *PdfGenerator) Generate(zip *MyArchive, output io.Writer, options PdfGen
 		return err
 	}
 
+	// the pages of the pdf without annotations
+	pageCount := len(zip.Pages)
+	if pageCount == 0 {
+		pageCount, err = p.pdfReader.GetNumPages()
+		if err != nil {
+			return err
+		}
+	}
+
 	c := creator.New()
 	if p.template {
 		// use the standard page size
 		c.SetPageSize(rmPageSize)
 	}
 
-	if p.pdfReader != nil && p.options.AllPages {
+	if p.pdfReader != nil && p.options.AllPages && len(p.options.Pages) == 0 && !p.options.AnnotationsOnly {
 		logrus.Info("generating all pages")
 		outlines := p.pdfReader.GetOutlineTree()
 		c.SetOutlineTree(outlines)
 	}
 
-	for i, pageAnnotations := range zip.Pages {
-		hasContent := pageAnnotations.Data != nil
+	// the numbers of the exported pages in the document
+	pageNumbers := []int{}
+	if p.options.AddPageNumbers {
+		c.DrawFooter(func(block *creator.Block, args creator.FooterFunctionArgs) {
+			if args.PageNum > len(pageNumbers) {
+				return
+			}
+			p := c.NewParagraph(fmt.Sprintf("%d", pageNumbers[args.PageNum-1]))
+			p.SetFontSize(8)
+			w := block.Width() - 20
+			h := block.Height() - 10
+			p.SetPos(w, h)
+			block.Draw(p)
+		})
+	}
+
+	for i := 0; i < pageCount; i++ {
+		var pageAnnotations *rm.Rm
+		if i < len(zip.Pages) {
+			pageAnnotations = zip.Pages[i].Data
+		}
+		hasContent := pageAnnotations != nil
 
-		// do not add a page when there are no annotations
-		if !p.options.AllPages && !hasContent {
+		if !p.options.selected(i+1, hasContent) {
 			continue
 		}
 
@@ -79,79 +125,22 @@ func (p *PdfGenerator) Generate(zip *MyArchive, output io.Writer, options PdfGen
 		if err != nil {
 			return err
 		}
+		pageNumbers = append(pageNumbers, i+1)
 
-		ratio := c.Height() / c.Width()
-
-		var scale float64
-		if ratio < 1.33 {
-			scale = c.Width() / DeviceWidth
-		} else {
-			scale = c.Height() / DeviceHeight
-		}
+		scale := deviceScale(c.Width(), c.Height())
 		if page == nil {
 			logrus.Fatal("page is null")
 		}
 
-		if err != nil {
-			return err
-		}
 		if !hasContent {
 			continue
 		}
 
 		contentCreator := contentstream.NewContentCreator()
 		contentCreator.Add_q()
-
-		for _, layer := range pageAnnotations.Data.Layers {
-			for _, line := range layer.Lines {
-				if len(line.Points) < 1 {
-					continue
-				}
-				if line.BrushType == rm.Eraser || line.BrushType == rm.EraseArea {
-					continue
-				}
-
-				if line.BrushType == rm.HighlighterV5 {
-					last := len(line.Points) - 1
-					x1, y1 := normalized(line.Points[0], scale)
-					x2, _ := normalized(line.Points[last], scale)
-					// make horizontal lines only, use y1
-					width := scale * 30
-					y1 += width / 2
-
-					lineDef := annotator.LineAnnotationDef{X1: x1 - 1, Y1: c.Height() - y1, X2: x2, Y2: c.Height() - y1}
-					lineDef.LineColor = pdf.NewPdfColorDeviceRGB(1.0, 1.0, 0.0) //yellow
-					lineDef.Opacity = 0.5
-					lineDef.LineWidth = width
-					ann, err := annotator.CreateLineAnnotation(lineDef)
-					if err != nil {
-						return err
-					}
-					page.AddAnnotation(ann)
-				} else {
-					path := draw.NewPath()
-					for i := 0; i < len(line.Points); i++ {
-						x1, y1 := normalized(line.Points[i], scale)
-						path = path.AppendPoint(draw.NewPoint(x1, c.Height()-y1))
-					}
-
-					contentCreator.Add_w(float64(line.BrushSize / 10))
-
-					switch line.BrushColor {
-					case rm.Black:
-						contentCreator.Add_rg(1.0, 1.0, 1.0)
-					case rm.White:
-						contentCreator.Add_rg(0.0, 0.0, 0.0)
-					case rm.Grey:
-						contentCreator.Add_rg(0.8, 0.8, 0.8)
-					}
-
-					//TODO: use bezier
-					draw.DrawPathWithCreator(path, contentCreator)
-
-					contentCreator.Add_S()
-				}
-			}
+		err = drawStrokes(contentCreator, page, pageStrokes(pageAnnotations), scale, c.Height())
+		if err != nil {
+			return err
 		}
 		contentCreator.Add_Q()
 		drawingOperations := contentCreator.Operations().String()
@@ -163,32 +152,82 @@ func (p *PdfGenerator) Generate(zip *MyArchive, output io.Writer, options PdfGen
 		wrapper := []string{"q", pageContentStreams, "Q", drawingOperations}
 		page.SetContentStreams(wrapper, core.NewFlateEncoder())
 	}
+	if len(pageNumbers) == 0 {
+		return ErrorNoPages
+	}
 
 	return c.Write(output)
 }
 
+// drawStrokes draws the runs of the strokes as Bézier curves with round caps
+// and joins, the translucent ones with a graphics state of their opacity
+func drawStrokes(cc *contentstream.ContentCreator, page *pdf.PdfPage, strokes []stroke, scale, height float64) error {
+	// round joins, and caps at the ends of the strokes
+	cc.AddOperand(contentstream.ContentStreamOperation{Operand: "j", Params: []core.PdfObject{core.MakeInteger(1)}})
+	point := func(v vec) (float64, float64) {
+		return v.x * scale, height - v.y*scale
+	}
+	for _, s := range strokes {
+		for i, r := range s.runs {
+			cc.Add_q()
+			lineCap := int64(0)
+			if s.roundCaps(i) {
+				lineCap = 1
+			}
+			cc.AddOperand(contentstream.ContentStreamOperation{Operand: "J", Params: []core.PdfObject{core.MakeInteger(lineCap)}})
+			if r.opacity < 1 || s.highlight {
+				name, err := addOpacityState(page, r.opacity, s.highlight)
+				if err != nil {
+					return err
+				}
+				cc.Add_gs(name)
+			}
+			cc.Add_RG(float64(s.color.R)/0xff, float64(s.color.G)/0xff, float64(s.color.B)/0xff)
+			cc.Add_w(r.width * scale)
+			cc.Add_m(point(r.segments[0].p0))
+			for _, seg := range r.segments {
+				if seg.dot() {
+					// a dot, drawn by the round caps
+					cc.Add_l(point(seg.p1))
+					continue
+				}
+				x1, y1 := point(seg.c1)
+				x2, y2 := point(seg.c2)
+				x3, y3 := point(seg.p1)
+				cc.Add_c(x1, y1, x2, y2, x3, y3)
+			}
+			cc.Add_S()
+			cc.Add_Q()
+		}
+	}
+	return nil
+}
+
+// addOpacityState adds the graphics state of the opacity to the page, the
+// highlighter multiplies the colors it covers
+func addOpacityState(page *pdf.PdfPage, opacity float64, highlight bool) (core.PdfObjectName, error) {
+	name := core.PdfObjectName(fmt.Sprintf("RmOpacity%d", int(math.Round(opacity*100))))
+	if highlight {
+		name += "Multiply"
+	}
+	if page.HasExtGState(name) {
+		return name, nil
+	}
+	state := core.MakeDict()
+	state.Set("CA", core.MakeFloat(opacity))
+	state.Set("ca", core.MakeFloat(opacity))
+	if highlight {
+		state.Set("BM", core.MakeName("Multiply"))
+	}
+	return name, page.AddExtGState(name, state)
+}
+
 func (p *PdfGenerator) initBackgroundPages(r io.ReadSeeker) error {
 	if r != nil {
-		pdfReader, err := pdf.NewPdfReader(r)
+		pdfReader, err := openPdf(r)
 		if err != nil {
 			return err
 		}
-
-		encrypted, err := pdfReader.IsEncrypted()
-		if err != nil {
-			return nil
-		}
-		if encrypted {
-			valid, err := pdfReader.Decrypt([]byte(""))
-			if err != nil {
-				return err
-			}
-			if !valid {
-				return fmt.Errorf("cannot decrypt")
-			}
-
-		}
-
 		p.pdfReader = pdfReader
 		p.template = false
 		return nil
@@ -199,39 +238,51 @@ func (p *PdfGenerator) initBackgroundPages(r io.ReadSeeker) error {
 	return nil
 }
 
-func (p *PdfGenerator) addBackgroundPage(c *creator.Creator, pageNum int) (*pdf.PdfPage, error) {
-	var page *pdf.PdfPage
+// openPdf reads the pdf of the document, decrypting it with an empty password
+func openPdf(r io.ReadSeeker) (*pdf.PdfReader, error) {
+	pdfReader, err := pdf.NewPdfReader(r)
+	if err != nil {
+		return nil, err
+	}
 
-	if !p.template && !p.options.AnnotationsOnly {
-		tmpPage, err := p.pdfReader.GetPage(pageNum)
+	encrypted, err := pdfReader.IsEncrypted()
+	if err != nil {
+		return pdfReader, nil
+	}
+	if encrypted {
+		valid, err := pdfReader.Decrypt([]byte(""))
 		if err != nil {
 			return nil, err
 		}
-		mbox, err := tmpPage.GetMediaBox()
-		if err != nil {
-			return nil, err
+		if !valid {
+			return nil, fmt.Errorf("cannot decrypt")
 		}
+	}
+	return pdfReader, nil
+}
 
-		// TODO: adjust the page if cropped
-		pageHeight := mbox.Ury - mbox.Lly
-		pageWidth := mbox.Urx - mbox.Llx
-		// use the pdf's page size
-		c.SetPageSize(creator.PageSize{pageWidth, pageHeight})
-		c.AddPage(tmpPage)
-		page = tmpPage
-	} else {
-		page = c.NewPage()
+func (p *PdfGenerator) addBackgroundPage(c *creator.Creator, pageNum int) (*pdf.PdfPage, error) {
+	if p.template {
+		return c.NewPage(), nil
 	}
 
-	if p.options.AddPageNumbers {
-		c.DrawFooter(func(block *creator.Block, args creator.FooterFunctionArgs) {
-			p := c.NewParagraph(fmt.Sprintf("%d", args.PageNum))
-			p.SetFontSize(8)
-			w := block.Width() - 20
-			h := block.Height() - 10
-			p.SetPos(w, h)
-			block.Draw(p)
-		})
+	tmpPage, err := p.pdfReader.GetPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	mbox, err := tmpPage.GetMediaBox()
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: adjust the page if cropped
+	pageHeight := mbox.Ury - mbox.Lly
+	pageWidth := mbox.Urx - mbox.Llx
+	// use the pdf's page size, also for the annotations only
+	c.SetPageSize(creator.PageSize{pageWidth, pageHeight})
+	if p.options.AnnotationsOnly {
+		return c.NewPage(), nil
 	}
-	return page, nil
+	c.AddPage(tmpPage)
+	return tmpPage, nil
 }
@@ -47,6 +47,50 @@ func RenderRmapi(a *MyArchive, output io.Writer) error {
 	return pdfgen.Generate(a, output, options)
 }
 
+// Export renders the selected pages of the document as pdf, or as png or svg
+// pages at the resolution
+func Export(a *MyArchive, format string, dpi int, options PdfGeneratorOptions, output io.Writer) error {
+	switch format {
+	case FormatPDF:
+		pdfgen := PdfGenerator{}
+		return pdfgen.Generate(a, output, options)
+	case FormatPNG, FormatSVG:
+		generator := ImageGenerator{}
+		return generator.Generate(a, output, format, dpi, options)
+	}
+	return ErrorUnsupportedFormat
+}
+
+// CheckPages fails with ErrorNoPages when the options select none of the
+// pages of the document, so it can be told before the export is streamed
+func CheckPages(a *MyArchive, options PdfGeneratorOptions) error {
+	if options.AllPages && len(options.Pages) == 0 && !(len(a.Pages) == 0 && a.PayloadReader == nil) {
+		return nil
+	}
+	count := len(a.Pages)
+	if count == 0 && a.PayloadReader != nil {
+		reader, err := openPdf(a.PayloadReader)
+		if err != nil {
+			return err
+		}
+		count, err = reader.GetNumPages()
+		if err != nil {
+			return err
+		}
+		_, err = a.PayloadReader.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < count; i++ {
+		hasContent := i < len(a.Pages) && a.Pages[i].Data != nil
+		if options.selected(i+1, hasContent) {
+			return nil
+		}
+	}
+	return ErrorNoPages
+}
+
 type SeekCloser struct {
 	*bytes.Reader
 }
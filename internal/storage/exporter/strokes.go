@@ -0,0 +1,309 @@
+package exporter
+
+import (
+	"image/color"
+	"math"
+
+	"github.com/juruen/rmapi/encoding/rm"
+)
+
+const (
+	// highlighterWidth the width of the highlighter strokes in device pixels
+	highlighterWidth = 30
+	// highlighterOpacity the highlighter does not hide what it covers
+	highlighterOpacity = 0.5
+	// calligraphyV5 the calligraphy pen, newer than the brushes of rmapi
+	calligraphyV5 rm.BrushType = 21
+	// widthStep the widths of the strokes are rounded to it, in device pixels,
+	// the segments of the same width are drawn together
+	widthStep = 0.25
+	// opacitySteps the number of opacities the segments are rounded to
+	opacitySteps = 16
+	// nibAngle the angle of the nib of the calligraphy pen, from the bottom
+	// left to the top right
+	nibAngle = -math.Pi / 4
+)
+
+// brush how the points of a line are drawn
+type brush int
+
+const (
+	fineliner brush = iota
+	ballpoint
+	marker
+	pencil
+	mechanicalPencil
+	calligraphy
+	paintBrush
+	highlighter
+)
+
+// brushOf the brush of the type, the erasers are not drawn
+func brushOf(t rm.BrushType) (brush, bool) {
+	switch t {
+	case rm.Fineliner, rm.FinelinerV5:
+		return fineliner, true
+	case rm.BallPoint, rm.BallPointV5:
+		return ballpoint, true
+	case rm.Marker, rm.MarkerV5:
+		return marker, true
+	case rm.TiltPencil, rm.TiltPencilV5:
+		return pencil, true
+	case rm.SharpPencil, rm.SharpPencilV5:
+		return mechanicalPencil, true
+	case calligraphyV5:
+		return calligraphy, true
+	case rm.Brush, rm.BrushV5:
+		return paintBrush, true
+	case rm.Highlighter, rm.HighlighterV5:
+		return highlighter, true
+	case rm.Eraser, rm.EraseArea:
+		return 0, false
+	}
+	// an unknown pen
+	return fineliner, true
+}
+
+// vec a point in device pixels
+type vec struct {
+	x, y float64
+}
+
+func (v vec) add(o vec) vec {
+	return vec{v.x + o.x, v.y + o.y}
+}
+
+func (v vec) sub(o vec) vec {
+	return vec{v.x - o.x, v.y - o.y}
+}
+
+func (v vec) scale(f float64) vec {
+	return vec{v.x * f, v.y * f}
+}
+
+// segment a cubic Bézier between two points of a line, in device pixels
+type segment struct {
+	p0, c1, c2, p1 vec
+}
+
+// at the point of the curve at t in [0, 1]
+func (s segment) at(t float64) vec {
+	u := 1 - t
+	return s.p0.scale(u * u * u).
+		add(s.c1.scale(3 * u * u * t)).
+		add(s.c2.scale(3 * u * t * t)).
+		add(s.p1.scale(t * t * t))
+}
+
+// length the length of the control polygon, which bounds the curve's
+func (s segment) length() float64 {
+	return math.Hypot(s.c1.x-s.p0.x, s.c1.y-s.p0.y) +
+		math.Hypot(s.c2.x-s.c1.x, s.c2.y-s.c1.y) +
+		math.Hypot(s.p1.x-s.c2.x, s.p1.y-s.c2.y)
+}
+
+// dot whether the segment is a single point
+func (s segment) dot() bool {
+	return s.p0 == s.p1 && s.c1 == s.p0 && s.c2 == s.p0
+}
+
+// run consecutive segments of a stroke with the same width and opacity, drawn
+// at once so that they do not darken where they overlap
+type run struct {
+	segments []segment
+	width    float64
+	opacity  float64
+}
+
+// stroke a visible line of a page, in device pixels
+type stroke struct {
+	runs  []run
+	color color.NRGBA
+	// highlight the stroke is blended with what it covers
+	highlight bool
+}
+
+// roundCaps whether the run ends the stroke, the curves are smooth where
+// the other runs meet so they are cut square to not overlap
+func (s *stroke) roundCaps(i int) bool {
+	return i == 0 || i == len(s.runs)-1
+}
+
+// deviceScale the scale from the device pixels to a page of the size, the
+// strokes are fitted to its width or its height
+func deviceScale(width, height float64) float64 {
+	if height/width < 1.33 {
+		return width / DeviceWidth
+	}
+	return height / DeviceHeight
+}
+
+// brushColor the color of the strokes of the brush
+func brushColor(c rm.BrushColor) color.NRGBA {
+	switch c {
+	case rm.Grey:
+		return color.NRGBA{0x80, 0x80, 0x80, 0xff}
+	case rm.White:
+		return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	return color.NRGBA{0, 0, 0, 0xff}
+}
+
+// pageStrokes the visible strokes of the page, the erased parts are not
+// drawn by the tablet either
+func pageStrokes(page *rm.Rm) []stroke {
+	if page == nil {
+		return nil
+	}
+	strokes := []stroke{}
+	for _, layer := range page.Layers {
+		for _, line := range layer.Lines {
+			if len(line.Points) < 1 {
+				continue
+			}
+			b, visible := brushOf(line.BrushType)
+			if !visible {
+				continue
+			}
+			s := stroke{color: brushColor(line.BrushColor)}
+			if b == highlighter {
+				s.color = color.NRGBA{0xff, 0xff, 0x00, 0xff}
+				s.highlight = true
+			}
+			s.runs = lineRuns(b, line)
+			strokes = append(strokes, s)
+		}
+	}
+	return strokes
+}
+
+// lineRuns smooths the line and draws each of its segments with the width
+// and the opacity of the brush at its points
+func lineRuns(b brush, line rm.Line) []run {
+	if !pressureRecorded(line.Points) {
+		// full pressure
+		points := make([]rm.Point, len(line.Points))
+		for i, p := range line.Points {
+			p.Pressure = 1
+			points[i] = p
+		}
+		line.Points = points
+	}
+	segments := smooth(line.Points)
+	average := lineWidth(line)
+	runs := []run{}
+	for i, s := range segments {
+		p0 := line.Points[i]
+		p1 := p0
+		if i+1 < len(line.Points) {
+			p1 = line.Points[i+1]
+		}
+		width, opacity := b.draw(line, p0, p1, average)
+		width = math.Max(math.Round(width/widthStep)*widthStep, widthStep)
+		opacity = math.Round(clamp(opacity, 0.1, 1)*opacitySteps) / opacitySteps
+
+		last := len(runs) - 1
+		if last >= 0 && runs[last].width == width && runs[last].opacity == opacity {
+			runs[last].segments = append(runs[last].segments, s)
+			continue
+		}
+		runs = append(runs, run{segments: []segment{s}, width: width, opacity: opacity})
+	}
+	return runs
+}
+
+// draw the width and the opacity of the segment between the points, the
+// tablet records the width of the pressure sensitive brushes
+func (b brush) draw(line rm.Line, p0, p1 rm.Point, average float64) (float64, float64) {
+	width := (pointWidth(line, p0) + pointWidth(line, p1)) / 2
+	pressure := clamp(float64(p0.Pressure+p1.Pressure)/2, 0, 1)
+	switch b {
+	case fineliner:
+		return average, 1
+	case ballpoint:
+		return width, 0.6 + 0.4*pressure
+	case marker:
+		return width, 1
+	case pencil:
+		return width, 0.2 + 0.8*pressure
+	case mechanicalPencil:
+		return average, 0.7
+	case calligraphy:
+		// broad across the nib, thin along it
+		angle := math.Atan2(float64(p1.Y-p0.Y), float64(p1.X-p0.X))
+		if p0.X == p1.X && p0.Y == p1.Y {
+			angle = nibAngle + math.Pi/2
+		}
+		return width * (0.25 + 0.75*math.Abs(math.Sin(angle-nibAngle))), 1
+	case paintBrush:
+		return width, 1.5 * math.Pow(pressure, 1.5)
+	case highlighter:
+		return highlighterWidth, highlighterOpacity
+	}
+	return width, 1
+}
+
+// pointWidth the width of the point, from its pressure and the size of the
+// brush when the tablet did not record it
+func pointWidth(line rm.Line, p rm.Point) float64 {
+	if p.Width > 0 {
+		return float64(p.Width)
+	}
+	return float64(line.BrushSize) * (0.5 + clamp(float64(p.Pressure), 0, 1)/2)
+}
+
+// pressureRecorded whether the tablet recorded the pressure of the points
+func pressureRecorded(points []rm.Point) bool {
+	for _, p := range points {
+		if p.Pressure > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lineWidth the average width of the points, which the tablet records
+func lineWidth(line rm.Line) float64 {
+	var sum float64
+	for _, p := range line.Points {
+		sum += float64(p.Width)
+	}
+	width := sum / float64(len(line.Points))
+	if width <= 0 {
+		return float64(line.BrushSize)
+	}
+	return width
+}
+
+// smooth the Catmull-Rom spline through the points as Bézier segments, a
+// single point is a dot
+func smooth(points []rm.Point) []segment {
+	at := func(i int) vec {
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(points) {
+			i = len(points) - 1
+		}
+		return vec{float64(points[i].X), float64(points[i].Y)}
+	}
+	if len(points) == 1 {
+		p := at(0)
+		return []segment{{p, p, p, p}}
+	}
+	segments := make([]segment, 0, len(points)-1)
+	for i := 0; i+1 < len(points); i++ {
+		p0, p1 := at(i), at(i+1)
+		segments = append(segments, segment{
+			p0: p0,
+			c1: p0.add(p1.sub(at(i - 1)).scale(1.0 / 6)),
+			c2: p1.sub(at(i + 2).sub(p0).scale(1.0 / 6)),
+			p1: p1,
+		})
+	}
+	return segments
+}
+
+func clamp(f, min, max float64) float64 {
+	return math.Min(math.Max(f, min), max)
+}
@@ -0,0 +1,202 @@
+package exporter
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juruen/rmapi/archive"
+	"github.com/juruen/rmapi/encoding/rm"
+	"github.com/unidoc/unipdf/v3/render"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden images of the exports")
+
+// brushesNotebook a page with a wave of each brush, pressing harder along it
+func brushesNotebook() *MyArchive {
+	brushes := []rm.BrushType{
+		rm.FinelinerV5, rm.BallPointV5, rm.MarkerV5, rm.TiltPencilV5,
+		rm.SharpPencilV5, calligraphyV5, rm.BrushV5, rm.HighlighterV5,
+	}
+	lines := []rm.Line{}
+	for i, brush := range brushes {
+		line := rm.Line{BrushType: brush, BrushColor: rm.Black, BrushSize: rm.Medium}
+		if brush == rm.SharpPencilV5 {
+			line.BrushColor = rm.Grey
+		}
+		y := 200 + float64(i)*200
+		for x := 150; x <= 1250; x += 25 {
+			pressure := float64(x-150) / 1100
+			line.Points = append(line.Points, rm.Point{
+				X:        float32(x),
+				Y:        float32(y + 60*math.Sin(float64(x)/80)),
+				Pressure: float32(pressure),
+				Width:    float32(4 + 16*pressure),
+			})
+		}
+		lines = append(lines, line)
+	}
+	// a dot, and an erased line which is not drawn
+	lines = append(lines,
+		rm.Line{BrushType: rm.FinelinerV5, BrushSize: rm.Medium, Points: []rm.Point{{X: 700, Y: 1800, Width: 12}}},
+		rm.Line{BrushType: rm.Eraser, BrushSize: rm.Large, Points: []rm.Point{{X: 100, Y: 1800, Width: 40}, {X: 1300, Y: 1800, Width: 40}}},
+	)
+	page := &rm.Rm{Version: rm.V5, Layers: []rm.Layer{{Lines: lines}}}
+	return &MyArchive{Zip: archive.Zip{Pages: []archive.Page{{Data: page}}}}
+}
+
+// compareGolden compares the image with the golden one in testdata, a few
+// pixels may differ by the rounding of the antialiasing
+func compareGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *updateGolden {
+		var out bytes.Buffer
+		if err := png.Encode(&out, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	f, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expected, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected.Bounds() != img.Bounds() {
+		t.Fatalf("%s: the size %v is not %v", name, img.Bounds(), expected.Bounds())
+	}
+	b := img.Bounds()
+	different := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r1, g1, b1, _ := img.At(x, y).RGBA()
+			r2, g2, b2, _ := expected.At(x, y).RGBA()
+			if channelDiff(r1, r2) > 0x1000 || channelDiff(g1, g2) > 0x1000 || channelDiff(b1, b2) > 0x1000 {
+				different++
+			}
+		}
+	}
+	if different > b.Dx()*b.Dy()/1000 {
+		t.Errorf("%s: %d pixels differ from the golden image, run the tests with -update to accept them", name, different)
+	}
+}
+
+func channelDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestRenderBrushesGolden(t *testing.T) {
+	var out bytes.Buffer
+	err := Export(brushesNotebook(), FormatPNG, 100, allPages, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, "brushes.png", img)
+}
+
+func TestRenderBrushesPdfGolden(t *testing.T) {
+	var out bytes.Buffer
+	generator := PdfGenerator{}
+	err := generator.Generate(brushesNotebook(), &out, allPages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := openPdf(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(content, "0 0 0 RG") || strings.Contains(content, "1 1 1 RG") {
+		t.Errorf("the black ink is not black:\n%s", content)
+	}
+	if !strings.Contains(content, " c\n") {
+		t.Error("the strokes are not smoothed")
+	}
+
+	device := render.NewImageDevice()
+	device.OutputWidth = 618
+	img, err := device.Render(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareGolden(t, "brushes-pdf.png", img)
+}
+
+func TestBrushWidthAndOpacity(t *testing.T) {
+	light := rm.Point{Pressure: 0.1, Width: 4}
+	hard := rm.Point{Pressure: 0.9, Width: 16}
+	line := rm.Line{BrushSize: rm.Medium, Points: []rm.Point{light, hard}}
+
+	width, opacity := fineliner.draw(line, light, light, 10)
+	if width != 10 || opacity != 1 {
+		t.Errorf("the fineliner is %v wide and %v opaque", width, opacity)
+	}
+	lightWidth, lightOpacity := pencil.draw(line, light, light, 10)
+	hardWidth, hardOpacity := pencil.draw(line, hard, hard, 10)
+	if lightWidth >= hardWidth || lightOpacity >= hardOpacity {
+		t.Errorf("the pencil does not follow the pressure %v %v, %v %v", lightWidth, lightOpacity, hardWidth, hardOpacity)
+	}
+	_, lightOpacity = paintBrush.draw(line, light, light, 10)
+	_, hardOpacity = paintBrush.draw(line, hard, hard, 10)
+	if lightOpacity >= hardOpacity {
+		t.Errorf("the brush does not follow the pressure %v %v", lightOpacity, hardOpacity)
+	}
+
+	// broad across the nib, thin along it
+	across, _ := calligraphy.draw(line, rm.Point{X: 0, Y: 0, Width: 16}, rm.Point{X: 10, Y: 10, Width: 16}, 16)
+	along, _ := calligraphy.draw(line, rm.Point{X: 0, Y: 10, Width: 16}, rm.Point{X: 10, Y: 0, Width: 16}, 16)
+	if across <= along*2 {
+		t.Errorf("the calligraphy pen is %v wide across the nib and %v along it", across, along)
+	}
+
+	if _, visible := brushOf(rm.EraseArea); visible {
+		t.Error("the eraser is drawn")
+	}
+}
+
+func TestSmoothThroughThePoints(t *testing.T) {
+	points := []rm.Point{{X: 0, Y: 0}, {X: 100, Y: 50}, {X: 200, Y: 0}, {X: 300, Y: 50}}
+	segments := smooth(points)
+	if len(segments) != 3 {
+		t.Fatalf("%d segments", len(segments))
+	}
+	for i, s := range segments {
+		if s.p0 != (vec{float64(points[i].X), float64(points[i].Y)}) || s.at(1) != (vec{float64(points[i+1].X), float64(points[i+1].Y)}) {
+			t.Errorf("segment %d does not go through the points: %+v", i, s)
+		}
+	}
+	// the tangents are continuous
+	in := segments[0].p1.sub(segments[0].c2)
+	out := segments[1].c1.sub(segments[1].p0)
+	if math.Abs(in.x*out.y-in.y*out.x) > 1e-9 {
+		t.Errorf("the curve has a corner, %v %v", in, out)
+	}
+}
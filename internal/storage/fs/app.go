@@ -1,18 +1,23 @@
 package fs
 
 import (
+	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/common"
 	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
@@ -28,27 +33,39 @@ const (
 	paramExp       = "exp"
 	paramSignature = "signature"
 	paramScope     = "scope"
+	paramDevice    = "device"
 	routeBlob      = "/blobstorage"
 	routeStorage   = "/storage"
+
+	// maxIndexUpload the largest upload checked for an index, the root
+	// index of tens of thousands of documents
+	maxIndexUpload = 4 << 20
 )
 
 // ErrorNotFound not found
-var ErrorNotFound = errors.New("not found")
+var ErrorNotFound = storage.ErrorNotFound
 
 // ErrorWrongGeneration the geration did not match
-var ErrorWrongGeneration = errors.New("wrong generation")
+var ErrorWrongGeneration = storage.ErrorWrongGeneration
+
+// ErrorHashMismatch the blob does not match its id
+var ErrorHashMismatch = storage.ErrorHashMismatch
 
-// App file system document storage
+// App the storage routes, serving the documents and blobs of a backend
 type App struct {
-	cfg *config.Config
-	fs  *FileSystemStorage
+	cfg   *config.Config
+	docs  storage.DocumentStorer
+	blobs storage.BlobStorage
+	quota *storage.Quota
 }
 
 // NewApp StorageApp various storage routes
-func NewApp(cfg *config.Config, fs *FileSystemStorage) *App {
+func NewApp(cfg *config.Config, docs storage.DocumentStorer, blobs storage.BlobStorage, quota *storage.Quota) *App {
 	staticWrapper := App{
-		fs:  fs,
-		cfg: cfg,
+		docs:  docs,
+		blobs: blobs,
+		cfg:   cfg,
+		quota: quota,
 	}
 	return &staticWrapper
 }
@@ -88,10 +105,13 @@ func (app *App) uploadDocument(c *gin.Context) {
 	}
 	id := token.DocumentID
 	log.Debug("[storage] uploading documentId: ", id)
+	if !common.CheckQuota(c, app.quota, token.UserID, c.Request.ContentLength) {
+		return
+	}
 	body := c.Request.Body
 	defer body.Close()
 
-	err = app.fs.StoreDocument(token.UserID, id, body)
+	err = app.docs.StoreDocument(token.UserID, id, body)
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -114,7 +134,7 @@ func (app *App) downloadDocument(c *gin.Context) {
 	//todo: storage provider
 	log.Info("Requestng Id: ", id)
 
-	reader, err := app.fs.GetDocument(token.UserID, id)
+	reader, err := app.docs.GetDocument(token.UserID, id)
 
 	if err != nil {
 		log.Error(err)
@@ -122,7 +142,10 @@ func (app *App) downloadDocument(c *gin.Context) {
 		return
 	}
 	defer reader.Close()
-	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", reader, nil)
+	// documents are replaced by uploads, they are revalidated by date
+	size, modtime := fileInfo(reader)
+	c.Header("Cache-Control", "no-cache")
+	serveContent(c, id, reader, size, modtime)
 }
 
 func (app *App) downloadBlob(c *gin.Context) {
@@ -133,8 +156,13 @@ func (app *App) downloadBlob(c *gin.Context) {
 	exp := common.QueryS(paramExp, c)
 	signature := common.QueryS(paramSignature, c)
 	scope := common.QueryS(paramScope, c)
+	deviceID := c.Query(paramDevice)
 
-	err := VerifyURLParams([]string{uid, blobID, exp, scope}, exp, signature, app.cfg.JWTSecretKey)
+	parts := []string{uid, blobID, exp, scope}
+	if deviceID != "" {
+		parts = append(parts, deviceID)
+	}
+	err := VerifyURLParams(parts, exp, signature, app.cfg.JWTSecretKey)
 	if err != nil {
 		log.Warn(err)
 		c.AbortWithStatus(http.StatusForbidden)
@@ -143,15 +171,17 @@ func (app *App) downloadBlob(c *gin.Context) {
 
 	if scope != "read" {
 		c.AbortWithStatus(http.StatusForbidden)
+		return
 	}
 
 	if blobID == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
+		return
 	}
 
 	log.Info("Requestng blob: ", blobID)
 
-	reader, generation, size, err := app.fs.LoadBlob(uid, blobID)
+	reader, generation, size, err := app.blobs.LoadBlob(uid, blobID)
 	if err != nil {
 		if err == ErrorNotFound {
 			c.AbortWithStatus(http.StatusNotFound)
@@ -163,11 +193,18 @@ func (app *App) downloadBlob(c *gin.Context) {
 	}
 	defer reader.Close()
 
-	if blobID == "root" {
+	c.Header(generationHeader, strconv.FormatInt(generation, 10))
+	if blobID == rootFile {
+		// the root changes with every sync
 		log.Debug("Sending gen: ", generation)
+		c.Header("Cache-Control", noCacheControl)
+		c.DataFromReader(http.StatusOK, size, octetStream, reader, nil)
+		return
 	}
-	c.Header(generationHeader, strconv.FormatInt(generation, 10))
-	c.DataFromReader(http.StatusOK, size, "application/octet-stream", reader, nil)
+
+	c.Header("ETag", `"`+blobID+`"`)
+	c.Header("Cache-Control", immutableCacheControl)
+	serveContent(c, blobID, reader, size, time.Time{})
 }
 
 func (app *App) uploadBlob(c *gin.Context) {
@@ -178,24 +215,48 @@ func (app *App) uploadBlob(c *gin.Context) {
 	exp := common.QueryS(paramExp, c)
 	signature := common.QueryS(paramSignature, c)
 	scope := common.QueryS(paramScope, c)
+	deviceID := c.Query(paramDevice)
 
-	err := VerifyURLParams([]string{uid, blobID, exp, scope}, exp, signature, app.cfg.JWTSecretKey)
+	parts := []string{uid, blobID, exp, scope}
+	if deviceID != "" {
+		parts = append(parts, deviceID)
+	}
+	err := VerifyURLParams(parts, exp, signature, app.cfg.JWTSecretKey)
 	if err != nil {
 		c.AbortWithStatus(http.StatusForbidden)
+		return
 	}
 	log.Info(exp, signature)
 
 	if blobID == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
+		return
 	}
 
 	if scope != "write" {
 		log.Warn("wrong scope: " + scope)
 		c.AbortWithStatus(http.StatusForbidden)
+		return
 	}
 
-	body := c.Request.Body
-	defer body.Close()
+	defer c.Request.Body.Close()
+
+	// the root and the indexes are stored regardless of the quota, so that
+	// a user at the quota can still publish deletions
+	exempt := blobID == rootFile
+	var index []byte
+	if !exempt {
+		index, exempt, err = readIndexUpload(c.Request.Body, c.Request.ContentLength)
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	if !exempt && !common.CheckQuota(c, app.quota, uid, c.Request.ContentLength) {
+		return
+	}
+	body := io.MultiReader(bytes.NewReader(index), c.Request.Body)
 
 	generation := int64(0)
 	gh := c.Request.Header.Get(generationMatchHeader)
@@ -208,13 +269,22 @@ func (app *App) uploadBlob(c *gin.Context) {
 		}
 	}
 
-	newgen, err := app.fs.StoreBlob(uid, blobID, body, generation)
+	var newgen int64
+	if blobID == rootFile {
+		newgen, err = app.blobs.StoreRoot(uid, deviceID, body, generation)
+	} else {
+		newgen, err = app.blobs.StoreBlob(uid, blobID, body, generation)
+	}
 
 	if err != nil {
 		if err == ErrorWrongGeneration {
 			c.AbortWithStatus(http.StatusPreconditionFailed)
 			return
 		}
+		if err == ErrorHashMismatch {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -224,6 +294,21 @@ func (app *App) uploadBlob(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{})
 }
 
+// readIndexUpload reads an upload of a known size small enough to be an
+// index, isIndex when it parses as one, the content is the part of the
+// upload read
+func readIndexUpload(body io.Reader, size int64) (content []byte, isIndex bool, err error) {
+	if size < 0 || size > maxIndexUpload {
+		return nil, false, nil
+	}
+	content, err = ioutil.ReadAll(io.LimitReader(body, size))
+	if err != nil {
+		return nil, false, err
+	}
+	_, _, err = models.ParseIndexSchema(bytes.NewReader(content))
+	return content, err == nil, nil
+}
+
 // SignURLParams signs url params
 func SignURLParams(parts []string, key []byte) (string, error) {
 	h := hmac.New(sha256.New, key)
@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// atomicFile a temp file next to the target which replaces it once committed,
+// a crash or a failed write never leaves a partially written target behind
+type atomicFile struct {
+	*os.File
+	target    string
+	committed bool
+}
+
+// createAtomic starts writing the target, the hidden temp file is skipped by gc and fsck
+func createAtomic(target string) (*atomicFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(target), ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: f, target: target}, nil
+}
+
+// Commit flushes the content to disk and moves it into place
+func (f *atomicFile) Commit() error {
+	err := f.Sync()
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	err = f.File.Close()
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	err = os.Rename(f.Name(), f.target)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	f.committed = true
+	syncDir(filepath.Dir(f.target))
+	return nil
+}
+
+// Abort discards the temp file, does nothing once committed so it can be deferred
+func (f *atomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// syncDir makes the renames in the directory durable
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.Warn("cannot open directory for sync: ", err)
+		return
+	}
+	defer d.Close()
+	// not supported on every platform, the rename is still atomic
+	if err = d.Sync(); err != nil {
+		log.Debug("cannot sync directory: ", err)
+	}
+}
+
+// writeFile atomically replaces the file with the content of r
+func writeFile(filePath string, r io.Reader) error {
+	f, err := createAtomic(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// writeBlob atomically stores a blob of the user, which is only accepted when it hashes to the id
+func (fs *FileSystemStorage) writeBlob(uid, filePath, id string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := createAtomic(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	w, err := fs.storeWriter(uid, f)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, hasher), r)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != id && !fs.isIndexOf(uid, f.File, id) {
+		log.Warn("rejecting blob with wrong hash: ", id)
+		return storage.ErrorHashMismatch
+	}
+	return fs.commitBlob(f, id)
+}
+
+// isIndexOf whether the file is an index whose entries hash to id, which is how index blobs are named
+func (fs *FileSystemStorage) isIndexOf(uid string, f *os.File, id string) bool {
+	content, _, err := fs.storedReader(uid, f)
+	if err != nil {
+		return false
+	}
+	hash, err := models.IndexHash(content)
+	return err == nil && hash == id
+}
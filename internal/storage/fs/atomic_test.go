@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+func TestStoreBlobVerifiesHash(t *testing.T) {
+	testuser := "test"
+	fs := NewStorage(&config.Config{
+		DataDir: t.TempDir(),
+	})
+	blobPath := fs.getUserBlobPath(testuser)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := storeTestBlob(t, fs, testuser, "content")
+	_, err = fs.StoreBlob(testuser, hash, strings.NewReader("truncat"), 0)
+	if err != storage.ErrorHashMismatch {
+		t.Fatalf("expected a hash mismatch, got %v", err)
+	}
+
+	content, err := ioutil.ReadFile(fs.getBlobFilePath(testuser, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("the rejected upload replaced the blob: %s", content)
+	}
+	entries, err := ioutil.ReadDir(path.Dir(fs.getBlobFilePath(testuser, hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temp files left behind: %d entries", len(entries))
+	}
+}
+
+func TestRootRecovery(t *testing.T) {
+	testuser := "test"
+	fs := NewStorage(&config.Config{
+		DataDir: t.TempDir(),
+	})
+	blobPath := fs.getUserBlobPath(testuser)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: testuser,
+	}
+
+	first := storeTestBlob(t, fs, testuser, "first")
+	second := storeTestBlob(t, fs, testuser, "second")
+	_, err = ls.WriteRootIndex(0, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ls.WriteRootIndex(1, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crashed after the history was committed, before the root was replaced,
+	// and a later append was torn
+	err = ioutil.WriteFile(path.Join(blobPath, rootFile), []byte(first), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootLog, err := os.OpenFile(path.Join(blobPath, rootLogFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootLog.WriteString(`{"generation":3,"timestamp":"2022-01-01T00:00:00Z","hash":"1234`)
+	rootLog.Close()
+
+	rootHash, gen, err := ls.GetRootIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootHash != second || gen != 2 {
+		t.Errorf("expected generation 2 %s, got %d %s", second, gen, rootHash)
+	}
+
+	gen, err = ls.WriteRootIndex(2, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 3 {
+		t.Errorf("expected generation 3, got %d", gen)
+	}
+	history, err := fs.RootHistory(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].Hash != first {
+		t.Errorf("torn line not dropped %+v", history)
+	}
+}
@@ -13,52 +13,91 @@ import (
 	"strings"
 	"time"
 
-	"github.com/zgs225/rmfakecloud/internal/common"
 	"github.com/zgs225/rmfakecloud/internal/config"
 	"github.com/zgs225/rmfakecloud/internal/storage"
 	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
 	"github.com/zgs225/rmfakecloud/internal/storage/models"
 	"github.com/google/uuid"
-	"github.com/juju/fslock"
 	log "github.com/sirupsen/logrus"
 )
 
 const cachedTreeName = ".tree"
 
-// GetTree returns the cached blob tree for the user
+// GetTree returns the cached blob tree for the user, a tree kept in memory is
+// only mirrored when a root was stored since, otherwise it is loaded from disk
 func (fs *FileSystemStorage) GetTree(uid string) (t *models.HashTree, err error) {
 	ls := &LocalBlobStorage{
 		uid: uid,
 		fs:  fs,
 	}
 
-	cachePath := path.Join(fs.getUserPath(uid), cachedTreeName)
-
-	tree, err := models.LoadTree(cachePath)
-	if err != nil {
-		return nil, err
+	tree, stale := fs.trees.Get(uid)
+	if tree != nil && !stale {
+		return tree, nil
+	}
+	if tree == nil {
+		tree, err = fs.loadTree(uid)
+		if err != nil {
+			return nil, err
+		}
 	}
 	changed, err := tree.Mirror(ls)
 	if err != nil {
 		return nil, err
 	}
 	if changed {
-		err = tree.Save(cachePath)
+		err = fs.writeTree(uid, tree)
 		if err != nil {
 			return nil, err
 		}
 	}
+	fs.trees.Put(uid, tree)
 	return tree, nil
 }
 
 // SaveTree saves the cached tree
 func (fs *FileSystemStorage) SaveTree(uid string, t *models.HashTree) error {
-	cachePath := path.Join(fs.getUserPath(uid), cachedTreeName)
-	return t.Save(cachePath)
+	err := fs.writeTree(uid, t)
+	if err != nil {
+		fs.trees.Remove(uid)
+		return err
+	}
+	fs.trees.Put(uid, t)
+	return nil
+}
+
+// loadTree reads the cached tree from disk, empty when there is none
+func (fs *FileSystemStorage) loadTree(uid string) (*models.HashTree, error) {
+	tree := &models.HashTree{}
+	content, err := fs.readStored(uid, path.Join(fs.getUserPath(uid), cachedTreeName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tree, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(content, tree)
+	if err != nil {
+		log.Warn("cached tree corrupt: ", err)
+		return nil, err
+	}
+	return tree, nil
+}
+
+// writeTree writes the cached tree to disk
+func (fs *FileSystemStorage) writeTree(uid string, t *models.HashTree) error {
+	content, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return fs.writeStored(uid, path.Join(fs.getUserPath(uid), cachedTreeName), bytes.NewReader(content))
 }
 
 // Export exports a document
-func (fs *FileSystemStorage) Export(uid, docid string) (r io.ReadCloser, err error) {
+func (fs *FileSystemStorage) Export(uid, docid string, format storage.ExportFormat, options storage.ExportOptions) (r io.ReadCloser, err error) {
+	if !exporter.IsFormat(format.Type) {
+		return nil, exporter.ErrorUnsupportedFormat
+	}
 	tree, err := fs.GetTree(uid)
 	if err != nil {
 		return nil, err
@@ -76,22 +115,29 @@ func (fs *FileSystemStorage) Export(uid, docid string) (r io.ReadCloser, err err
 	if err != nil {
 		return nil, err
 	}
+	err = exporter.CheckPages(archive, options.GeneratorOptions())
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
 	reader, writer := io.Pipe()
 	go func() {
-		err = exporter.RenderRmapi(archive, writer)
+		defer archive.Close()
+		err := exporter.Export(archive, format.Type, format.DPI, options.GeneratorOptions(), writer)
 		if err != nil {
 			log.Error(err)
-			writer.Close()
-			return
 		}
-		writer.Close()
+		writer.CloseWithError(err)
 	}()
-	return reader, err
+	return reader, nil
 }
 
 // CreateBlobDocument creates a new document
 func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, stream io.Reader) (doc *storage.Document, err error) {
 	ext := path.Ext(filename)
+	if models.IsDocumentArchive(ext) {
+		return fs.importBlobArchive(uid, filename, parent, ext, stream)
+	}
 	switch ext {
 	case models.PdfFileExt:
 		fallthrough
@@ -99,7 +145,6 @@ func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, st
 	default:
 		return nil, errors.New("unsupported extension: " + ext)
 	}
-	//TODO: zips and rm
 
 	docid := uuid.New().String()
 	//create metadata
@@ -122,7 +167,7 @@ func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, st
 		Synced:           true,
 		MetadataModified: true,
 	}
-	metahash, size, err := createMetadataFile(metadata, blobPath)
+	metahash, size, err := fs.createMetadataFile(uid, metadata)
 	fi := models.NewFileHashEntry(metahash, docid+models.MetadataFileExt)
 	fi.Size = size
 	if err != nil {
@@ -136,12 +181,12 @@ func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, st
 		return
 	}
 
-	content := createContent(ext)
+	content := models.CreateContent(ext)
 	contentHash, size, err := models.Hash(strings.NewReader(content))
 	if err != nil {
 		return
 	}
-	err = saveTo(strings.NewReader(content), contentHash, blobPath)
+	err = fs.saveTo(uid, strings.NewReader(content), contentHash)
 	if err != nil {
 		return
 	}
@@ -154,20 +199,34 @@ func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, st
 	if err != nil {
 		return
 	}
-	defer tmpdoc.Close()
-	defer os.Remove(tmpdoc.Name())
+	// the target is known once the payload is hashed
+	payload := &atomicFile{File: tmpdoc}
+	defer payload.Abort()
 
-	tee := io.TeeReader(stream, tmpdoc)
+	payloadContent, err := fs.storeWriter(uid, payload)
+	if err != nil {
+		return nil, err
+	}
+	tee := io.TeeReader(stream, payloadContent)
 	payloadHash, size, err := models.Hash(tee)
 	if err != nil {
 		return nil, err
 	}
-	tmpdoc.Close()
-	payloadFilename := path.Join(blobPath, payloadHash)
-	err = os.Rename(tmpdoc.Name(), payloadFilename)
+	err = payloadContent.Close()
+	if err != nil {
+		return nil, err
+	}
+	payload.target = fs.shardedBlobPath(uid, payloadHash)
+	err = os.MkdirAll(path.Dir(payload.target), 0700)
 	if err != nil {
 		return nil, err
 	}
+	trackPayload := fs.trackUsage(uid, payload.target)
+	err = fs.commitBlob(payload, payloadHash)
+	if err != nil {
+		return nil, err
+	}
+	trackPayload()
 	fi = models.NewFileHashEntry(payloadHash, docid+ext)
 	fi.Size = size
 	err = hashDoc.AddFile(fi)
@@ -176,92 +235,246 @@ func (fs *FileSystemStorage) CreateBlobDocument(uid, filename, parent string, st
 		return nil, err
 	}
 
-	//TODO: loop
-	err = tree.Add(hashDoc)
+	err = fs.publishDoc(uid, tree, hashDoc)
 	if err != nil {
 		return
 	}
 
-	docIndexReader, err := hashDoc.IndexReader()
-	err = saveTo(docIndexReader, hashDoc.Hash, blobPath)
+	doc = &storage.Document{
+		ID:     docid,
+		Type:   models.DocumentType,
+		Parent: "",
+		Name:   docName,
+	}
+	return
+}
+
+// CreateBlobFolder creates a new folder, which has a metadata and a content blob
+func (fs *FileSystemStorage) CreateBlobFolder(uid, name, parent string) (*storage.Document, error) {
+	docid := uuid.New().String()
+	tree, err := fs.GetTree(uid)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	rootIndexReader, err := tree.RootIndex()
-	err = saveTo(rootIndexReader, tree.Hash, blobPath)
+	metadata := models.MetadataFile{
+		DocumentName:     name,
+		CollectionType:   models.CollectionType,
+		Parent:           parent,
+		Version:          1,
+		LastModified:     strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Synced:           true,
+		MetadataModified: true,
+	}
+	metahash, size, err := fs.createMetadataFile(uid, metadata)
 	if err != nil {
-		return
+		return nil, err
 	}
-	blobStorage := &LocalBlobStorage{
-		fs:  fs,
-		uid: uid,
+	fi := models.NewFileHashEntry(metahash, docid+models.MetadataFileExt)
+	fi.Size = size
+	hashDoc := models.NewHashDocMeta(docid, metadata)
+	err = hashDoc.AddFile(fi)
+	if err != nil {
+		return nil, err
 	}
 
-	//todo:check gen + locking
-	gen, err := blobStorage.WriteRootIndex(tree.Generation, tree.Hash)
+	contentHash, size, err := models.Hash(strings.NewReader(models.FolderContent))
 	if err != nil {
-		return
+		return nil, err
+	}
+	err = fs.saveTo(uid, strings.NewReader(models.FolderContent), contentHash)
+	if err != nil {
+		return nil, err
+	}
+	fi = models.NewFileHashEntry(contentHash, docid+models.ContentFileExt)
+	fi.Size = size
+	err = hashDoc.AddFile(fi)
+	if err != nil {
+		return nil, err
 	}
-	log.Info("got gen ", gen)
-	tree.Generation = gen
-	err = fs.SaveTree(uid, tree)
 
+	err = fs.publishDoc(uid, tree, hashDoc)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return &storage.Document{
+		ID:      docid,
+		Type:    models.CollectionType,
+		Parent:  parent,
+		Name:    name,
+		Version: 1,
+	}, nil
+}
 
-	doc = &storage.Document{
-		ID:     docid,
-		Type:   models.DocumentType,
-		Parent: "",
-		Name:   docName,
+// UpdateBlobDocument stores the changed metadata of a document of the tree
+// and publishes the tree as a new root generation, which fails with
+// ErrorWrongGeneration when the tree changed in the meantime
+func (fs *FileSystemStorage) UpdateBlobDocument(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	metahash, reader, err := hashDoc.MetadataReader()
+	if err != nil {
+		return err
 	}
-	return
+	err = fs.saveTo(uid, reader, metahash)
+	if err != nil {
+		return err
+	}
+	err = hashDoc.Rehash()
+	if err != nil {
+		return err
+	}
+	err = tree.Rehash()
+	if err != nil {
+		return err
+	}
+	return fs.publishTree(uid, tree, hashDoc)
+}
+
+// RemoveBlobDocuments removes documents from the tree and publishes the tree
+// as a new root generation, their blobs are left to the garbage collection
+func (fs *FileSystemStorage) RemoveBlobDocuments(uid string, tree *models.HashTree, docIDs ...string) error {
+	for _, docID := range docIDs {
+		if _, err := tree.FindDoc(docID); err != nil {
+			return storage.ErrorNotFound
+		}
+		err := tree.Remove(docID)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.publishRoot(uid, tree)
 }
 
-func saveTo(r io.Reader, hash, blobPath string) (err error) {
-	rootIndexFilePath := path.Join(blobPath, hash)
-	rootIndex, err := os.Create(rootIndexFilePath)
+// publishDoc adds the document to the tree and makes the new root current
+func (fs *FileSystemStorage) publishDoc(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	err := tree.Add(hashDoc)
 	if err != nil {
-		return
+		return err
 	}
-	_, err = io.Copy(rootIndex, r)
+	return fs.publishTree(uid, tree, hashDoc)
+}
+
+// publishTree stores the indexes of the changed document and the tree and makes the new root current
+func (fs *FileSystemStorage) publishTree(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	docIndexReader, err := hashDoc.IndexReader()
 	if err != nil {
-		return
+		return err
 	}
-	return nil
+	err = fs.saveTo(uid, docIndexReader, hashDoc.Hash)
+	if err != nil {
+		return err
+	}
+	return fs.publishRoot(uid, tree)
+}
+
+// publishRoot stores the root index of the tree and makes it the current root
+func (fs *FileSystemStorage) publishRoot(uid string, tree *models.HashTree) error {
+	rootIndexReader, err := tree.RootIndex()
+	if err != nil {
+		return err
+	}
+	err = fs.saveTo(uid, rootIndexReader, tree.Hash)
+	if err != nil {
+		return err
+	}
+	entry, err := fs.storeRoot(uid, "", tree.Hash, tree.Generation)
+	if err != nil {
+		return err
+	}
+	log.Info("got gen ", entry.Generation)
+	if entry.Hash != tree.Hash {
+		// merged with a root a device published since the tree was loaded
+		ls := &LocalBlobStorage{
+			fs:  fs,
+			uid: uid,
+		}
+		merged, err := models.BuildTreeFromRoot(ls, entry.Hash, entry.Generation)
+		if err != nil {
+			// the tree is rebuilt from the root on the next load
+			log.Warn("cannot load the merged tree of ", uid, ": ", err)
+			fs.trees.Remove(uid)
+			err = os.Remove(path.Join(fs.getUserPath(uid), cachedTreeName))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		*tree = *merged
+	}
+	tree.Generation = entry.Generation
+	return fs.SaveTree(uid, tree)
 }
 
-func createMetadataFile(metadata models.MetadataFile, spath string) (filehash string, size int64, err error) {
+// importBlobArchive stores the files of an uploaded .zip, .rmdoc or .rm as
+// blobs, the document keeps its id unless it is not a uuid or already taken
+func (fs *FileSystemStorage) importBlobArchive(uid, filename, parent, ext string, stream io.Reader) (*storage.Document, error) {
+	archive, closeArchive, err := models.OpenUploadedArchive(ext, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
 
-	jsn, err := json.Marshal(metadata)
+	tree, err := fs.GetTree(uid)
 	if err != nil {
-		return
+		return nil, err
 	}
-	filehash, size, err = models.Hash(bytes.NewReader(jsn))
+	hashDoc, err := archive.HashDoc(&LocalBlobStorage{fs: fs, uid: uid}, tree, filename, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.publishDoc(uid, tree, hashDoc)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Document{
+		ID:     archive.ID,
+		Type:   models.DocumentType,
+		Parent: parent,
+		Name:   hashDoc.DocumentName,
+	}, nil
+}
+
+func (fs *FileSystemStorage) saveTo(uid string, r io.Reader, hash string) error {
+	blobPath := fs.getBlobFilePath(uid, hash)
+	defer fs.trackUsage(uid, blobPath)()
+	return fs.writeBlob(uid, blobPath, hash, r)
+}
+
+func (fs *FileSystemStorage) createMetadataFile(uid string, metadata models.MetadataFile) (filehash string, size int64, err error) {
+
+	jsn, err := json.Marshal(metadata)
 	if err != nil {
 		return
 	}
-	filePath := path.Join(spath, filehash)
-	err = ioutil.WriteFile(filePath, jsn, 0600)
+	filehash, size, err = models.Hash(bytes.NewReader(jsn))
 	if err != nil {
 		return
 	}
+	filePath := fs.getBlobFilePath(uid, filehash)
+	defer fs.trackUsage(uid, filePath)()
+	err = fs.writeBlob(uid, filePath, filehash, bytes.NewReader(jsn))
 	return
 }
 
-//serves as root modification log and generation number source
-const historyFile = ".root.history"
 const rootFile = "root"
 
 // GetBlobURL return a url for a file to store
-func (fs *FileSystemStorage) GetBlobURL(uid, blobid, scope string) (docurl string, exp time.Time, err error) {
-	uploadRL := fs.Cfg.StorageURL
+func (fs *FileSystemStorage) GetBlobURL(uid, blobid, scope, deviceID string) (docurl string, exp time.Time, err error) {
+	return SignedBlobURL(fs.Cfg, uid, blobid, scope, deviceID)
+}
+
+// SignedBlobURL a signed url to the blob storage route, the device is only
+// part of it when known
+func SignedBlobURL(cfg *config.Config, uid, blobid, scope, deviceID string) (docurl string, exp time.Time, err error) {
+	uploadRL := cfg.StorageURL
 	exp = time.Now().Add(time.Minute * config.ReadStorageExpirationInMinutes)
 	strExp := strconv.FormatInt(exp.Unix(), 10)
 
-	signature, err := SignURLParams([]string{uid, blobid, strExp, scope}, fs.Cfg.JWTSecretKey)
+	parts := []string{uid, blobid, strExp, scope}
+	if deviceID != "" {
+		parts = append(parts, deviceID)
+	}
+	signature, err := SignURLParams(parts, cfg.JWTSecretKey)
 	if err != nil {
 		return
 	}
@@ -273,6 +486,9 @@ func (fs *FileSystemStorage) GetBlobURL(uid, blobid, scope string) (docurl strin
 		paramSignature: {signature},
 		paramScope:     {scope},
 	}
+	if deviceID != "" {
+		params.Set(paramDevice, deviceID)
+	}
 
 	blobURL := uploadRL + routeBlob + "?" + params.Encode()
 	log.Debugln("blobUrl: ", blobURL)
@@ -282,100 +498,115 @@ func (fs *FileSystemStorage) GetBlobURL(uid, blobid, scope string) (docurl strin
 // LoadBlob Opens a blob by id
 func (fs *FileSystemStorage) LoadBlob(uid, blobid string) (reader io.ReadCloser, gen int64, size int64, err error) {
 	generation := int64(0)
-	blobPath := path.Join(fs.getUserBlobPath(uid), common.Sanitize(blobid))
+	blobPath := fs.getBlobFilePath(uid, blobid)
 	log.Debugln("Fullpath:", blobPath)
 	if blobid == rootFile {
-		historyPath := path.Join(fs.getUserBlobPath(uid), historyFile)
-		lock := fslock.New(historyPath)
-		err := lock.LockWithTimeout(time.Duration(time.Second * 5))
+		lock, err := fs.lockRoot(uid)
 		if err != nil {
-			log.Error("cannot obtain lock")
 			return nil, 0, 0, err
 		}
 		defer lock.Unlock()
 
-		fi, err1 := os.Stat(historyPath)
-		if err1 == nil {
-			generation = generationFromFileSize(fi.Size())
+		current, err := fs.currentRoot(uid)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if current != nil {
+			generation = current.Generation
+			err = fs.recoverRoot(uid, current.Hash)
+			if err != nil {
+				log.Error("cannot recover the root: ", err)
+			}
 		}
 	}
 
 	fi, err := os.Stat(blobPath)
+	if os.IsNotExist(err) && fs.getLayout() < layoutSharded {
+		// moved by the migration meanwhile
+		blobPath = fs.shardedBlobPath(uid, blobid)
+		fi, err = os.Stat(blobPath)
+	}
 	if err != nil || fi.IsDir() {
 		return nil, 0, 0, ErrorNotFound
 	}
 
-	reader, err = os.Open(blobPath)
-	return reader, generation, fi.Size(), err
+	reader, size, err = fs.openStored(uid, blobPath)
+	return reader, generation, size, err
 }
 
 // StoreBlob stores a document
 func (fs *FileSystemStorage) StoreBlob(uid, id string, stream io.Reader, lastGen int64) (generation int64, err error) {
-	generation = 1
-
-	reader := stream
 	if id == rootFile {
-		historyPath := path.Join(fs.getUserBlobPath(uid), historyFile)
-		lock := fslock.New(historyPath)
-		err = lock.LockWithTimeout(time.Duration(time.Second * 5))
-		if err != nil {
-			log.Error("cannot obtain lock")
-		}
-		defer lock.Unlock()
-
-		currentGen := int64(0)
-		fi, err1 := os.Stat(historyPath)
-		if err1 == nil {
-			currentGen = generationFromFileSize(fi.Size())
-		}
-
-		if currentGen != lastGen && currentGen > 0 {
-			log.Warnf("wrong generation, server %d, client %d", currentGen, lastGen)
-			return currentGen, ErrorWrongGeneration
-		}
+		return fs.StoreRoot(uid, "", stream, lastGen)
+	}
 
-		var buf bytes.Buffer
-		tee := io.TeeReader(stream, &buf)
+	blobPath := fs.getBlobFilePath(uid, id)
+	defer fs.trackUsage(uid, blobPath)()
+	return 1, fs.writeBlob(uid, blobPath, id, stream)
+}
 
-		var hist *os.File
-		hist, err = os.OpenFile(historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			return
-		}
-		defer hist.Close()
-		t := time.Now().UTC().Format(time.RFC3339) + " "
-		hist.WriteString(t)
-		_, err = io.Copy(hist, tee)
-		if err != nil {
-			return
-		}
-		hist.WriteString("\n")
+// StoreRoot publishes a new root uploaded by the device. Appending it to the
+// root log is the commit, the log is synced before the root file is replaced,
+// a root file lagging behind the log after a crash is repaired when it is loaded
+func (fs *FileSystemStorage) StoreRoot(uid, deviceID string, stream io.Reader, lastGen int64) (generation int64, err error) {
+	rootHash, err := models.ReadRootHash(stream)
+	if err != nil {
+		return
+	}
+	entry, err := fs.storeRoot(uid, deviceID, rootHash, lastGen)
+	if err == ErrorWrongGeneration {
+		return entry.Generation, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entry.Generation, nil
+}
 
-		reader = ioutil.NopCloser(&buf)
-		size, err1 := hist.Seek(0, os.SEEK_CUR)
-		if err1 != nil {
-			err = err1
-			return
-		}
-		generation = generationFromFileSize(size)
+// storeRoot commits the root to the log and replaces the root file, the
+// entry is the one committed, merged with the current root when enabled,
+// or the current one with ErrorWrongGeneration
+func (fs *FileSystemStorage) storeRoot(uid, deviceID, rootHash string, lastGen int64) (*rootLogEntry, error) {
+	lock, err := fs.lockRoot(uid)
+	if err != nil {
+		return nil, err
 	}
+	defer lock.Unlock()
 
-	blobPath := path.Join(fs.getUserBlobPath(uid), common.Sanitize(id))
-	file, err := os.Create(blobPath)
+	logPath := path.Join(fs.getUserBlobPath(uid), rootLogFile)
+	defer fs.trackUsage(uid, logPath)()
+	rootLog, err := os.OpenFile(logPath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		return
+		return nil, err
+	}
+	defer rootLog.Close()
+	entry, err := appendRootLog(rootLog, lastGen, rootHash, deviceID)
+	if err == ErrorWrongGeneration && fs.Cfg.MergeRoots {
+		entry, err = fs.mergeRoot(uid, deviceID, rootLog, entry, lastGen, rootHash)
 	}
-	defer file.Close()
-	_, err = io.Copy(file, reader)
 	if err != nil {
-		return
+		return entry, err
 	}
+	fs.trees.Invalidate(uid, entry.Generation)
 
-	return
+	rootPath := fs.getBlobFilePath(uid, rootFile)
+	defer fs.trackUsage(uid, rootPath)()
+	err = writeFile(rootPath, strings.NewReader(entry.Hash))
+	return entry, err
 }
 
-//use file size as generation
-func generationFromFileSize(size int64) int64 {
-	//time + 1 space + 64 hash + 1 newline
-	return size / 86
+// recoverRoot replaces a root file which does not match the last log entry,
+// the root was committed to the log but the crash happened before it was written
+func (fs *FileSystemStorage) recoverRoot(uid, rootHash string) error {
+	rootPath := fs.getBlobFilePath(uid, rootFile)
+	current, err := ioutil.ReadFile(rootPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if string(current) == rootHash {
+		return nil
+	}
+	log.Warnf("root of %s does not match the log, recovering %s", uid, rootHash)
+	defer fs.trackUsage(uid, rootPath)()
+	return writeFile(rootPath, strings.NewReader(rootHash))
 }
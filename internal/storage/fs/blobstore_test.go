@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+func TestUpdateBlobDocument(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := fs.CreateBlobDocument(testuser, "blah.pdf", "", strings.NewReader("dummy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := tree.FindDoc(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.DocumentName = "renamed"
+	err = fs.UpdateBlobDocument(testuser, tree, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Generation != stale.Generation+1 {
+		t.Errorf("generation %d", tree.Generation)
+	}
+
+	tree, err = fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, _ = tree.FindDoc(d.ID)
+	if doc.DocumentName != "renamed" {
+		t.Errorf("not renamed: %s", doc.DocumentName)
+	}
+	report, err := fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() {
+		t.Errorf("unhealthy after update: %+v", report)
+	}
+
+	doc, _ = stale.FindDoc(d.ID)
+	doc.Parent = "folder"
+	err = fs.UpdateBlobDocument(testuser, stale, doc)
+	if err != storage.ErrorWrongGeneration {
+		t.Errorf("stale tree published: %v", err)
+	}
+}
+
+func TestTreeCache(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := fs.CreateBlobDocument(testuser, "blah.pdf", "", strings.NewReader("dummy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the callers get copies
+	err = tree.Remove(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cached.FindDoc(d.ID); err != nil {
+		t.Errorf("the cached tree was changed: %v", err)
+	}
+
+	// a device publishes a root without the document
+	rootIndex := storeTestBlob(t, fs, testuser, "3\n")
+	gen, err := fs.StoreRoot(testuser, "device", strings.NewReader(rootIndex), cached.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err = fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Generation != gen || tree.Hash != rootIndex {
+		t.Errorf("stale tree %d %s", tree.Generation, tree.Hash)
+	}
+	if _, err = tree.FindDoc(d.ID); err == nil {
+		t.Error("the removed document is still in the tree")
+	}
+}
@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// compressedMagic marks a file stored compressed, it is followed by the size
+// of the content and its gzip stream. No blob the devices upload starts with
+// it (text, zips, pdfs, .rm files), one that does is stored compressed anyway
+const compressedMagic = "\x89RMZ"
+
+// compressedHeaderSize the magic and the size of the content
+const compressedHeaderSize = len(compressedMagic) + 8
+
+// startCompression writes the header, its size is filled in by finishCompression
+func (w *storeWriter) startCompression() error {
+	w.decided = true
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	_, err := w.f.Write(header)
+	if err != nil {
+		return err
+	}
+	w.z = gzip.NewWriter(w.f)
+	return nil
+}
+
+func (w *storeWriter) finishCompression() error {
+	err := w.z.Close()
+	if err != nil {
+		return err
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(w.size))
+	_, err = w.f.WriteAt(size, int64(len(compressedMagic)))
+	return err
+}
+
+// readCompressedHeader the size of the content when it is compressed, the
+// reader is left at the start of the gzip stream, or of the content otherwise
+func readCompressedHeader(r io.ReadSeeker) (size int64, compressed bool, err error) {
+	header := make([]byte, compressedHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, false, err
+	}
+	if n < compressedHeaderSize || !bytes.HasPrefix(header, []byte(compressedMagic)) {
+		_, err = r.Seek(0, io.SeekStart)
+		return 0, false, err
+	}
+	return int64(binary.BigEndian.Uint64(header[len(compressedMagic):])), true, nil
+}
+
+// compressedFile the decompressed content of a file, seeking backwards
+// restarts the decompression
+type compressedFile struct {
+	f       io.ReadSeekCloser
+	z       *gzip.Reader
+	size    int64
+	modtime time.Time
+	// pos the position of the next read, read the bytes decompressed
+	pos  int64
+	read int64
+}
+
+func (c *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+func (c *compressedFile) Read(p []byte) (int, error) {
+	if c.pos < c.read {
+		_, err := c.f.Seek(int64(compressedHeaderSize), io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		err = c.z.Reset(c.f)
+		if err != nil {
+			return 0, err
+		}
+		c.read = 0
+	}
+	if c.pos > c.read {
+		n, err := io.CopyN(ioutil.Discard, c.z, c.pos-c.read)
+		c.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.z.Read(p)
+	c.read += int64(n)
+	c.pos = c.read
+	return n, err
+}
+
+func (c *compressedFile) Close() error {
+	c.z.Close()
+	return c.f.Close()
+}
+
+func (c *compressedFile) contentInfo() (int64, time.Time) {
+	return c.size, c.modtime
+}
@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+)
+
+func TestCompressedBlobs(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Repeat("reMarkable .lines file, version=5 ", 100)
+	raw := storeTestBlob(t, fs, testuser, "stored before the compression")
+	// looks like a compressed file, so it is compressed anyway
+	lookalike := storeTestBlob(t, fs, testuser, compressedMagic+"not compressed")
+	cfg.CompressBlobs = true
+	compressed := storeTestBlob(t, fs, testuser, content)
+
+	fi, err := os.Stat(fs.getBlobFilePath(testuser, compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(content)) {
+		t.Errorf("the blob was not compressed, %d bytes", fi.Size())
+	}
+	loadTestBlob(t, fs, testuser, compressed, content)
+	loadTestBlob(t, fs, testuser, raw, "stored before the compression")
+	loadTestBlob(t, fs, testuser, lookalike, compressedMagic+"not compressed")
+
+	reader, _, size, err := fs.LoadBlob(testuser, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if size != int64(len(content)) {
+		t.Errorf("expected the size of the content %d, got %d", len(content), size)
+	}
+	// a range, then from the start again
+	seeker := reader.(io.ReadSeeker)
+	_, err = seeker.Seek(100, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 10)
+	_, err = io.ReadFull(seeker, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(part) != content[100:110] {
+		t.Errorf("wrong range %q", part)
+	}
+	_, err = seeker.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(seeker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(all) != content {
+		t.Error("wrong content after seeking back")
+	}
+
+	report, err := fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 0 {
+		t.Errorf("compressed blobs reported corrupt: %v", report.Corrupt)
+	}
+}
+
+func TestCompressedDocument(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:       t.TempDir(),
+		CompressBlobs: true,
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("zip", 1000)
+	err = fs.StoreDocument(testuser, "doc", ioutil.NopCloser(strings.NewReader(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := fs.GetDocument(testuser, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	size, _ := fileInfo(reader)
+	if size != int64(len(content)) {
+		t.Errorf("expected the size of the content %d, got %d", len(content), size)
+	}
+	stored, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != content {
+		t.Error("wrong document content")
+	}
+}
+
+func TestCheckDamagedCompressedBlobs(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:       t.TempDir(),
+		CompressBlobs: true,
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("reMarkable .lines file, version=5 ", 100)
+	intact := storeTestBlob(t, fs, testuser, content)
+	badHeader := storeTestBlob(t, fs, testuser, content+"bad header")
+	truncated := storeTestBlob(t, fs, testuser, content+"truncated")
+
+	damage := func(hash string, change func([]byte) []byte) {
+		blobPath := fs.getBlobFilePath(testuser, hash)
+		stored, err := ioutil.ReadFile(blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(blobPath, change(stored), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	damage(badHeader, func(stored []byte) []byte {
+		// the gzip magic
+		stored[compressedHeaderSize] ^= 0xff
+		return stored
+	})
+	damage(truncated, func(stored []byte) []byte {
+		return stored[:len(stored)/2]
+	})
+
+	report, err := fs.CheckBlobs(testuser, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 2 || len(report.Quarantined) != 2 {
+		t.Fatalf("expected the damaged blobs, got %+v", report)
+	}
+	for _, hash := range []string{badHeader, truncated} {
+		if _, err = os.Stat(path.Join(fs.getUserPath(testuser), quarantineDir, hash)); err != nil {
+			t.Errorf("%s not quarantined", hash)
+		}
+	}
+	loadTestBlob(t, fs, testuser, intact, content)
+}
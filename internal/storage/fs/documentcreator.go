@@ -2,11 +2,10 @@ package fs
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -16,53 +15,14 @@ import (
 	"github.com/zgs225/rmfakecloud/internal/storage"
 	"github.com/zgs225/rmfakecloud/internal/storage/models"
 	"github.com/google/uuid"
-	"github.com/sirupsen/logrus"
 )
 
-func createContent(fileType string) string {
-	fileType = strings.TrimPrefix(fileType, ".")
-	str :=
-		`
-{
-	"dummyDocument": false,
-	"extraMetadata": {
-		"LastPen": "Finelinerv2",
-		"LastTool": "Finelinerv2",
-		"ThicknessScale": "",
-		"LastFinelinerv2Size": "1"
-	},
-	"fileType": "%s",
-	"fontName": "",
-	"lastOpenedPage": 0,
-	"lineHeight": -1,
-	"margins": 180,
-	"orientation": "portrait",
-	"pageCount": 0,
-	"pages": [],
-	"textScale": 1,
-	"transform": {
-		"m11": 1,
-		"m12": 0,
-		"m13": 0,
-		"m21": 0,
-		"m22": 1,
-		"m23": 0,
-		"m31": 0,
-		"m32": 0,
-		"m33": 1
-	}
-}
-`
-	return fmt.Sprintf(str, fileType)
-}
-
-func extractID(r io.Reader) (string, error) {
-	return "", nil
-}
-
 // CreateDocument creates a new document
 func (fs *FileSystemStorage) CreateDocument(uid, filename, parent string, stream io.Reader) (doc *storage.Document, err error) {
 	ext := path.Ext(filename)
+	if models.IsDocumentArchive(ext) {
+		return fs.importArchive(uid, filename, parent, ext, stream)
+	}
 	switch ext {
 	case models.PdfFileExt:
 		fallthrough
@@ -71,79 +31,151 @@ func (fs *FileSystemStorage) CreateDocument(uid, filename, parent string, stream
 		return nil, errors.New("unsupported extension: " + ext)
 	}
 
-	var docid string
-
-	var isZip = false
-	if ext == models.ZipFileExt {
-		docid, err = extractID(stream)
-		isZip = true
-	} else {
-		docid = uuid.New().String()
-	}
+	docid := uuid.New().String()
 	//create zip from pdf
 	zipfile := fs.getPathFromUser(uid, docid+models.ZipFileExt)
-	file, err := os.Create(zipfile)
+	defer fs.trackUsage(uid, zipfile)()
+	file, err := fs.createStored(uid, zipfile)
+	if err != nil {
+		return
+	}
+	defer file.Abort()
+
+	w := zip.NewWriter(file)
+
+	documentPath := docid + ext
+	var entry io.Writer
+	entry, err = w.Create(documentPath)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(entry, stream)
 	if err != nil {
 		return
 	}
-	defer file.Close()
-
-	if !isZip {
-		w := zip.NewWriter(file)
-		defer w.Close()
-
-		documentPath := docid + ext
-		var entry io.Writer
-		entry, err = w.Create(documentPath)
-		if err != nil {
-			return
-		}
-
-		_, err = io.Copy(entry, stream)
-		if err != nil {
-			return
-		}
-
-		entry, err = w.Create(docid + models.PageFileExt)
-		if err != nil {
-			return
-		}
-		entry.Write([]byte{})
-
-		entry, err = w.Create(docid + models.ContentFileExt)
-		if err != nil {
-			return
-		}
-
-		content := createContent(ext)
-		entry.Write([]byte(content))
-	} else {
-		logrus.Info("writing file")
-		_, err = io.Copy(file, stream)
-		if err != nil {
-			return
-		}
+
+	entry, err = w.Create(docid + models.PageFileExt)
+	if err != nil {
+		return
+	}
+	entry.Write([]byte{})
+
+	entry, err = w.Create(docid + models.ContentFileExt)
+	if err != nil {
+		return
+	}
+
+	content := models.CreateContent(ext)
+	entry.Write([]byte(content))
+
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	err = file.Commit()
+	if err != nil {
+		return
 	}
 
 	//create metadata
 	name := strings.TrimSuffix(filename, ext)
+	return fs.createDocumentMetadata(uid, docid, name, parent)
+}
+
+// CreateFolder creates a new folder, its zip only has the content
+func (fs *FileSystemStorage) CreateFolder(uid, name, parent string) (*storage.Document, error) {
+	docid := uuid.New().String()
+	zipfile := fs.getPathFromUser(uid, docid+models.ZipFileExt)
+	defer fs.trackUsage(uid, zipfile)()
+	file, err := fs.createStored(uid, zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Abort()
+
+	w := zip.NewWriter(file)
+	entry, err := w.Create(docid + models.ContentFileExt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = entry.Write([]byte(models.FolderContent))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = file.Commit()
+	if err != nil {
+		return nil, err
+	}
+
 	doc1 := createRawMedatadata(docid, name, parent)
+	doc1.Type = models.CollectionType
+	return fs.saveDocumentMetadata(uid, doc1)
+}
 
-	jsn, err := json.Marshal(doc1)
+// importArchive stores the files of an uploaded .zip, .rmdoc or .rm, the
+// document keeps its id unless it is not a uuid or already taken
+func (fs *FileSystemStorage) importArchive(uid, filename, parent, ext string, stream io.Reader) (*storage.Document, error) {
+	archive, closeArchive, err := models.OpenUploadedArchive(ext, stream)
 	if err != nil {
-		return
+		return nil, err
 	}
+	defer closeArchive()
 
-	doc = &storage.Document{
-		ID:      docid,
-		Type:    doc1.Type,
-		Name:    name,
-		Version: 1,
+	_, taken := os.Stat(fs.getPathFromUser(uid, archive.ID+models.MetadataFileExt))
+	if _, err := uuid.Parse(archive.ID); err != nil || taken == nil {
+		archive.Remap(uuid.NewString())
 	}
+
+	zipfile := fs.getPathFromUser(uid, archive.ID+models.ZipFileExt)
+	defer fs.trackUsage(uid, zipfile)()
+	file, err := fs.createStored(uid, zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Abort()
+	err = archive.WriteZip(file)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.createDocumentMetadata(uid, archive.ID, archive.Name(filename), parent)
+}
+
+// createDocumentMetadata saves the metadata of a new document
+func (fs *FileSystemStorage) createDocumentMetadata(uid, docid, name, parent string) (*storage.Document, error) {
+	return fs.saveDocumentMetadata(uid, createRawMedatadata(docid, name, parent))
+}
+
+// saveDocumentMetadata saves the metadata of a new document or folder
+func (fs *FileSystemStorage) saveDocumentMetadata(uid string, doc1 *messages.RawMetadata) (*storage.Document, error) {
+	jsn, err := json.Marshal(doc1)
+	if err != nil {
+		return nil, err
+	}
+
 	//save metadata
-	metafilePath := fs.getPathFromUser(uid, docid+models.MetadataFileExt)
-	err = ioutil.WriteFile(metafilePath, jsn, 0600)
-	return
+	metafilePath := fs.getPathFromUser(uid, doc1.ID+models.MetadataFileExt)
+	defer fs.trackUsage(uid, metafilePath)()
+	err = fs.writeStored(uid, metafilePath, bytes.NewReader(jsn))
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Document{
+		ID:      doc1.ID,
+		Type:    doc1.Type,
+		Parent:  doc1.Parent,
+		Name:    doc1.VissibleName,
+		Version: doc1.Version,
+	}, nil
 }
 
 func createRawMedatadata(id, name, parent string) *messages.RawMetadata {
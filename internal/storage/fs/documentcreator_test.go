@@ -1,6 +1,8 @@
 package fs
 
 import (
+	"archive/zip"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
@@ -43,3 +45,129 @@ func TestCreateDocument(t *testing.T) {
 	}
 
 }
+
+func testArchive(t *testing.T, id string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		id + models.ContentFileExt: "{}",
+		id + "/page.rm":            "lines",
+	} {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportArchive(t *testing.T) {
+	testuser := "test"
+	id := "0b6ef7a6-4bd5-4b5e-8c5e-7d1b0f0c3a11"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := fs.CreateDocument(testuser, "notes.zip", "", bytes.NewReader(testArchive(t, id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ID != id || d.Name != "notes" {
+		t.Errorf("imported as %s %s", d.ID, d.Name)
+	}
+	again, err := fs.CreateDocument(testuser, "notes.zip", "", bytes.NewReader(testArchive(t, id)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID == id {
+		t.Error("the existing document is overwritten")
+	}
+
+	for _, name := range []string{"notes.zip", "notes.rmdoc"} {
+		d, err = fs.CreateBlobDocument(testuser, name, "", bytes.NewReader(testArchive(t, id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.ID == id {
+		t.Error("the existing blob document is overwritten")
+	}
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := tree.FindDoc(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.DocumentName != "notes" || len(doc.Files) != 3 {
+		t.Errorf("imported %s with %d files", doc.DocumentName, len(doc.Files))
+	}
+	report, err := fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || report.Documents != 2 {
+		t.Errorf("unhealthy after import: %+v", report)
+	}
+}
+
+func TestCreateFolder(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder, err := fs.CreateFolder(testuser, "books", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := fs.GetMetadata(testuser, folder.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Type != models.CollectionType || metadata.VissibleName != "books" {
+		t.Errorf("folder metadata %+v", metadata)
+	}
+
+	parent, err := fs.CreateBlobFolder(testuser, "books", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := fs.CreateBlobFolder(testuser, "novels", parent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := tree.FindDoc(nested.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.CollectionType != models.CollectionType || doc.Parent != parent.ID || len(doc.Files) != 2 {
+		t.Errorf("nested folder %+v", doc.MetadataFile)
+	}
+	report, err := fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy() || report.Documents != 2 {
+		t.Errorf("unhealthy after creating folders: %+v", report)
+	}
+}
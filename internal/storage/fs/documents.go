@@ -1,13 +1,15 @@
 package fs
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -30,7 +32,14 @@ const (
 
 // FileSystemStorage store everything to disk
 type FileSystemStorage struct {
-	Cfg *config.Config
+	Cfg   *config.Config
+	usage *storage.UsageCounter
+	trees *storage.TreeCache
+	// layout the version of the data dir layout, accessed atomically
+	layout int32
+	// keyrings the unwrapped data keys of the users
+	keysMu   sync.Mutex
+	keyrings map[string]*keyring
 }
 
 func sanitizeFileName(fileName string) string {
@@ -46,14 +55,15 @@ func (fs *FileSystemStorage) getUserBlobPath(uid string) string {
 	return filepath.Join(fs.getUserPath(uid), SyncFolder)
 }
 
+// gets the path of a file in the user dir
 func (fs *FileSystemStorage) getPathFromUser(uid, path string) string {
 	return filepath.Join(fs.getUserPath(uid), sanitizeFileName(path))
 }
 
-// ExportDocument Exports a document to the outputType
-func (fs *FileSystemStorage) ExportDocument(uid, id, outputType string, exportOption storage.ExportOption) (io.ReadCloser, error) {
-	if outputType != "pdf" {
-		return nil, errors.New("todo: only pdfs supported")
+// ExportDocument Exports a document to the format
+func (fs *FileSystemStorage) ExportDocument(uid, id string, format storage.ExportFormat, options storage.ExportOptions) (io.ReadCloser, error) {
+	if !exporter.IsFormat(format.Type) {
+		return nil, exporter.ErrorUnsupportedFormat
 	}
 
 	cacheDirPath := fs.getPathFromUser(uid, CacheDir)
@@ -70,21 +80,30 @@ func (fs *FileSystemStorage) ExportDocument(uid, id, outputType string, exportOp
 		return nil, fmt.Errorf("cant find raw document %v", err)
 	}
 
-	outputFilePath := path.Join(cacheDirPath, sanitizedID+"-annotated.pdf")
+	outputFilePath := path.Join(cacheDirPath, sanitizedID+"-"+options.String()+"."+format.String())
 	outStat, err := os.Stat(outputFilePath)
 
 	// exists and not older
 	if err == nil && !rawStat.ModTime().After(outStat.ModTime()) {
-		return os.Open(outputFilePath)
+		cached, _, err := fs.openStored(uid, outputFilePath)
+		return cached, err
 	}
 
-	size := rawStat.Size()
 	arch := &exporter.MyArchive{}
-	zipFile, err := os.Open(zipFilePath)
+	stored, size, err := fs.openStored(uid, zipFilePath)
 	if err != nil {
 		return nil, err
 	}
-	defer zipFile.Close()
+	defer stored.Close()
+	zipFile, ok := stored.(io.ReaderAt)
+	if !ok {
+		// a compressed or encrypted zip, which needs random access
+		content, err := ioutil.ReadAll(stored)
+		if err != nil {
+			return nil, err
+		}
+		zipFile = bytes.NewReader(content)
+	}
 	err = arch.Read(zipFile, size)
 	if err != nil {
 		return nil, err
@@ -94,22 +113,24 @@ func (fs *FileSystemStorage) ExportDocument(uid, id, outputType string, exportOp
 		arch.PayloadReader = exporter.NewSeekCloser(arch.Payload)
 	}
 
-	outputFile, err := os.Create(outputFilePath)
+	outputFile, err := fs.createStored(uid, outputFilePath)
 	if err != nil {
 		return nil, err
 	}
+	defer outputFile.Abort()
 
-	err = exporter.RenderRmapi(arch, outputFile)
+	err = exporter.Export(arch, format.Type, format.DPI, options.GeneratorOptions(), outputFile)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = outputFile.Seek(0, 0)
+	err = outputFile.Commit()
 	if err != nil {
 		return nil, err
 	}
 
-	return outputFile, nil
+	exported, _, err := fs.openStored(uid, outputFilePath)
+	return exported, err
 
 }
 
@@ -117,7 +138,7 @@ func (fs *FileSystemStorage) ExportDocument(uid, id, outputType string, exportOp
 func (fs *FileSystemStorage) GetDocument(uid, id string) (io.ReadCloser, error) {
 	fullPath := fs.getPathFromUser(uid, id+models.ZipFileExt)
 	log.Debugln("Fullpath:", fullPath)
-	reader, err := os.Open(fullPath)
+	reader, _, err := fs.openStored(uid, fullPath)
 	return reader, err
 }
 
@@ -141,27 +162,40 @@ func (fs *FileSystemStorage) RemoveDocument(uid, id string) error {
 	zipfile := filepath.Base(id + models.ZipFileExt)
 	fullPath = fs.getPathFromUser(uid, zipfile)
 	err = os.Rename(fullPath, path.Join(trashDir, zipfile))
-	if err != nil {
+	// folders may have no content
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return nil
+	// the modification time of the metadata is when it was trashed
+	now := time.Now()
+	return os.Chtimes(path.Join(trashDir, meta), now, now)
 }
 
-// StoreDocument stores a document
+// StoreDocument stores a document, the content it replaces is kept as a version
 func (fs *FileSystemStorage) StoreDocument(uid, id string, stream io.ReadCloser) error {
 	fullPath := fs.getPathFromUser(uid, id+models.ZipFileExt)
-	file, err := os.Create(fullPath)
+	err := fs.keepVersion(uid, id)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = io.Copy(file, stream)
-	return err
+	track := fs.trackUsage(uid, fullPath)
+	err = fs.writeStored(uid, fullPath, stream)
+	track()
+	if err != nil {
+		return err
+	}
+	// after the write, a version being restored may be the oldest
+	return fs.pruneVersions(uid, id)
 }
 
 // GetStorageURL the storage url
 func (fs *FileSystemStorage) GetStorageURL(uid, id string) (docurl string, expiration time.Time, err error) {
-	uploadRL := fs.Cfg.StorageURL
+	return SignedStorageURL(fs.Cfg, uid, id)
+}
+
+// SignedStorageURL a url with a signed token to the document storage route
+func SignedStorageURL(cfg *config.Config, uid, id string) (docurl string, expiration time.Time, err error) {
+	uploadRL := cfg.StorageURL
 	exp := time.Now().Add(time.Minute * config.ReadStorageExpirationInMinutes)
 
 	log.Debugln("uploadUrl: ", uploadRL)
@@ -173,7 +207,7 @@ func (fs *FileSystemStorage) GetStorageURL(uid, id string) (docurl string, expir
 			Audience:  storageUsage,
 		},
 	}
-	signedToken, err := common.SignClaims(claim, fs.Cfg.JWTSecretKey)
+	signedToken, err := common.SignClaims(claim, cfg.JWTSecretKey)
 	if err != nil {
 		return "", exp, err
 	}
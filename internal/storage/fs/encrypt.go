@@ -0,0 +1,231 @@
+package fs
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// encryptedMagic marks a file encrypted with a data key of the user, it is
+	// followed by the id of the key, the nonce prefix and the sealed chunks
+	encryptedMagic = "\x89RME"
+	// encryptedChunkSize the content is sealed in chunks, which can be
+	// decrypted on their own for Range requests
+	encryptedChunkSize  = 64 * 1024
+	noncePrefixSize     = 7
+	encryptedHeaderSize = len(encryptedMagic) + dataKeyIDSize + noncePrefixSize
+)
+
+// storeTarget where the content of a stored file is written, the header of
+// the content is filled in at the end
+type storeTarget interface {
+	io.Writer
+	io.WriterAt
+}
+
+// chunkNonce the nonce of the chunk, the last chunk is marked so that a
+// truncated file does not decrypt
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals the content chunk by chunk. The first chunk is sealed
+// last, so that the header of the content written in it can still be changed
+type encryptWriter struct {
+	f      storeTarget
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	// chunk the current chunk, first the first one held back
+	chunk []byte
+	first []byte
+	index uint32
+}
+
+func newEncryptWriter(f storeTarget, keyID []byte, aead cipher.AEAD) (*encryptWriter, error) {
+	prefix := make([]byte, noncePrefixSize)
+	_, err := rand.Read(prefix)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedMagic...)
+	header = append(header, keyID...)
+	header = append(header, prefix...)
+	_, err = f.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{f: f, aead: aead, header: header, prefix: prefix}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	e.chunk = append(e.chunk, p...)
+	// a full chunk is only sealed once more follows, the last one is marked
+	for len(e.chunk) > encryptedChunkSize {
+		if e.index == 0 {
+			e.first = append([]byte{}, e.chunk[:encryptedChunkSize]...)
+			// reserved for the first chunk
+			_, err := e.f.Write(make([]byte, encryptedChunkSize+e.aead.Overhead()))
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			_, err := e.f.Write(e.seal(e.chunk[:encryptedChunkSize], false))
+			if err != nil {
+				return 0, err
+			}
+		}
+		e.index++
+		e.chunk = e.chunk[encryptedChunkSize:]
+	}
+	return len(p), nil
+}
+
+// WriteAt changes content in the first chunk, which is not sealed yet
+func (e *encryptWriter) WriteAt(p []byte, off int64) (int, error) {
+	first := e.first
+	if e.index == 0 {
+		first = e.chunk
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(first)) {
+		return 0, errors.New("can only change the first chunk")
+	}
+	return copy(first[off:], p), nil
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) []byte {
+	return e.aead.Seal(nil, chunkNonce(e.prefix, e.index, last), chunk, e.header)
+}
+
+// Close seals the last and the first chunk
+func (e *encryptWriter) Close() error {
+	_, err := e.f.Write(e.seal(e.chunk, true))
+	if err != nil || e.index == 0 {
+		return err
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, 0, false), e.first, e.header)
+	_, err = e.f.WriteAt(sealed, int64(len(e.header)))
+	return err
+}
+
+// encryptedFile the decrypted content of a file, seekable
+type encryptedFile struct {
+	f       *os.File
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	size    int64
+	modtime time.Time
+	// stored the size of the file, chunks the number of sealed chunks
+	stored int64
+	chunks int64
+	pos    int64
+	// plain the decrypted chunk at index
+	plain []byte
+	index int64
+}
+
+// readEncryptedHeader the id of the data key when the file is encrypted
+func readEncryptedHeader(f *os.File) (header []byte, encrypted bool, err error) {
+	header = make([]byte, encryptedHeaderSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	if n < encryptedHeaderSize || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, false, nil
+	}
+	return header, true, nil
+}
+
+func newEncryptedFile(f *os.File, fi os.FileInfo, header []byte, aead cipher.AEAD) (*encryptedFile, error) {
+	sealedChunk := int64(encryptedChunkSize + aead.Overhead())
+	sealed := fi.Size() - int64(len(header))
+	if sealed < int64(aead.Overhead()) {
+		return nil, errors.New("truncated encrypted file")
+	}
+	chunks := (sealed + sealedChunk - 1) / sealedChunk
+	return &encryptedFile{
+		f:       f,
+		aead:    aead,
+		header:  header,
+		prefix:  header[len(header)-noncePrefixSize:],
+		size:    sealed - chunks*int64(aead.Overhead()),
+		modtime: fi.ModTime(),
+		stored:  fi.Size(),
+		chunks:  chunks,
+		index:   -1,
+	}, nil
+}
+
+func (e *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += e.pos
+	case io.SeekEnd:
+		offset += e.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	e.pos = offset
+	return offset, nil
+}
+
+func (e *encryptedFile) Read(p []byte) (int, error) {
+	if e.pos >= e.size {
+		return 0, io.EOF
+	}
+	index := e.pos / encryptedChunkSize
+	if index != e.index {
+		err := e.open(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.plain[e.pos-index*encryptedChunkSize:])
+	e.pos += int64(n)
+	return n, nil
+}
+
+// open decrypts the chunk
+func (e *encryptedFile) open(index int64) error {
+	sealedChunk := int64(encryptedChunkSize + e.aead.Overhead())
+	offset := int64(len(e.header)) + index*sealedChunk
+	length := sealedChunk
+	if offset+length > e.stored {
+		length = e.stored - offset
+	}
+	sealed := make([]byte, length)
+	_, err := e.f.ReadAt(sealed, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	plain, err := e.aead.Open(nil, chunkNonce(e.prefix, uint32(index), index == e.chunks-1), sealed, e.header)
+	if err != nil {
+		return errors.New("cannot decrypt, the file was modified or the key is wrong")
+	}
+	e.plain = plain
+	e.index = index
+	return nil
+}
+
+func (e *encryptedFile) Close() error {
+	return e.f.Close()
+}
+
+func (e *encryptedFile) contentInfo() (int64, time.Time) {
+	return e.size, e.modtime
+}
@@ -0,0 +1,298 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/model"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// largeTestContent spans several encrypted chunks, every position is distinct
+func largeTestContent() string {
+	var b strings.Builder
+	for i := 0; b.Len() < 3*encryptedChunkSize; i++ {
+		b.WriteString(time.Duration(i).String())
+	}
+	return b.String()
+}
+
+func assertEncrypted(t *testing.T, filePath, plain string) {
+	t.Helper()
+	stored, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, []byte(encryptedMagic)) {
+		t.Errorf("%s is not encrypted", filePath)
+	}
+	if bytes.Contains(stored, []byte(plain)) {
+		t.Errorf("%s contains the plain content", filePath)
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	testuser := "test"
+	for _, compress := range []bool{false, true} {
+		cfg := &config.Config{
+			DataDir:       t.TempDir(),
+			EncryptionKey: testMasterKey(t),
+			CompressBlobs: compress,
+		}
+		fs := NewStorage(cfg)
+		user, err := model.NewUser(testuser, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fs.RegisterUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEncrypted(t, fs.getPathFromUser(testuser, profileName), user.Password)
+		stored, err := fs.GetUser(testuser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Password != user.Password {
+			t.Error("wrong profile")
+		}
+
+		content := largeTestContent()
+		hash := storeTestBlob(t, fs, testuser, content)
+		assertEncrypted(t, fs.getBlobFilePath(testuser, hash), content[:100])
+		loadTestBlob(t, fs, testuser, hash, content)
+
+		reader, _, size, err := fs.LoadBlob(testuser, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(content)) {
+			t.Errorf("compress %t: expected the size %d, got %d", compress, len(content), size)
+		}
+		// a range across two chunks
+		seeker := reader.(io.ReadSeeker)
+		start := int64(encryptedChunkSize - 5)
+		_, err = seeker.Seek(start, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, 10)
+		_, err = io.ReadFull(seeker, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+		if string(part) != content[start:start+10] {
+			t.Errorf("compress %t: wrong range %q", compress, part)
+		}
+
+		err = fs.UpdateMetadata(testuser, &messages.RawMetadata{ID: "doc", VissibleName: "secret name"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEncrypted(t, fs.getPathFromUser(testuser, "doc.metadata"), "secret name")
+		metadata, err := fs.GetMetadata(testuser, "doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.VissibleName != "secret name" {
+			t.Error("wrong metadata")
+		}
+
+		report, err := fs.CheckBlobs(testuser, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Corrupt) != 0 {
+			t.Errorf("compress %t: encrypted blobs reported corrupt: %v", compress, report.Corrupt)
+		}
+
+		// without the master key
+		plain := NewStorage(&config.Config{DataDir: cfg.DataDir})
+		_, _, _, err = plain.LoadBlob(testuser, hash)
+		if err != ErrorNoMasterKey {
+			t.Errorf("expected the missing master key, got %v", err)
+		}
+	}
+}
+
+func TestEncryptedBlobTampered(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:       t.TempDir(),
+		EncryptionKey: testMasterKey(t),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := largeTestContent()
+	hash := storeTestBlob(t, fs, testuser, content)
+	blobPath := fs.getBlobFilePath(testuser, hash)
+	stored, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a truncated last chunk, then a modified one
+	for _, tampered := range [][]byte{
+		stored[:len(stored)-1],
+		append(append([]byte{}, stored[:len(stored)-10]...), bytes.Repeat([]byte{'x'}, 10)...),
+	} {
+		err = ioutil.WriteFile(blobPath, tampered, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, _, _, err := fs.LoadBlob(testuser, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(reader)
+		reader.Close()
+		if err == nil {
+			t.Error("a tampered blob was decrypted")
+		}
+	}
+}
+
+func TestCheckTamperedEncryptedBlob(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:       t.TempDir(),
+		EncryptionKey: testMasterKey(t),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := largeTestContent()
+	intact := storeTestBlob(t, fs, testuser, content)
+	tampered := storeTestBlob(t, fs, testuser, content+"tampered")
+	blobPath := fs.getBlobFilePath(testuser, tampered)
+	stored, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a flipped byte in the second chunk
+	stored[len(stored)-encryptedChunkSize] ^= 0x01
+	err = ioutil.WriteFile(blobPath, stored, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.CheckBlobs(testuser, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != tampered || len(report.Quarantined) != 1 {
+		t.Fatalf("expected the tampered blob, got %+v", report)
+	}
+	loadTestBlob(t, fs, testuser, intact, content)
+
+	// without the master key nothing is quarantined
+	plain := NewStorage(&config.Config{DataDir: cfg.DataDir})
+	if _, err = plain.CheckBlobs(testuser, true); err != ErrorNoMasterKey {
+		t.Errorf("expected the missing master key, got %v", err)
+	}
+	loadTestBlob(t, fs, testuser, intact, content)
+}
+
+func TestEncryptUser(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	user, err := model.NewUser(testuser, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := storeTestBlob(t, fs, testuser, "plain page")
+	blobPath := fs.getBlobFilePath(testuser, hash)
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.Chtimes(blobPath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := testMasterKey(t)
+	cfg.EncryptionKey = oldKey
+	fs = NewStorage(cfg)
+	// plain files stay readable
+	loadTestBlob(t, fs, testuser, hash, "plain page")
+	err = fs.RotateKeys(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := fs.EncryptUser(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != 2 {
+		t.Errorf("expected the profile and the blob encrypted, got %d", encrypted)
+	}
+	assertEncrypted(t, blobPath, "plain page")
+	fi, err := os.Stat(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(old) {
+		t.Errorf("the modification time changed to %v", fi.ModTime())
+	}
+	encrypted, err = fs.EncryptUser(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != 0 {
+		t.Errorf("encrypted files were encrypted again: %d", encrypted)
+	}
+
+	// a new master key and a new data key
+	cfg = &config.Config{
+		DataDir:                cfg.DataDir,
+		EncryptionKey:          testMasterKey(t),
+		PreviousEncryptionKeys: [][]byte{oldKey},
+	}
+	fs = NewStorage(cfg)
+	err = fs.RotateKeys(testuser, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err = fs.EncryptUser(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != 2 {
+		t.Errorf("expected the files encrypted with the new data key, got %d", encrypted)
+	}
+
+	// the previous master key is not needed anymore
+	cfg.PreviousEncryptionKeys = nil
+	fs = NewStorage(cfg)
+	loadTestBlob(t, fs, testuser, hash, "plain page")
+	_, err = fs.GetUser(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// corrupt blobs are moved here, out of the sync directory
+const quarantineDir = ".quarantine"
+
+// CheckBlobs verifies that every blob matches its hash, that the root and the
+// document indexes only reference existing blobs of the right size and that
+// the cached tree matches the root. With repair the corrupt blobs are
+// quarantined and the cached tree is rebuilt
+func (fs *FileSystemStorage) CheckBlobs(uid string, repair bool) (*storage.FsckReport, error) {
+	report := &storage.FsckReport{
+		UserID:       uid,
+		Repair:       repair,
+		Corrupt:      []string{},
+		Dangling:     []string{},
+		SizeMismatch: []string{},
+		Unparsable:   []string{},
+		Quarantined:  []string{},
+	}
+
+	sizes, err := fs.checkBlobHashes(uid, report)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: uid,
+	}
+	rootHash, gen, err := ls.GetRootIndex()
+	if err != nil {
+		return nil, err
+	}
+	report.Root = rootHash
+	report.Generation = gen
+	if rootHash == "" {
+		return report, nil
+	}
+
+	check := models.CheckIndexes(ls, rootHash, sizes)
+	report.Documents = check.Documents
+	report.Dangling = append(report.Dangling, check.Dangling...)
+	report.SizeMismatch = append(report.SizeMismatch, check.SizeMismatch...)
+	report.Unparsable = append(report.Unparsable, check.Unparsable...)
+
+	err = fs.checkTreeCache(uid, rootHash, gen, check.Docs, report)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("fsck %s: scanned %d, documents %d, corrupt %d, dangling %d, size mismatches %d, unparsable %d, stale cache: %t",
+		uid, report.Scanned, report.Documents, len(report.Corrupt), len(report.Dangling),
+		len(report.SizeMismatch), len(report.Unparsable), report.StaleCache)
+	return report, nil
+}
+
+// checkBlobHashes hashes all blobs and returns the sizes of the intact ones,
+// the index blobs are named by the hash of their entries
+func (fs *FileSystemStorage) checkBlobHashes(uid string, report *storage.FsckReport) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	blobs, err := fs.listBlobs(uid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sizes, nil
+		}
+		return nil, err
+	}
+
+	for _, blob := range blobs {
+		name := blob.name
+		report.Scanned++
+		hash, size, err := fs.storedHashAndSize(uid, blob.path)
+		if err != nil {
+			// the keys are not those of a blob, all of them would be quarantined
+			if errors.Is(err, ErrorNoMasterKey) || errors.Is(err, errorKeyring) {
+				return nil, err
+			}
+			if os.IsNotExist(err) {
+				continue
+			}
+			// a damaged compressed stream or a failed integrity check
+			log.Warn("fsck: cannot read blob ", name, ": ", err)
+		} else if fmt.Sprintf("%x", hash) == name || fs.indexHash(uid, blob.path) == name {
+			sizes[name] = size
+			continue
+		} else {
+			log.Warn("fsck: corrupt blob ", name)
+		}
+
+		report.Corrupt = append(report.Corrupt, name)
+		if !report.Repair {
+			continue
+		}
+		err = fs.quarantineBlob(uid, blob)
+		if err != nil {
+			return nil, err
+		}
+		report.Quarantined = append(report.Quarantined, name)
+	}
+	return sizes, nil
+}
+
+// indexHash the hash of the entries of an index blob, empty when it is not one
+func (fs *FileSystemStorage) indexHash(uid, filePath string) string {
+	f, _, err := fs.openStored(uid, filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	hash, err := models.IndexHash(f)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// quarantineBlob moves the blob out of the sync directory, keeping it for inspection
+func (fs *FileSystemStorage) quarantineBlob(uid string, blob blobFile) error {
+	dir := path.Join(fs.getUserPath(uid), quarantineDir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	// the corrupt content must not be linked again
+	if fs.isSharedCopy(blob.info, blob.name) {
+		err = os.Remove(fs.sharedBlobPath(blob.name))
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(blob.path, path.Join(dir, blob.name))
+}
+
+// checkTreeCache compares the cached tree with the root index and rebuilds it on repair
+func (fs *FileSystemStorage) checkTreeCache(uid, rootHash string, gen int64, docs []*models.HashEntry, report *storage.FsckReport) error {
+	cachePath := path.Join(fs.getUserPath(uid), cachedTreeName)
+	// a missing cache is built on the next sync
+	if _, err := os.Stat(cachePath); err != nil {
+		return nil
+	}
+	tree, err := fs.loadTree(uid)
+	report.StaleCache = err != nil || !tree.MatchesRoot(rootHash, docs)
+	if !report.StaleCache || !report.Repair {
+		return nil
+	}
+
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: uid,
+	}
+	tree, err = models.BuildTreeFromRoot(ls, rootHash, gen)
+	if err != nil {
+		// the tree is rebuilt on the next sync once the blobs are back
+		log.Warn("fsck: cannot rebuild the tree of ", uid, ": ", err)
+		fs.trees.Remove(uid)
+		return os.Remove(cachePath)
+	}
+	err = fs.SaveTree(uid, tree)
+	if err != nil {
+		return err
+	}
+	report.CacheRebuilt = true
+	return nil
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// storeTestIndex stores an index blob under the hash of its entries
+func storeTestIndex(t *testing.T, fs *FileSystemStorage, uid, content string) string {
+	hash, err := models.IndexHash(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.StoreBlob(uid, hash, strings.NewReader(content), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCheckBlobs(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	blobPath := fs.getUserBlobPath(testuser)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := storeTestBlob(t, fs, testuser, "page")
+	book := storeTestBlob(t, fs, testuser, "book")
+	missing, _, err := models.Hash(strings.NewReader("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docIndex := storeTestIndex(t, fs, testuser, "3\n"+
+		page+":0:doc.content:0:4\n"+
+		book+":0:doc.epub:0:1\n"+
+		missing+":0:doc.pdf:0:7\n")
+	rootIndex := storeTestIndex(t, fs, testuser, "3\n"+docIndex+":80000000:doc:3:0\n")
+	_, err = fs.StoreBlob(testuser, rootFile, strings.NewReader(rootIndex), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt, _, err := models.Hash(strings.NewReader("original"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptPath := fs.getBlobFilePath(testuser, corrupt)
+	err = os.MkdirAll(path.Dir(corruptPath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(corruptPath, []byte("bit rot"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := path.Join(fs.getUserPath(testuser), cachedTreeName)
+	err = ioutil.WriteFile(cachePath, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy() || report.Documents != 1 || report.Scanned != 5 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.Corrupt) != 1 || report.Corrupt[0] != corrupt {
+		t.Errorf("expected the corrupt blob, got %v", report.Corrupt)
+	}
+	if len(report.Dangling) != 1 || report.Dangling[0] != "doc/doc.pdf "+missing {
+		t.Errorf("expected the missing pdf, got %v", report.Dangling)
+	}
+	if len(report.SizeMismatch) != 1 || !strings.HasPrefix(report.SizeMismatch[0], "doc/doc.epub") {
+		t.Errorf("expected the epub size mismatch, got %v", report.SizeMismatch)
+	}
+	if !report.StaleCache || report.CacheRebuilt || len(report.Quarantined) != 0 {
+		t.Errorf("check only changed something %+v", report)
+	}
+
+	report, err = fs.CheckBlobs(testuser, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Quarantined) != 1 || !report.CacheRebuilt {
+		t.Errorf("not repaired %+v", report)
+	}
+	if _, err = os.Stat(path.Join(fs.getUserPath(testuser), quarantineDir, corrupt)); err != nil {
+		t.Error("corrupt blob not quarantined")
+	}
+
+	report, err = fs.CheckBlobs(testuser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Corrupt) != 0 || report.StaleCache {
+		t.Errorf("repair incomplete %+v", report)
+	}
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Hash != rootIndex || len(tree.Docs) != 1 {
+		t.Errorf("unexpected tree %+v", tree)
+	}
+}
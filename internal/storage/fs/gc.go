@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// blobs younger than this are never collected, a device may have uploaded
+// them and not yet published the root that references them
+const gcGracePeriod = time.Hour
+
+// CollectGarbage removes the blobs which are referenced neither by the current root
+// nor by the last keepRoots roots of the history
+func (fs *FileSystemStorage) CollectGarbage(uid string, keepRoots int, dryRun bool) (*storage.GarbageReport, error) {
+	roots, err := fs.retainedRoots(uid, keepRoots)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := models.Reachable(&LocalBlobStorage{fs: fs, uid: uid}, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := fs.listBlobs(uid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &storage.GarbageReport{UserID: uid, DryRun: dryRun}, nil
+		}
+		return nil, err
+	}
+
+	report := &storage.GarbageReport{
+		UserID:       uid,
+		DryRun:       dryRun,
+		Unreferenced: []string{},
+	}
+	cutoff := time.Now().Add(-gcGracePeriod)
+	for _, blob := range blobs {
+		name := blob.name
+		report.Scanned++
+		if referenced[name] {
+			report.Referenced++
+			continue
+		}
+		if blob.info.ModTime().After(cutoff) {
+			continue
+		}
+
+		report.Unreferenced = append(report.Unreferenced, name)
+		report.ReclaimableBytes += blob.info.Size()
+		if dryRun {
+			continue
+		}
+		err = fs.releaseBlob(blob.path)
+		if err != nil {
+			return report, err
+		}
+		fs.usage.Add(uid, -blob.info.Size())
+	}
+	log.Infof("gc %s: scanned %d, unreferenced %d, %d bytes, dry run: %t",
+		uid, report.Scanned, len(report.Unreferenced), report.ReclaimableBytes, dryRun)
+
+	return report, nil
+}
+
+// retainedRoots the current root hash and the last keepRoots distinct ones from the history
+func (fs *FileSystemStorage) retainedRoots(uid string, keepRoots int) ([]string, error) {
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: uid,
+	}
+	current, _, err := ls.GetRootIndex()
+	if err != nil {
+		return nil, err
+	}
+	history, err := fs.rootLog(uid)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(history))
+	for _, h := range history {
+		hashes = append(hashes, h.Hash)
+	}
+	return models.RetainedRoots(current, hashes, keepRoots), nil
+}
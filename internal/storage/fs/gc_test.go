@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+func storeTestBlob(t *testing.T, fs *FileSystemStorage, uid, content string) string {
+	hash, _, err := models.Hash(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.StoreBlob(uid, hash, strings.NewReader(content), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCollectGarbage(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	blobPath := fs.getUserBlobPath(testuser)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := storeTestBlob(t, fs, testuser, "page")
+	docIndex := storeTestBlob(t, fs, testuser, "3\n"+file+":0:doc.content:0:4\n")
+	rootIndex := storeTestBlob(t, fs, testuser, "3\n"+docIndex+":80000000:doc:1:0\n")
+	_, err = fs.StoreBlob(testuser, rootFile, strings.NewReader(rootIndex), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := storeTestBlob(t, fs, testuser, "orphan")
+	fresh := storeTestBlob(t, fs, testuser, "fresh orphan")
+	old := time.Now().Add(-2 * gcGracePeriod)
+	for _, h := range []string{file, docIndex, rootIndex, orphan} {
+		err = os.Chtimes(fs.getBlobFilePath(testuser, h), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := fs.CollectGarbage(testuser, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unreferenced) != 1 || report.Unreferenced[0] != orphan {
+		t.Fatalf("expected only the orphan, got %v", report.Unreferenced)
+	}
+	if report.ReclaimableBytes != int64(len("orphan")) {
+		t.Errorf("wrong reclaimable size %d", report.ReclaimableBytes)
+	}
+	if _, err = os.Stat(fs.getBlobFilePath(testuser, orphan)); err != nil {
+		t.Error("dry run removed the blob")
+	}
+
+	_, err = fs.CollectGarbage(testuser, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fs.getBlobFilePath(testuser, orphan)); !os.IsNotExist(err) {
+		t.Error("orphan not removed")
+	}
+	for _, h := range []string{file, docIndex, rootIndex, fresh} {
+		if _, err = os.Stat(fs.getBlobFilePath(testuser, h)); err != nil {
+			t.Error("referenced or fresh blob removed ", h)
+		}
+	}
+}
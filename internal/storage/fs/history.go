@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// RootHistory lists the generations of the user's root, oldest first
+func (fs *FileSystemStorage) RootHistory(uid string) ([]storage.RootGeneration, error) {
+	history, err := fs.rootLog(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]storage.RootGeneration, 0, len(history))
+	for _, h := range history {
+		result = append(result, storage.RootGeneration{
+			Generation: h.Generation,
+			Timestamp:  h.Timestamp,
+			Hash:       h.Hash,
+			DeviceID:   h.DeviceID,
+		})
+	}
+	return result, nil
+}
+
+// GetTreeAt rebuilds the tree as it was at the given generation
+func (fs *FileSystemStorage) GetTreeAt(uid string, generation int64) (*models.HashTree, error) {
+	history, err := fs.RootHistory(uid)
+	if err != nil {
+		return nil, err
+	}
+	root, err := storage.FindGeneration(history, generation)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: uid,
+	}
+	return models.BuildTreeFromRoot(ls, root.Hash, root.Generation)
+}
+
+// RestoreRoot publishes the root of an older generation as a new generation,
+// the devices will sync to that state
+func (fs *FileSystemStorage) RestoreRoot(uid string, generation int64) (int64, error) {
+	tree, err := fs.GetTreeAt(uid, generation)
+	if err != nil {
+		return 0, fmt.Errorf("generation %d cannot be restored, %w", generation, err)
+	}
+	// the blobs may have been garbage collected
+	err = tree.MissingFile(func(hash string) bool {
+		_, err := os.Stat(fs.getBlobFilePath(uid, hash))
+		return err == nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("generation %d cannot be restored, %w", generation, err)
+	}
+
+	ls := &LocalBlobStorage{
+		fs:  fs,
+		uid: uid,
+	}
+	_, currentGen, err := ls.GetRootIndex()
+	if err != nil {
+		return 0, err
+	}
+	newGen, err := ls.WriteRootIndex(currentGen, tree.Hash)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("restored %s to generation %d as generation %d", uid, generation, newGen)
+	return newGen, nil
+}
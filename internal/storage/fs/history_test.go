@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+)
+
+func TestRestoreRoot(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var roots []string
+	for i, content := range []string{"first", "second"} {
+		file := storeTestBlob(t, fs, testuser, content)
+		docIndex := storeTestBlob(t, fs, testuser, "3\n"+file+":0:doc.content:0:5\n")
+		rootIndex := storeTestBlob(t, fs, testuser, "3\n"+docIndex+":80000000:doc:1:0\n")
+		_, err = fs.StoreBlob(testuser, rootFile, strings.NewReader(rootIndex), int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, rootIndex)
+	}
+
+	history, err := fs.RootHistory(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Generation != 1 || history[0].Hash != roots[0] {
+		t.Fatalf("unexpected history %v", history)
+	}
+
+	gen, err := fs.RestoreRoot(testuser, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 3 {
+		t.Errorf("expected generation 3, got %d", gen)
+	}
+
+	reader, _, _, err := fs.LoadBlob(testuser, rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	current, _ := ioutil.ReadAll(reader)
+	if string(current) != roots[0] {
+		t.Errorf("root not restored")
+	}
+
+	if _, err = fs.RestoreRoot(testuser, 7); err == nil {
+		t.Error("restored a missing generation")
+	}
+}
+
+func TestMigrateRootHistory(t *testing.T) {
+	testuser := "test"
+	fs := NewStorage(&config.Config{
+		DataDir: t.TempDir(),
+	})
+	blobPath := fs.getUserBlobPath(testuser)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := storeTestBlob(t, fs, testuser, "first")
+	second := storeTestBlob(t, fs, testuser, "second")
+	legacy := "2022-01-01T00:00:00Z " + first + "\n" +
+		"2022-01-02T00:00:00Z " + second + "\n" +
+		"2022-01-03T00:00:00Z 12"
+	err = ioutil.WriteFile(path.Join(blobPath, historyFile), []byte(legacy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(blobPath, rootFile), []byte(second), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, gen, _, err := fs.LoadBlob(testuser, rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if gen != 2 {
+		t.Errorf("expected generation 2, got %d", gen)
+	}
+	if _, err = os.Stat(path.Join(blobPath, historyFile)); !os.IsNotExist(err) {
+		t.Errorf("legacy history not removed: %v", err)
+	}
+
+	// a manual edit does not change the numbering
+	rootLog, err := os.OpenFile(path.Join(blobPath, rootLogFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootLog.WriteString("not an entry\n")
+	rootLog.Close()
+
+	gen, err = fs.StoreRoot(testuser, "device1", strings.NewReader(first), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 3 {
+		t.Errorf("expected generation 3, got %d", gen)
+	}
+	if _, err = fs.StoreRoot(testuser, "device2", strings.NewReader(second), 2); err != ErrorWrongGeneration {
+		t.Errorf("expected a wrong generation, got %v", err)
+	}
+
+	history, err := fs.RootHistory(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Hash != first || history[1].Generation != 2 || history[2].DeviceID != "device1" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+
+	// a legacy history next to the root log is moved away once
+	err = ioutil.WriteFile(path.Join(blobPath, historyFile), []byte(legacy), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err = fs.RootHistory(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Errorf("the stale history changed the log %+v", history)
+	}
+	if _, err = os.Stat(path.Join(blobPath, historyFile)); !os.IsNotExist(err) {
+		t.Errorf("stale history not moved: %v", err)
+	}
+	if _, err = os.Stat(path.Join(blobPath, staleHistoryFile)); err != nil {
+		t.Errorf("stale history not kept: %v", err)
+	}
+}
@@ -0,0 +1,355 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// keyringFile the data keys of the user, wrapped with the master key
+	keyringFile   = ".keys"
+	dataKeyIDSize = 8
+	dataKeySize   = 32
+)
+
+// ErrorNoMasterKey an encrypted file is read without the master key configured
+var ErrorNoMasterKey = errors.New("the file is encrypted and no master key is configured")
+
+// errorKeyring the data keys of the user cannot be read or unwrapped
+var errorKeyring = errors.New("cannot read the data keys")
+
+// wrappedKey a data key sealed with a master key
+type wrappedKey struct {
+	ID string `json:"id"`
+	// Master the id of the master key which wrapped it
+	Master string `json:"master"`
+	Nonce  []byte `json:"nonce"`
+	Key    []byte `json:"key"`
+}
+
+// keyringContent the keyring file, new content is encrypted with the current key
+type keyringContent struct {
+	Current string       `json:"current"`
+	Keys    []wrappedKey `json:"keys"`
+}
+
+// keyring the unwrapped data keys of a user
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// newAEAD the cipher of a key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// masterKeyID identifies a master key without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// encrypts whether new content is encrypted
+func (fs *FileSystemStorage) encrypts() bool {
+	return len(fs.Cfg.EncryptionKey) > 0
+}
+
+// masterKeys the current and the previous master keys by id
+func (fs *FileSystemStorage) masterKeys() map[string][]byte {
+	keys := map[string][]byte{}
+	for _, key := range fs.Cfg.PreviousEncryptionKeys {
+		keys[masterKeyID(key)] = key
+	}
+	if fs.encrypts() {
+		keys[masterKeyID(fs.Cfg.EncryptionKey)] = fs.Cfg.EncryptionKey
+	}
+	return keys
+}
+
+// wrapKey seals the data key with the current master key, bound to the user
+func (fs *FileSystemStorage) wrapKey(uid, id string, key []byte) (*wrappedKey, error) {
+	aead, err := newAEAD(fs.Cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedKey{
+		ID:     id,
+		Master: masterKeyID(fs.Cfg.EncryptionKey),
+		Nonce:  nonce,
+		Key:    aead.Seal(nil, nonce, key, []byte(uid+"/"+id)),
+	}, nil
+}
+
+// unwrapKey opens the data key with the master key which wrapped it
+func (fs *FileSystemStorage) unwrapKey(uid string, wrapped *wrappedKey) ([]byte, error) {
+	master, ok := fs.masterKeys()[wrapped.Master]
+	if !ok {
+		return nil, fmt.Errorf("the master key %s of the data key %s is not configured", wrapped.Master, wrapped.ID)
+	}
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, wrapped.Nonce, wrapped.Key, []byte(uid+"/"+wrapped.ID))
+}
+
+func (fs *FileSystemStorage) readKeyring(uid string) (*keyringContent, error) {
+	content, err := ioutil.ReadFile(fs.getPathFromUser(uid, keyringFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &keyringContent{}, nil
+		}
+		return nil, err
+	}
+	keys := &keyringContent{}
+	err = json.Unmarshal(content, keys)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the keyring of %s, %w", uid, err)
+	}
+	return keys, nil
+}
+
+func (fs *FileSystemStorage) writeKeyring(uid string, keys *keyringContent) error {
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(fs.getPathFromUser(uid, keyringFile), bytes.NewReader(content))
+}
+
+// keyring the unwrapped data keys of the user, loaded once
+func (fs *FileSystemStorage) keyring(uid string) (*keyring, error) {
+	fs.keysMu.Lock()
+	defer fs.keysMu.Unlock()
+	return fs.loadKeyring(uid)
+}
+
+// loadKeyring has to be called with the keys locked
+func (fs *FileSystemStorage) loadKeyring(uid string) (*keyring, error) {
+	if ring, ok := fs.keyrings[uid]; ok {
+		return ring, nil
+	}
+	content, err := fs.readKeyring(uid)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyring{current: content.Current, keys: map[string]cipher.AEAD{}}
+	for i := range content.Keys {
+		key, err := fs.unwrapKey(uid, &content.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[content.Keys[i].ID] = aead
+	}
+	fs.keyrings[uid] = ring
+	return ring, nil
+}
+
+// addDataKey generates a new data key for the user, which encrypts the new
+// content from now on. Has to be called with the keys locked
+func (fs *FileSystemStorage) addDataKey(uid string) error {
+	content, err := fs.readKeyring(uid)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, dataKeyIDSize)
+	key := make([]byte, dataKeySize)
+	_, err = rand.Read(id)
+	if err != nil {
+		return err
+	}
+	_, err = rand.Read(key)
+	if err != nil {
+		return err
+	}
+	wrapped, err := fs.wrapKey(uid, hex.EncodeToString(id), key)
+	if err != nil {
+		return err
+	}
+	content.Keys = append(content.Keys, *wrapped)
+	content.Current = wrapped.ID
+	err = fs.writeKeyring(uid, content)
+	if err != nil {
+		return err
+	}
+	delete(fs.keyrings, uid)
+	log.Info("new data key for ", uid)
+	return nil
+}
+
+// currentDataKey the key which encrypts new content of the user, created on first use
+func (fs *FileSystemStorage) currentDataKey(uid string) (id []byte, aead cipher.AEAD, err error) {
+	fs.keysMu.Lock()
+	defer fs.keysMu.Unlock()
+	ring, err := fs.loadKeyring(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ring.current == "" {
+		err = fs.addDataKey(uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		ring, err = fs.loadKeyring(uid)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	id, err = hex.DecodeString(ring.current)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, ring.keys[ring.current], nil
+}
+
+// dataKey the key of the user with the id, which encrypted a file
+func (fs *FileSystemStorage) dataKey(uid string, id []byte) (cipher.AEAD, error) {
+	if len(fs.masterKeys()) == 0 {
+		return nil, ErrorNoMasterKey
+	}
+	ring, err := fs.keyring(uid)
+	if err != nil {
+		return nil, fmt.Errorf("%w of %s: %v", errorKeyring, uid, err)
+	}
+	aead, ok := ring.keys[hex.EncodeToString(id)]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %x of %s", id, uid)
+	}
+	return aead, nil
+}
+
+// RotateKeys wraps the data keys of the user with the current master key, so
+// that the previous master keys can be dropped. With newDataKey the new
+// content is encrypted with a new data key, EncryptUser re-encrypts the rest
+func (fs *FileSystemStorage) RotateKeys(uid string, newDataKey bool) error {
+	if !fs.encrypts() {
+		return errors.New("no master key configured")
+	}
+	fs.keysMu.Lock()
+	defer fs.keysMu.Unlock()
+	content, err := fs.readKeyring(uid)
+	if err != nil {
+		return err
+	}
+	current := masterKeyID(fs.Cfg.EncryptionKey)
+	for i := range content.Keys {
+		if content.Keys[i].Master == current {
+			continue
+		}
+		key, err := fs.unwrapKey(uid, &content.Keys[i])
+		if err != nil {
+			return err
+		}
+		wrapped, err := fs.wrapKey(uid, content.Keys[i].ID, key)
+		if err != nil {
+			return err
+		}
+		content.Keys[i] = *wrapped
+	}
+	err = fs.writeKeyring(uid, content)
+	if err != nil {
+		return err
+	}
+	delete(fs.keyrings, uid)
+	if newDataKey || content.Current == "" {
+		return fs.addDataKey(uid)
+	}
+	return nil
+}
+
+// isStoredFile whether the file of the user is written through the layers,
+// the root and its log are only hashes and stay as they are
+func isStoredFile(name string) bool {
+	switch name {
+	case rootFile, rootLogFile, rootLockFile, historyFile, keyringFile:
+		return false
+	}
+	return !strings.HasPrefix(name, ".tmp")
+}
+
+// EncryptUser encrypts the files of the user in place with the current data
+// key, the files already encrypted with it are skipped
+func (fs *FileSystemStorage) EncryptUser(uid string) (int, error) {
+	if !fs.encrypts() {
+		return 0, errors.New("no master key configured")
+	}
+	current, _, err := fs.currentDataKey(uid)
+	if err != nil {
+		return 0, err
+	}
+	encrypted := 0
+	err = filepath.Walk(fs.getUserPath(uid), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isStoredFile(info.Name()) {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		header, ok, err := readEncryptedHeader(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if ok && bytes.Equal(header[len(encryptedMagic):len(encryptedMagic)+dataKeyIDSize], current) {
+			return nil
+		}
+		err = fs.encryptFile(uid, p, info)
+		if err != nil {
+			return fmt.Errorf("cannot encrypt %s, %w", p, err)
+		}
+		encrypted++
+		// the link to the shared copy was replaced
+		if strings.HasPrefix(p, fs.getUserBlobPath(uid)) {
+			fs.releaseShared(info.Name())
+		}
+		return nil
+	})
+	return encrypted, err
+}
+
+// encryptFile rewrites the file, keeping its modification time which the
+// trash and the garbage collection rely on
+func (fs *FileSystemStorage) encryptFile(uid, filePath string, info os.FileInfo) error {
+	defer fs.trackUsage(uid, filePath)()
+	reader, _, err := fs.openStored(uid, filePath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	err = fs.writeStored(uid, filePath, reader)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(filePath, info.ModTime(), info.ModTime())
+}
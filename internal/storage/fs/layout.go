@@ -0,0 +1,214 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/common"
+)
+
+const (
+	// layoutFile the version of the layout of the data dir
+	layoutFile = "layout"
+	// layoutFlat all blobs of a user in the sync directory, no version file
+	layoutFlat = 1
+	// layoutSharded the blobs in sync/ab/cd/abcd..., by the prefix of their hash
+	layoutSharded = 2
+	// currentLayout the layout written by this version
+	currentLayout = layoutSharded
+)
+
+// blobFile a blob found in the sync directory
+type blobFile struct {
+	name string
+	path string
+	info os.FileInfo
+}
+
+// loadLayout reads the layout version of the data dir, a data dir without
+// blobs gets the current one
+func (fs *FileSystemStorage) loadLayout() {
+	layoutPath := filepath.Join(fs.Cfg.DataDir, layoutFile)
+	content, err := ioutil.ReadFile(layoutPath)
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			log.Fatalf("%s is not a layout version: %v", layoutPath, err)
+		}
+		if version > currentLayout {
+			log.Fatalf("the data dir has layout %d, this version only knows up to %d", version, currentLayout)
+		}
+		fs.setLayout(version)
+		return
+	}
+	if !os.IsNotExist(err) {
+		log.Fatal("cannot read the layout version: ", err)
+	}
+
+	fs.setLayout(layoutFlat)
+	if fs.hasBlobs() {
+		return
+	}
+	err = fs.saveLayout(currentLayout)
+	if err != nil {
+		log.Warn("cannot save the layout version: ", err)
+	}
+}
+
+func (fs *FileSystemStorage) setLayout(version int) {
+	atomic.StoreInt32(&fs.layout, int32(version))
+}
+
+func (fs *FileSystemStorage) getLayout() int {
+	return int(atomic.LoadInt32(&fs.layout))
+}
+
+func (fs *FileSystemStorage) saveLayout(version int) error {
+	err := writeFile(filepath.Join(fs.Cfg.DataDir, layoutFile), strings.NewReader(strconv.Itoa(version)+"\n"))
+	if err != nil {
+		return err
+	}
+	fs.setLayout(version)
+	return nil
+}
+
+// hasBlobs whether any user has stored a blob
+func (fs *FileSystemStorage) hasBlobs() bool {
+	users, err := ioutil.ReadDir(fs.getUserPath(""))
+	if err != nil {
+		return false
+	}
+	for _, u := range users {
+		entries, err := ioutil.ReadDir(fs.getUserBlobPath(u.Name()))
+		if err == nil && len(entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isSharded whether the blob is kept in a shard, the root and the hidden files
+// (the root log, locks and temp files) stay in the sync directory
+func isSharded(blobid string) bool {
+	return len(blobid) > 4 && blobid != rootFile && !strings.HasPrefix(blobid, ".")
+}
+
+// shardedBlobPath where the blob is stored in the sharded layout
+func (fs *FileSystemStorage) shardedBlobPath(uid, blobid string) string {
+	blobid = common.Sanitize(blobid)
+	if !isSharded(blobid) {
+		return filepath.Join(fs.getUserBlobPath(uid), blobid)
+	}
+	return filepath.Join(fs.getUserBlobPath(uid), blobid[:2], blobid[2:4], blobid)
+}
+
+// getBlobFilePath the path of the blob, blobs which were not migrated yet are
+// found in the sync directory
+func (fs *FileSystemStorage) getBlobFilePath(uid, blobid string) string {
+	sharded := fs.shardedBlobPath(uid, blobid)
+	if fs.getLayout() >= layoutSharded {
+		return sharded
+	}
+	flat := filepath.Join(fs.getUserBlobPath(uid), common.Sanitize(blobid))
+	if _, err := os.Stat(sharded); os.IsNotExist(err) {
+		if _, err = os.Stat(flat); err == nil {
+			return flat
+		}
+	}
+	return sharded
+}
+
+// listBlobs the blobs of the user, in the sync directory and in the shards
+func (fs *FileSystemStorage) listBlobs(uid string) ([]blobFile, error) {
+	blobPath := fs.getUserBlobPath(uid)
+	blobs := []blobFile{}
+	err := filepath.Walk(blobPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// moved by the migration
+			if os.IsNotExist(err) && p != blobPath {
+				return nil
+			}
+			return err
+		}
+		name := info.Name()
+		// the root, root log, locks and temp files
+		if info.IsDir() || name == rootFile || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		blobs = append(blobs, blobFile{name: name, path: p, info: info})
+		return nil
+	})
+	return blobs, err
+}
+
+// MigrateLayout moves the blobs of all users into the current layout, the
+// blobs stay readable while they are moved
+func (fs *FileSystemStorage) MigrateLayout() error {
+	if fs.getLayout() >= currentLayout {
+		return nil
+	}
+	users, err := ioutil.ReadDir(fs.getUserPath(""))
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if !u.IsDir() {
+			continue
+		}
+		moved, err := fs.shardBlobs(u.Name())
+		if err != nil {
+			return fmt.Errorf("cannot migrate the blobs of %s, %w", u.Name(), err)
+		}
+		if moved > 0 {
+			log.Infof("moved %d blobs of %s into shards", moved, u.Name())
+		}
+	}
+	log.Info("data dir migrated to layout ", currentLayout)
+	return fs.saveLayout(currentLayout)
+}
+
+// shardBlobs moves the blobs of the sync directory into their shards
+func (fs *FileSystemStorage) shardBlobs(uid string) (int, error) {
+	blobPath := fs.getUserBlobPath(uid)
+	entries, err := ioutil.ReadDir(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	moved := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isSharded(name) {
+			continue
+		}
+		target := fs.shardedBlobPath(uid, name)
+		err = os.MkdirAll(filepath.Dir(target), 0700)
+		if err != nil {
+			return moved, err
+		}
+		// blobs never change, one stored again meanwhile is the same
+		if _, err = os.Stat(target); err == nil {
+			err = os.Remove(filepath.Join(blobPath, name))
+			if err != nil {
+				return moved, err
+			}
+			fs.usage.Add(uid, -entry.Size())
+			continue
+		}
+		err = os.Rename(filepath.Join(blobPath, name), target)
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	syncDir(blobPath)
+	return moved, nil
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	// a data dir of an older version
+	blobPath := path.Join(cfg.DataDir, userDir, testuser, SyncFolder)
+	err := os.MkdirAll(blobPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _, err := models.Hash(strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(blobPath, hash), []byte("content"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewStorage(cfg)
+	if fs.getLayout() != layoutFlat {
+		t.Fatalf("expected the flat layout, got %d", fs.getLayout())
+	}
+	loadTestBlob(t, fs, testuser, hash, "content")
+
+	err = fs.MigrateLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(blobPath, hash)); !os.IsNotExist(err) {
+		t.Errorf("the blob was not moved: %v", err)
+	}
+	if _, err = os.Stat(path.Join(blobPath, hash[:2], hash[2:4], hash)); err != nil {
+		t.Errorf("the blob is not in its shard: %v", err)
+	}
+	loadTestBlob(t, fs, testuser, hash, "content")
+
+	fs = NewStorage(cfg)
+	if fs.getLayout() != currentLayout {
+		t.Errorf("the layout version was not saved, got %d", fs.getLayout())
+	}
+	loadTestBlob(t, fs, testuser, hash, "content")
+}
+
+func loadTestBlob(t *testing.T, fs *FileSystemStorage, uid, hash, expected string) {
+	t.Helper()
+	reader, _, _, err := fs.LoadBlob(uid, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("unexpected content %s", content)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount the number of hard links of the file
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
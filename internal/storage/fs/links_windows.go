@@ -0,0 +1,12 @@
+//go:build windows
+
+package fs
+
+import (
+	"os"
+)
+
+// linkCount the number of hard links is not known, the shared blobs are kept
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
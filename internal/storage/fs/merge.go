@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// mergeRoot merges a root uploaded on top of an older generation with the
+// current one, when they changed different documents since that generation.
+// The merged root is committed at the next generation, otherwise the
+// current entry is returned with ErrorWrongGeneration. Has to be called
+// with the root locked
+func (fs *FileSystemStorage) mergeRoot(uid, deviceID string, rootLog *os.File, current *rootLogEntry, lastGen int64, rootHash string) (*rootLogEntry, error) {
+	if lastGen <= 0 || current == nil {
+		return current, ErrorWrongGeneration
+	}
+	entries, err := readRootLog(path.Join(fs.getUserBlobPath(uid), rootLogFile))
+	if err != nil {
+		return nil, err
+	}
+	var base *rootLogEntry
+	for i := range entries {
+		if entries[i].Generation == lastGen {
+			base = &entries[i]
+		}
+	}
+	if base == nil {
+		log.Warnf("root of %s not merged, generation %d is not in the log", uid, lastGen)
+		return current, ErrorWrongGeneration
+	}
+
+	notMerged := func(err error) (*rootLogEntry, error) {
+		log.Warnf("root of %s not merged: %v", uid, err)
+		return current, ErrorWrongGeneration
+	}
+	_, baseIndex, err := fs.readIndexSchema(uid, base.Hash)
+	if err != nil {
+		return notMerged(err)
+	}
+	_, ours, err := fs.readIndexSchema(uid, current.Hash)
+	if err != nil {
+		return notMerged(err)
+	}
+	schema, theirs, err := fs.readIndexSchema(uid, rootHash)
+	if err != nil {
+		return notMerged(err)
+	}
+	return fs.commitMerge(uid, deviceID, rootLog, current, base, schema, baseIndex, ours, theirs)
+}
+
+// commitMerge merges the indexes and appends the merged root to the log
+func (fs *FileSystemStorage) commitMerge(uid, deviceID string, rootLog *os.File, current, base *rootLogEntry, schema string, baseIndex, ours, theirs []*models.HashEntry) (*rootLogEntry, error) {
+	merged, conflicts := models.MergeRootIndexes(baseIndex, ours, theirs)
+	if len(conflicts) > 0 {
+		log.Infof("root of %s not merged, %s and generation %d both changed %v since generation %d",
+			uid, deviceName(deviceID), current.Generation, conflicts, base.Generation)
+		return current, ErrorWrongGeneration
+	}
+
+	mergedHash, content, err := models.NewRootIndex(schema, merged)
+	if err != nil {
+		return nil, err
+	}
+	blobPath := fs.getBlobFilePath(uid, mergedHash)
+	trackIndex := fs.trackUsage(uid, blobPath)
+	err = fs.writeBlob(uid, blobPath, mergedHash, bytes.NewReader(content))
+	trackIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := appendRootLog(rootLog, current.Generation, mergedHash, deviceID)
+	if err != nil {
+		return entry, err
+	}
+	log.Infof("merged the root of %s: %s changed generation %d, generation %d is current, merged as generation %d %s",
+		uid, deviceName(deviceID), base.Generation, current.Generation, entry.Generation, mergedHash)
+	return entry, nil
+}
+
+// readIndexSchema the schema and the entries of an index blob
+func (fs *FileSystemStorage) readIndexSchema(uid, hash string) (string, []*models.HashEntry, error) {
+	reader, _, _, err := fs.LoadBlob(uid, hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot load the index %s, %w", hash, err)
+	}
+	defer reader.Close()
+	return models.ParseIndexSchema(reader)
+}
+
+// deviceName the device for the logs
+func deviceName(deviceID string) string {
+	if deviceID == "" {
+		return "the server"
+	}
+	return "device " + deviceID
+}
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// storeTestRoot uploads a root index with the documents, id to hash
+func storeTestRoot(t *testing.T, fs *FileSystemStorage, uid string, lastGen int64, docs map[string]string) (string, int64, error) {
+	t.Helper()
+	entries := []*models.HashEntry{}
+	for id, hash := range docs {
+		entries = append(entries, &models.HashEntry{Hash: hash, Type: "80000000", EntryName: id, Subfiles: 1})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].EntryName < entries[j].EntryName })
+	hash, content, err := models.NewRootIndex(models.SchemaVersionV3, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.StoreBlob(uid, hash, bytes.NewReader(content), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := fs.StoreRoot(uid, "device", strings.NewReader(hash), lastGen)
+	return hash, gen, err
+}
+
+func TestMergeRoots(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:    t.TempDir(),
+		MergeRoots: true,
+	}
+	fs := NewStorage(cfg)
+	a1 := storeTestBlob(t, fs, testuser, "a1")
+	a2 := storeTestBlob(t, fs, testuser, "a2")
+	a3 := storeTestBlob(t, fs, testuser, "a3")
+	b1 := storeTestBlob(t, fs, testuser, "b1")
+
+	_, gen, err := storeTestRoot(t, fs, testuser, 0, map[string]string{"a": a1})
+	if err != nil || gen != 1 {
+		t.Fatalf("first root: %d %v", gen, err)
+	}
+	_, gen, err = storeTestRoot(t, fs, testuser, 1, map[string]string{"a": a1, "b": b1})
+	if err != nil || gen != 2 {
+		t.Fatalf("second root: %d %v", gen, err)
+	}
+
+	// another device changed a on top of generation 1
+	_, gen, err = storeTestRoot(t, fs, testuser, 1, map[string]string{"a": a2})
+	if err != nil {
+		t.Fatal("not merged: ", err)
+	}
+	if gen != 3 {
+		t.Errorf("expected the merged root at generation 3, got %d", gen)
+	}
+	rootHash, err := ioutil.ReadFile(fs.getBlobFilePath(testuser, rootFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, merged, err := fs.readIndexSchema(testuser, string(rootHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 || merged[0].Hash != a2 || merged[1].Hash != b1 {
+		t.Errorf("wrong merged root %v", merged)
+	}
+
+	// a was changed differently since generation 2
+	_, gen, err = storeTestRoot(t, fs, testuser, 2, map[string]string{"a": a3, "b": b1})
+	if err != ErrorWrongGeneration {
+		t.Errorf("a conflict was merged: %v", err)
+	}
+	if gen != 3 {
+		t.Errorf("expected the current generation 3, got %d", gen)
+	}
+
+	cfg.MergeRoots = false
+	_, _, err = storeTestRoot(t, fs, testuser, 1, map[string]string{"a": a1, "c": b1})
+	if err != ErrorWrongGeneration {
+		t.Errorf("merged while disabled: %v", err)
+	}
+}
+
+func TestPublishOnStaleGeneration(t *testing.T) {
+	testuser := "test"
+	fs := NewStorage(&config.Config{
+		DataDir:    t.TempDir(),
+		MergeRoots: true,
+	})
+	err := os.MkdirAll(fs.getUserBlobPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, err := fs.CreateBlobFolder(testuser, "one", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.CreateBlobFolder(testuser, "two", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := tree.Clone()
+
+	// a device published a change since the tree was loaded
+	_, err = fs.CreateBlobFolder(testuser, "three", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.RemoveBlobDocuments(testuser, stale, one.ID)
+	if err != nil {
+		t.Fatal("not merged: ", err)
+	}
+	if stale.Generation != 4 || len(stale.Docs) != 2 {
+		t.Errorf("expected the merged tree at generation 4, got %d with %d docs", stale.Generation, len(stale.Docs))
+	}
+	rootHash, err := ioutil.ReadFile(fs.getBlobFilePath(testuser, rootFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rootHash) != stale.Hash {
+		t.Errorf("the root %s is not the merged one %s", rootHash, stale.Hash)
+	}
+
+	tree, err = fs.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, doc := range tree.Docs {
+		names = append(names, doc.DocumentName)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "three,two" {
+		t.Errorf("wrong documents after the merge %v", names)
+	}
+}
@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
@@ -40,12 +41,7 @@ func (fs *FileSystemStorage) GetAllMetadata(uid string) (result []*messages.RawM
 // GetMetadata loads a document's metadata
 func (fs *FileSystemStorage) GetMetadata(uid, id string) (*messages.RawMetadata, error) {
 	fullPath := fs.getPathFromUser(uid, id+models.MetadataFileExt)
-	f, err := os.Open(fullPath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	content, err := ioutil.ReadAll(f)
+	content, err := fs.readStored(uid, fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -63,12 +59,12 @@ func (fs *FileSystemStorage) GetMetadata(uid, id string) (*messages.RawMetadata,
 // UpdateMetadata updates the metadata of a document
 func (fs *FileSystemStorage) UpdateMetadata(uid string, r *messages.RawMetadata) error {
 	filepath := fs.getPathFromUser(uid, r.ID+models.MetadataFileExt)
+	defer fs.trackUsage(uid, filepath)()
 
 	js, err := json.Marshal(r)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filepath, js, 0600)
-	return err
+	return fs.writeStored(uid, filepath, bytes.NewReader(js))
 
 }
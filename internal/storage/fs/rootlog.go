@@ -0,0 +1,286 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/juju/fslock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rootLogFile the root modification log and the source of the generation,
+	// one json entry per line
+	rootLogFile = ".root.log"
+	// rootLockFile serializes the updates of the root and its log
+	rootLockFile = ".root.lock"
+	// historyFile the legacy log, fixed size lines whose count was the generation
+	historyFile = ".root.history"
+	// staleHistoryFile a legacy log found next to the root log, kept for inspection
+	staleHistoryFile = ".root.history.stale"
+	//time + 1 space + 64 hash + 1 newline
+	historyLineSize = 86
+	// rootLogTail how much of the end of the log is read at first to find the last entry
+	rootLogTail = 4096
+)
+
+// rootLogEntry a published root
+type rootLogEntry struct {
+	Generation int64     `json:"generation"`
+	Timestamp  time.Time `json:"timestamp"`
+	Hash       string    `json:"hash"`
+	// DeviceID the device which uploaded the root, empty when changed by the server
+	DeviceID string `json:"device,omitempty"`
+}
+
+func parseRootLogLine(line []byte) (*rootLogEntry, error) {
+	entry := &rootLogEntry{}
+	err := json.Unmarshal(line, entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Generation <= 0 || entry.Hash == "" {
+		return nil, errors.New("incomplete root log entry")
+	}
+	return entry, nil
+}
+
+// lockRoot locks the root of the user and migrates a legacy history,
+// the returned lock has to be released
+func (fs *FileSystemStorage) lockRoot(uid string) (*fslock.Lock, error) {
+	lock := fslock.New(path.Join(fs.getUserBlobPath(uid), rootLockFile))
+	err := lock.LockWithTimeout(time.Duration(time.Second * 5))
+	if err != nil {
+		log.Error("cannot obtain lock")
+		return nil, err
+	}
+	err = fs.migrateRootHistory(uid)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// rootLog reads the root modification log of the user, oldest entry first
+func (fs *FileSystemStorage) rootLog(uid string) ([]rootLogEntry, error) {
+	lock, err := fs.lockRoot(uid)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	return readRootLog(path.Join(fs.getUserBlobPath(uid), rootLogFile))
+}
+
+// readRootLog reads the root modification log, malformed entries are skipped
+func readRootLog(logPath string) ([]rootLogEntry, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []rootLogEntry{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []rootLogEntry{}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a torn append
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := parseRootLogLine(line)
+		if err != nil {
+			log.Warnf("skipping malformed root log line %q: %v", line, err)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+}
+
+// lastRootLogEntry finds the last valid entry by reading the log backwards,
+// end is where the last complete line ends, anything after it is a torn append
+func lastRootLogEntry(f *os.File, size int64) (last *rootLogEntry, end int64, err error) {
+	end = -1
+	for chunk := int64(rootLogTail); ; chunk *= 2 {
+		start := size - chunk
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, size-start)
+		_, err = f.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		complete := bytes.LastIndexByte(buf, '\n') + 1
+		if end < 0 && (complete > 0 || start == 0) {
+			end = start + int64(complete)
+		}
+		lines := bytes.Split(buf[:complete], []byte("\n"))
+		if start > 0 {
+			// the first line may be cut
+			lines = lines[1:]
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := bytes.TrimSpace(lines[i])
+			if len(line) == 0 {
+				continue
+			}
+			last, err = parseRootLogLine(line)
+			if err == nil {
+				return last, end, nil
+			}
+			log.Warnf("skipping malformed root log line %q: %v", line, err)
+		}
+		if start == 0 {
+			return nil, end, nil
+		}
+	}
+}
+
+// currentRoot the last entry of the log, nil when no root was published
+func (fs *FileSystemStorage) currentRoot(uid string) (*rootLogEntry, error) {
+	f, err := os.Open(path.Join(fs.getUserBlobPath(uid), rootLogFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	last, _, err := lastRootLogEntry(f, fi.Size())
+	return last, err
+}
+
+// appendRootLog commits a new root to the log, a torn append is dropped first
+func appendRootLog(f *os.File, lastGen int64, hash, deviceID string) (*rootLogEntry, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	last, end, err := lastRootLogEntry(f, size)
+	if err != nil {
+		return nil, err
+	}
+	if end < size {
+		log.Warnf("dropping %d bytes of a torn root log line", size-end)
+		err = f.Truncate(end)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	currentGen := int64(0)
+	if last != nil {
+		currentGen = last.Generation
+	}
+	if currentGen != lastGen && currentGen > 0 {
+		log.Warnf("wrong generation, server %d, client %d", currentGen, lastGen)
+		return last, ErrorWrongGeneration
+	}
+
+	entry := &rootLogEntry{
+		Generation: currentGen + 1,
+		Timestamp:  time.Now().UTC(),
+		Hash:       hash,
+		DeviceID:   deviceID,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteAt(append(line, '\n'), end)
+	if err != nil {
+		return nil, err
+	}
+	return entry, f.Sync()
+}
+
+// migrateRootHistory converts the legacy history into the root log, the lines
+// are numbered by where they end, which is the generation the size of the
+// legacy file gave the devices
+func (fs *FileSystemStorage) migrateRootHistory(uid string) error {
+	blobPath := fs.getUserBlobPath(uid)
+	logPath := path.Join(blobPath, rootLogFile)
+	historyPath := path.Join(blobPath, historyFile)
+	content, err := ioutil.ReadFile(historyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err = os.Stat(logPath); err == nil {
+		// written by an older version after the migration, or left by a crash
+		log.Warnf("root log of %s already exists, moving %s to %s", uid, historyFile, staleHistoryFile)
+		return os.Rename(historyPath, path.Join(blobPath, staleHistoryFile))
+	}
+
+	defer fs.trackUsage(uid, historyPath)()
+	defer fs.trackUsage(uid, logPath)()
+
+	var migrated bytes.Buffer
+	count := 0
+	generation := int64(0)
+	offset := 0
+	for {
+		n := bytes.IndexByte(content[offset:], '\n')
+		if n < 0 {
+			break
+		}
+		line := content[offset : offset+n]
+		offset += n + 1
+		gen := int64(offset / historyLineSize)
+		fields := bytes.Fields(line)
+		if len(fields) != 2 || gen <= generation {
+			log.Warnf("skipping malformed root history line: %q", line)
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, string(fields[0]))
+		if err != nil {
+			log.Warn("skipping root history line with bad time: ", err)
+			continue
+		}
+		generation = gen
+		entry, err := json.Marshal(&rootLogEntry{
+			Generation: generation,
+			Timestamp:  timestamp,
+			Hash:       string(fields[1]),
+		})
+		if err != nil {
+			return err
+		}
+		migrated.Write(entry)
+		migrated.WriteByte('\n')
+		count++
+	}
+
+	if count > 0 {
+		err = writeFile(logPath, &migrated)
+		if err != nil {
+			return err
+		}
+		log.Infof("migrated %d root history entries of %s", count, uid)
+	}
+	return os.Remove(historyPath)
+}
@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// blobs never change, they are named by their hash
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	noCacheControl        = "no-store"
+	octetStream           = "application/octet-stream"
+)
+
+// serveContent serves the reader with Range and conditional request support,
+// readers that cannot seek (remote objects) are skipped forward instead. Set
+// the ETag beforehand for If-None-Match and If-Range
+func serveContent(c *gin.Context, name string, reader io.Reader, size int64, modtime time.Time) {
+	content, ok := reader.(io.ReadSeeker)
+	if !ok {
+		if size < 0 {
+			c.DataFromReader(http.StatusOK, size, octetStream, reader, nil)
+			return
+		}
+		content = &forwardSeeker{r: reader, size: size}
+	}
+	// keeps ServeContent from sniffing, which would seek back
+	c.Header("Content-Type", octetStream)
+	http.ServeContent(c.Writer, c.Request, name, modtime, content)
+}
+
+// fileInfo the size and modification time of the reader, when it is a file
+func fileInfo(reader io.Reader) (int64, time.Time) {
+	if decoded, ok := reader.(decodedFile); ok {
+		return decoded.contentInfo()
+	}
+	f, ok := reader.(*os.File)
+	if !ok {
+		return -1, time.Time{}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return -1, time.Time{}
+	}
+	return fi.Size(), fi.ModTime()
+}
+
+// forwardSeeker a stream of known size which seeks forward by skipping,
+// enough for http.ServeContent to serve a range
+type forwardSeeker struct {
+	r    io.Reader
+	size int64
+	// pos the position of the next read, read the bytes consumed
+	pos  int64
+	read int64
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < s.read {
+		return 0, errors.New("cannot seek backwards")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *forwardSeeker) Read(p []byte) (int, error) {
+	if s.pos > s.read {
+		n, err := io.CopyN(ioutil.Discard, s.r, s.pos-s.read)
+		s.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.read += int64(n)
+	s.pos = s.read
+	return n, err
+}
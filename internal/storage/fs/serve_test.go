@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func serveTestBlob(t *testing.T, seekable bool, header http.Header) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/blobstorage", nil)
+	for k, v := range header {
+		c.Request.Header[k] = v
+	}
+	const content = "0123456789"
+	var reader io.Reader = ioutil.NopCloser(strings.NewReader(content))
+	if seekable {
+		reader = strings.NewReader(content)
+	}
+	c.Header("ETag", `"blob"`)
+	serveContent(c, "blob", reader, int64(len(content)), time.Time{})
+	// done by the engine after the handlers
+	c.Writer.WriteHeaderNow()
+	return w
+}
+
+func TestServeContent(t *testing.T) {
+	for _, seekable := range []bool{true, false} {
+		w := serveTestBlob(t, seekable, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t.Errorf("seekable %t: %d %q", seekable, w.Code, w.Body.String())
+		}
+
+		w = serveTestBlob(t, seekable, http.Header{"Range": {"bytes=2-4"}})
+		if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+			t.Errorf("seekable %t: range %d %q", seekable, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Range") != "bytes 2-4/10" {
+			t.Errorf("seekable %t: content range %s", seekable, w.Header().Get("Content-Range"))
+		}
+
+		w = serveTestBlob(t, seekable, http.Header{"If-None-Match": {`"blob"`}})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("seekable %t: if-none-match %d", seekable, w.Code)
+		}
+	}
+}
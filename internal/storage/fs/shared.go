@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/common"
+)
+
+// sharedDir the content store shared by the users, in the data dir. A blob of
+// a user is a hard link to the shared copy, the number of links is the number
+// of users referencing it
+const sharedDir = "blobs"
+
+// sharedBlobPath where the blob is kept in the shared store
+func (fs *FileSystemStorage) sharedBlobPath(blobid string) string {
+	blobid = common.Sanitize(blobid)
+	return filepath.Join(fs.Cfg.DataDir, sharedDir, blobid[:2], blobid[2:4], blobid)
+}
+
+// commitBlob moves a verified blob into place. With the shared store the
+// content is only kept once, a copy already stored by any user is linked
+func (fs *FileSystemStorage) commitBlob(f *atomicFile, id string) error {
+	// the blobs are encrypted with the keys of their user
+	if !fs.Cfg.SharedBlobs || fs.encrypts() || !isSharded(id) {
+		return f.Commit()
+	}
+	target := f.target
+	shared := fs.sharedBlobPath(id)
+	if _, err := os.Stat(shared); err == nil {
+		err = linkBlob(shared, target)
+		// unless the shared copy was released meanwhile, then this one is stored
+		if err == nil || !os.IsNotExist(err) {
+			f.Abort()
+			return err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(shared), 0700)
+	if err != nil {
+		return err
+	}
+	f.target = shared
+	err = f.Commit()
+	if err != nil {
+		return err
+	}
+	return linkBlob(shared, target)
+}
+
+// linkBlob makes the target a link to the shared copy, which is copied when
+// the file system has no hard links
+func linkBlob(shared, target string) error {
+	if fi, err := os.Stat(target); err == nil {
+		if si, err := os.Stat(shared); err == nil && os.SameFile(fi, si) {
+			return nil
+		}
+	}
+	link, err := createAtomic(target)
+	if err != nil {
+		return err
+	}
+	defer link.Abort()
+	// the temp file only reserves the name
+	link.File.Close()
+	os.Remove(link.Name())
+	err = os.Link(shared, link.Name())
+	if err == nil {
+		err = os.Rename(link.Name(), target)
+		if err != nil {
+			os.Remove(link.Name())
+		}
+		return err
+	}
+	if os.IsNotExist(err) {
+		return err
+	}
+	log.Warn("cannot link a shared blob, copying it: ", err)
+
+	r, err := os.Open(shared)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(target, r)
+}
+
+// releaseBlob removes a blob of a user, the shared copy is removed with the last reference
+func (fs *FileSystemStorage) releaseBlob(blobPath string) error {
+	err := os.Remove(blobPath)
+	if err != nil || !fs.Cfg.SharedBlobs {
+		return err
+	}
+	fs.releaseShared(filepath.Base(blobPath))
+	return nil
+}
+
+// releaseShared removes the shared copy when no user references it anymore
+func (fs *FileSystemStorage) releaseShared(blobid string) {
+	if !isSharded(blobid) {
+		return
+	}
+	shared := fs.sharedBlobPath(blobid)
+	fi, err := os.Stat(shared)
+	if err != nil {
+		return
+	}
+	links, ok := linkCount(fi)
+	if !ok || links > 1 {
+		return
+	}
+	err = os.Remove(shared)
+	if err != nil {
+		log.Warn("cannot remove the shared blob: ", err)
+	}
+}
+
+// releaseUserBlobs drops the references of the user to the shared store
+func (fs *FileSystemStorage) releaseUserBlobs(uid string) error {
+	if !fs.Cfg.SharedBlobs {
+		return nil
+	}
+	blobs, err := fs.listBlobs(uid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, blob := range blobs {
+		err = fs.releaseBlob(blob.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSharedCopy whether the file is the shared copy of the blob
+func (fs *FileSystemStorage) isSharedCopy(fi os.FileInfo, blobid string) bool {
+	if !fs.Cfg.SharedBlobs || !isSharded(blobid) {
+		return false
+	}
+	si, err := os.Stat(fs.sharedBlobPath(blobid))
+	return err == nil && os.SameFile(fi, si)
+}
@@ -0,0 +1,69 @@
+package fs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+)
+
+func TestSharedBlobs(t *testing.T) {
+	cfg := &config.Config{
+		DataDir:     t.TempDir(),
+		SharedBlobs: true,
+	}
+	fs := NewStorage(cfg)
+	for _, uid := range []string{"alice", "bob"} {
+		err := os.MkdirAll(fs.getUserBlobPath(uid), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash := storeTestBlob(t, fs, "alice", "same page")
+	storeTestBlob(t, fs, "bob", "same page")
+
+	shared, err := os.Stat(fs.sharedBlobPath(hash))
+	if err != nil {
+		t.Fatal("the blob is not in the shared store: ", err)
+	}
+	for _, uid := range []string{"alice", "bob"} {
+		fi, err := os.Stat(fs.getBlobFilePath(uid, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(shared, fi) {
+			t.Errorf("the blob of %s is not the shared copy", uid)
+		}
+		usage, err := fs.GetUsage(uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage < int64(len("same page")) {
+			t.Errorf("the blob is not accounted to %s, usage %d", uid, usage)
+		}
+	}
+
+	err = fs.RemoveUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fs.sharedBlobPath(hash)); err != nil {
+		t.Fatal("the shared copy was removed while referenced: ", err)
+	}
+	loadTestBlob(t, fs, "bob", hash, "same page")
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	err = os.Chtimes(fs.getBlobFilePath("bob", hash), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.CollectGarbage("bob", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(fs.sharedBlobPath(hash)); !os.IsNotExist(err) {
+		t.Errorf("the unreferenced shared copy was kept: %v", err)
+	}
+}
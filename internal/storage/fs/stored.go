@@ -0,0 +1,255 @@
+package fs
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The blobs, zips and metadata of the users are stored with optional layers:
+// the content is compressed, then encrypted with a data key of the user.
+// Each layer starts with its magic, so files written with any settings stay
+// readable
+
+// storeWriter writes the content of a stored file. Close has to be called
+// before the file is committed
+type storeWriter struct {
+	// f where the content is written, the file or the encryption
+	f   storeTarget
+	enc *encryptWriter
+	z   *gzip.Writer
+	// head the first bytes of an uncompressed content, held back until it is
+	// known whether they look like a magic
+	head    []byte
+	decided bool
+	size    int64
+}
+
+// storeWriter starts the content of a file of the user
+func (fs *FileSystemStorage) storeWriter(uid string, f storeTarget) (*storeWriter, error) {
+	w := &storeWriter{f: f}
+	if fs.encrypts() {
+		id, aead, err := fs.currentDataKey(uid)
+		if err != nil {
+			return nil, err
+		}
+		w.enc, err = newEncryptWriter(f, id, aead)
+		if err != nil {
+			return nil, err
+		}
+		w.f = w.enc
+	}
+	if fs.Cfg.CompressBlobs {
+		return w, w.startCompression()
+	}
+	return w, nil
+}
+
+func (w *storeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	w.size += int64(n)
+	if !w.decided {
+		missing := len(compressedMagic) - len(w.head)
+		if missing > len(p) {
+			missing = len(p)
+		}
+		w.head = append(w.head, p[:missing]...)
+		p = p[missing:]
+		if len(w.head) < len(compressedMagic) {
+			return n, nil
+		}
+		err := w.flushHead()
+		if err != nil {
+			return 0, err
+		}
+	}
+	var err error
+	if w.z != nil {
+		_, err = w.z.Write(p)
+	} else {
+		_, err = w.f.Write(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// flushHead writes the held back bytes, compressed when they look like a magic
+func (w *storeWriter) flushHead() error {
+	w.decided = true
+	if head := string(w.head); head == compressedMagic || head == encryptedMagic {
+		err := w.startCompression()
+		if err != nil {
+			return err
+		}
+		_, err = w.z.Write(w.head)
+		return err
+	}
+	_, err := w.f.Write(w.head)
+	return err
+}
+
+// Close finishes the content
+func (w *storeWriter) Close() error {
+	if !w.decided {
+		err := w.flushHead()
+		if err != nil {
+			return err
+		}
+	}
+	if w.z != nil {
+		err := w.finishCompression()
+		if err != nil {
+			return err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+// storedFile an atomic file written through the layers, the file is not
+// embedded so that its ReadFrom does not bypass them
+type storedFile struct {
+	f *atomicFile
+	w *storeWriter
+}
+
+// createStored starts writing the target of the user, see createAtomic
+func (fs *FileSystemStorage) createStored(uid, target string) (*storedFile, error) {
+	f, err := createAtomic(target)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fs.storeWriter(uid, f)
+	if err != nil {
+		f.Abort()
+		return nil, err
+	}
+	return &storedFile{f: f, w: w}, nil
+}
+
+func (f *storedFile) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// Commit finishes the content and moves it into place
+func (f *storedFile) Commit() error {
+	err := f.w.Close()
+	if err != nil {
+		f.f.Abort()
+		return err
+	}
+	return f.f.Commit()
+}
+
+// Abort discards the file, see atomicFile
+func (f *storedFile) Abort() {
+	f.f.Abort()
+}
+
+// writeStored atomically replaces the file of the user with the content of r
+func (fs *FileSystemStorage) writeStored(uid, filePath string, r io.Reader) error {
+	f, err := fs.createStored(uid, filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// storedReader the content of an open file of the user and its size. An
+// uncompressed and unencrypted file is returned as is, otherwise the content
+// is decoded on the fly and still seekable, for Range requests
+func (fs *FileSystemStorage) storedReader(uid string, f *os.File) (io.ReadSeekCloser, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var content io.ReadSeekCloser = f
+	size := fi.Size()
+	header, encrypted, err := readEncryptedHeader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if encrypted {
+		aead, err := fs.dataKey(uid, header[len(encryptedMagic):len(encryptedMagic)+dataKeyIDSize])
+		if err != nil {
+			return nil, 0, err
+		}
+		decrypted, err := newEncryptedFile(f, fi, header, aead)
+		if err != nil {
+			return nil, 0, err
+		}
+		content = decrypted
+		size = decrypted.size
+	} else {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	compressedSize, compressed, err := readCompressedHeader(content)
+	if err != nil || !compressed {
+		return content, size, err
+	}
+	z, err := gzip.NewReader(content)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &compressedFile{f: content, z: z, size: compressedSize, modtime: fi.ModTime()}, compressedSize, nil
+}
+
+// openStored opens a file of the user, see storedReader
+func (fs *FileSystemStorage) openStored(uid, filePath string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, size, err := fs.storedReader(uid, f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return reader, size, nil
+}
+
+// readStored reads the whole content of a file of the user
+func (fs *FileSystemStorage) readStored(uid, filePath string) ([]byte, error) {
+	reader, _, err := fs.openStored(uid, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// storedHashAndSize the hash and the size of the content of a file of the user
+func (fs *FileSystemStorage) storedHashAndSize(uid, filePath string) ([]byte, int64, error) {
+	reader, _, err := fs.openStored(uid, filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	return hasher.Sum(nil), size, nil
+}
+
+// decodedFile a stored file whose content is not the file itself
+type decodedFile interface {
+	contentInfo() (size int64, modtime time.Time)
+}
@@ -0,0 +1,120 @@
+package fs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// GetTrash the documents in the trash dir, the modification time of the
+// metadata is when the document was trashed
+func (fs *FileSystemStorage) GetTrash(uid string) ([]*storage.TrashedDocument, error) {
+	result := []*storage.TrashedDocument{}
+	trashDir := fs.getPathFromUser(uid, DefaultTrashDir)
+	entries, err := ioutil.ReadDir(trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if path.Ext(entry.Name()) != models.MetadataFileExt {
+			continue
+		}
+		metadata, err := fs.readTrashedMetadata(uid, path.Join(trashDir, entry.Name()))
+		if err != nil {
+			log.Warn("cannot read trashed ", entry.Name(), ": ", err)
+			continue
+		}
+		result = append(result, &storage.TrashedDocument{
+			ID:      strings.TrimSuffix(entry.Name(), models.MetadataFileExt),
+			Name:    metadata.VissibleName,
+			Type:    metadata.Type,
+			Trashed: entry.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+func (fs *FileSystemStorage) readTrashedMetadata(uid, filePath string) (*messages.RawMetadata, error) {
+	content, err := fs.readStored(uid, filePath)
+	if err != nil {
+		return nil, err
+	}
+	metadata := &messages.RawMetadata{}
+	err = json.Unmarshal(content, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// RestoreDocument moves a document from the trash dir back to the root
+func (fs *FileSystemStorage) RestoreDocument(uid, id string) error {
+	trashDir := fs.getPathFromUser(uid, DefaultTrashDir)
+	meta := filepath.Base(id + models.MetadataFileExt)
+	metadata, err := fs.readTrashedMetadata(uid, path.Join(trashDir, meta))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrorNotFound
+		}
+		return err
+	}
+	if _, err = os.Stat(fs.getPathFromUser(uid, meta)); err == nil {
+		return storage.ErrorExists
+	}
+
+	zipfile := filepath.Base(id + models.ZipFileExt)
+	err = os.Rename(path.Join(trashDir, zipfile), fs.getPathFromUser(uid, zipfile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// the former parent may be gone
+	metadata.Parent = ""
+	storage.NextVersion(metadata)
+	err = fs.UpdateMetadata(uid, metadata)
+	if err != nil {
+		return err
+	}
+	trashedMeta := path.Join(trashDir, meta)
+	defer fs.trackUsage(uid, trashedMeta)()
+	return os.Remove(trashedMeta)
+}
+
+// PurgeDocument deletes a document from the trash dir
+func (fs *FileSystemStorage) PurgeDocument(uid, id string) error {
+	trashDir := fs.getPathFromUser(uid, DefaultTrashDir)
+	meta := path.Join(trashDir, filepath.Base(id+models.MetadataFileExt))
+	if _, err := os.Stat(meta); os.IsNotExist(err) {
+		return storage.ErrorNotFound
+	}
+
+	for _, filePath := range []string{
+		path.Join(trashDir, filepath.Base(id+models.ZipFileExt)),
+		meta,
+	} {
+		track := fs.trackUsage(uid, filePath)
+		err := os.Remove(filePath)
+		track()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := fs.removeVersions(uid, id)
+	if err != nil {
+		return err
+	}
+	log.Info("purged ", id)
+	return nil
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+func TestTrash(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := fs.CreateDocument(testuser, "kept.pdf", "", ioutil.NopCloser(strings.NewReader("dummy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := fs.CreateDocument(testuser, "purged.pdf", "", ioutil.NopCloser(strings.NewReader("dummy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, _ := fs.GetUsage(testuser)
+
+	for _, id := range []string{kept.ID, purged.ID} {
+		err = fs.RemoveDocument(testuser, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	trash, err := fs.GetTrash(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 2 || trash[0].Trashed.IsZero() {
+		t.Fatalf("trash %+v", trash)
+	}
+
+	err = fs.RestoreDocument(testuser, kept.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := fs.GetMetadata(testuser, kept.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Version != 2 || metadata.VissibleName != "kept" {
+		t.Errorf("restored %+v", metadata)
+	}
+	if _, err = fs.GetDocument(testuser, kept.ID); err != nil {
+		t.Error("the content is not restored ", err)
+	}
+	if err = fs.RestoreDocument(testuser, kept.ID); err != storage.ErrorNotFound {
+		t.Error("restored twice ", err)
+	}
+
+	err = fs.PurgeDocument(testuser, purged.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trash, _ = fs.GetTrash(testuser)
+	if len(trash) != 0 {
+		t.Errorf("not purged %+v", trash)
+	}
+	if err = fs.PurgeDocument(testuser, kept.ID); err != storage.ErrorNotFound {
+		t.Error("purged a document which is not trashed ", err)
+	}
+	usage, _ := fs.GetUsage(testuser)
+	if usage >= used {
+		t.Errorf("usage %d after purging, was %d", usage, used)
+	}
+}
@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// GetUsage the bytes stored by the user
+func (fs *FileSystemStorage) GetUsage(uid string) (int64, error) {
+	return fs.usage.Get(uid)
+}
+
+// calculateUsage sums the files of the user, except the caches and the profile
+func (fs *FileSystemStorage) calculateUsage(uid string) (int64, error) {
+	var used int64
+	err := filepath.Walk(fs.getUserPath(uid), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == CacheDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != cachedTreeName && info.Name() != profileName && info.Name() != keyringFile {
+			used += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return used, err
+}
+
+func fileSize(filePath string) int64 {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// trackUsage records the size change of the file, call the returned func once it is written
+func (fs *FileSystemStorage) trackUsage(uid, filePath string) func() {
+	before := fileSize(filePath)
+	return func() {
+		fs.usage.Add(uid, fileSize(filePath)-before)
+	}
+}
@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+	"github.com/gin-gonic/gin"
+)
+
+func TestQuota(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir: t.TempDir(),
+	}
+	fs := NewStorage(cfg)
+	user, err := model.NewUser(testuser, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Quota = 100
+	err = fs.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := storage.NewQuota(fs, fs, 0)
+
+	initial, err := fs.GetUsage(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial != 0 {
+		t.Errorf("new user uses %d bytes", initial)
+	}
+
+	storeTestBlob(t, fs, testuser, "60 bytes of content.................................... done")
+	// storing the same blob again does not count twice
+	storeTestBlob(t, fs, testuser, "60 bytes of content.................................... done")
+
+	used, limit, err := quota.Usage(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 60 || limit != 100 {
+		t.Errorf("unexpected usage %d of %d", used, limit)
+	}
+
+	if err = quota.Check(testuser, 100-used); err != nil {
+		t.Errorf("upload that fits rejected: %v", err)
+	}
+	if err = quota.Check(testuser, 101-used); err != storage.ErrorTooLarge {
+		t.Errorf("expected too large, got %v", err)
+	}
+
+	storeTestBlob(t, fs, testuser, string(make([]byte, 100-used)))
+	if err = quota.Check(testuser, -1); err != storage.ErrorQuotaExceeded {
+		t.Errorf("expected quota exceeded, got %v", err)
+	}
+
+	user.Quota = -1
+	err = fs.UpdateUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = quota.Check(testuser, 1000); err != nil {
+		t.Errorf("unlimited user rejected: %v", err)
+	}
+}
+
+// uploadTestBlob uploads the content through the blob route
+func uploadTestBlob(t *testing.T, app *App, uid, blobID, content string) int {
+	t.Helper()
+	exp := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	signature, err := SignURLParams([]string{uid, blobID, exp, "write"}, app.cfg.JWTSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{
+		paramUID:       {uid},
+		paramBlobID:    {blobID},
+		paramExp:       {exp},
+		paramSignature: {signature},
+		paramScope:     {"write"},
+	}
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPut, routeBlob+"?"+query.Encode(), strings.NewReader(content))
+	app.uploadBlob(c)
+	c.Writer.WriteHeaderNow()
+	return w.Code
+}
+
+func TestIndexUploadsIgnoreTheQuota(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:      t.TempDir(),
+		JWTSecretKey: []byte("secret"),
+	}
+	fs := NewStorage(cfg)
+	user, err := model.NewUser(testuser, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Quota = 100
+	err = fs.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{cfg: cfg, blobs: fs, quota: storage.NewQuota(fs, fs, 0)}
+	storeTestBlob(t, fs, testuser, string(make([]byte, 100)))
+
+	content := "a document at the quota"
+	hash, _, err := models.Hash(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := uploadTestBlob(t, app, testuser, hash, content); code != http.StatusInsufficientStorage {
+		t.Errorf("a blob was stored beyond the quota: %d", code)
+	}
+
+	// the root index without the deleted documents
+	rootHash, rootIndex, err := models.NewRootIndex(models.SchemaVersionV4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := uploadTestBlob(t, app, testuser, rootHash, string(rootIndex)); code != http.StatusOK {
+		t.Errorf("the index was rejected: %d", code)
+	}
+	if code := uploadTestBlob(t, app, testuser, rootFile, rootHash); code != http.StatusOK {
+		t.Errorf("the root was rejected: %d", code)
+	}
+}
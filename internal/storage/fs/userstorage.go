@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/zgs225/rmfakecloud/internal/config"
 	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,14 +21,18 @@ const (
 // NewStorage new file system storage
 func NewStorage(cfg *config.Config) *FileSystemStorage {
 	fs := &FileSystemStorage{
-		Cfg: cfg,
+		Cfg:      cfg,
+		keyrings: make(map[string]*keyring),
 	}
+	fs.usage = storage.NewUsageCounter(fs.calculateUsage)
+	fs.trees = storage.NewTreeCache(cfg.TreeCacheSize)
 
 	usersPath := fs.getUserPath("")
 	err := os.MkdirAll(usersPath, 0700)
 	if err != nil {
 		log.Fatal("cannot create the user path " + usersPath)
 	}
+	fs.loadLayout()
 
 	return fs
 }
@@ -43,15 +49,8 @@ func (fs *FileSystemStorage) GetUser(uid string) (user *model.User, err error) {
 		return
 	}
 
-	var f *os.File
-	f, err = os.Open(profilePath)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-
 	var content []byte
-	content, err = ioutil.ReadAll(f)
+	content, err = fs.readStored(uid, profilePath)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read profile: %s, %w", profilePath, err)
 	}
@@ -109,7 +108,14 @@ func (fs *FileSystemStorage) RegisterUser(u *model.User) (err error) {
 		return err
 	}
 	defer f.Close()
-	_, err = f.Write(js)
+	w, err := fs.storeWriter(u.ID, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(js)
+	if err == nil {
+		err = w.Close()
+	}
 	if err != nil {
 		log.Warn("could not write ", profilePath)
 		return err
@@ -137,7 +143,7 @@ func (fs *FileSystemStorage) UpdateUser(u *model.User) (err error) {
 	if err != nil {
 		return
 	}
-	err = ioutil.WriteFile(profilePath, js, 0600)
+	err = fs.writeStored(u.ID, profilePath, bytes.NewReader(js))
 
 	return
 }
@@ -149,11 +155,19 @@ func (fs *FileSystemStorage) RemoveUser(uid string) (err error) {
 		return
 	}
 
+	err = fs.releaseUserBlobs(uid)
+	if err != nil {
+		return
+	}
 	userSyncPath := fs.getUserPath(uid)
 	err = os.RemoveAll(userSyncPath)
 	if err != nil {
 		return
 	}
+	fs.trees.Remove(uid)
+	fs.keysMu.Lock()
+	delete(fs.keyrings, uid)
+	fs.keysMu.Unlock()
 
 	return
 }
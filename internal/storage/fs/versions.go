@@ -0,0 +1,183 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// VersionsDir the previous versions of the sync 1.0 documents, a dir per document
+const VersionsDir = ".versions"
+
+func (fs *FileSystemStorage) getVersionsPath(uid, id string) string {
+	return filepath.Join(fs.getPathFromUser(uid, VersionsDir), sanitizeFileName(id))
+}
+
+// keepVersion links the current content of the document into its versions
+// before it is replaced, with the version of the current metadata
+func (fs *FileSystemStorage) keepVersion(uid, id string) error {
+	if fs.Cfg.DocumentVersions <= 0 {
+		return nil
+	}
+	current := fs.getPathFromUser(uid, id+models.ZipFileExt)
+	if _, err := os.Stat(current); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	version := 0
+	if metadata, err := fs.GetMetadata(uid, id); err == nil {
+		version = metadata.Version
+	}
+
+	dir := fs.getVersionsPath(uid, id)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	versionPath := filepath.Join(dir, storage.VersionID(version, time.Now())+models.ZipFileExt)
+	defer fs.trackUsage(uid, versionPath)()
+	// the content is replaced atomically, the link keeps the previous one
+	err = os.Link(current, versionPath)
+	if err == nil {
+		return nil
+	}
+	log.Warn("cannot link the version of ", id, ", copying it: ", err)
+	r, err := os.Open(current)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(versionPath, r)
+}
+
+// pruneVersions removes the oldest versions of the document beyond the ones kept
+func (fs *FileSystemStorage) pruneVersions(uid, id string) error {
+	versions, err := fs.listVersions(uid, id)
+	if err != nil || len(versions) <= fs.Cfg.DocumentVersions {
+		return err
+	}
+	for _, v := range versions[fs.Cfg.DocumentVersions:] {
+		versionPath := filepath.Join(fs.getVersionsPath(uid, id), v.ID+models.ZipFileExt)
+		track := fs.trackUsage(uid, versionPath)
+		err = os.Remove(versionPath)
+		track()
+		if err != nil {
+			return err
+		}
+		log.Debug("pruned version ", v.ID, " of ", id)
+	}
+	return nil
+}
+
+// removeVersions removes all the versions of a purged document
+func (fs *FileSystemStorage) removeVersions(uid, id string) error {
+	versions, err := fs.listVersions(uid, id)
+	if err != nil {
+		return err
+	}
+	dir := fs.getVersionsPath(uid, id)
+	for _, v := range versions {
+		versionPath := filepath.Join(dir, v.ID+models.ZipFileExt)
+		track := fs.trackUsage(uid, versionPath)
+		err = os.Remove(versionPath)
+		track()
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Remove(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// listVersions the versions of the document, newest first
+func (fs *FileSystemStorage) listVersions(uid, id string) ([]*storage.DocumentVersion, error) {
+	result := []*storage.DocumentVersion{}
+	entries, err := ioutil.ReadDir(fs.getVersionsPath(uid, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		version, err := storage.ParseVersionFile(entry.Name(), entry.Size())
+		if err != nil {
+			log.Warn("unexpected version file ", entry.Name(), " of ", id)
+			continue
+		}
+		result = append(result, version)
+	}
+	storage.SortVersions(result)
+	return result, nil
+}
+
+// GetDocumentVersions the previous versions of the document, newest first
+func (fs *FileSystemStorage) GetDocumentVersions(uid, id string) ([]*storage.DocumentVersion, error) {
+	versions, err := fs.listVersions(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	// the size of the content, not of the stored file
+	for _, v := range versions {
+		reader, size, err := fs.openStored(uid, filepath.Join(fs.getVersionsPath(uid, id), v.ID+models.ZipFileExt))
+		if err != nil {
+			return nil, err
+		}
+		reader.Close()
+		v.Size = size
+	}
+	return versions, nil
+}
+
+// GetDocumentVersion opens a previous version of the document
+func (fs *FileSystemStorage) GetDocumentVersion(uid, id, versionID string) (io.ReadCloser, error) {
+	if _, _, err := storage.ParseVersionID(versionID); err != nil {
+		return nil, storage.ErrorNotFound
+	}
+	reader, _, err := fs.openStored(uid, filepath.Join(fs.getVersionsPath(uid, id), versionID+models.ZipFileExt))
+	if os.IsNotExist(err) {
+		return nil, storage.ErrorNotFound
+	}
+	return reader, err
+}
+
+// RestoreDocumentVersion stores a previous version as the next version of
+// the document, the one it replaces is kept as a version
+func (fs *FileSystemStorage) RestoreDocumentVersion(uid, id, versionID string) (*messages.RawMetadata, error) {
+	metadata, err := fs.GetMetadata(uid, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrorNotFound
+		}
+		return nil, err
+	}
+	reader, err := fs.GetDocumentVersion(uid, id, versionID)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.StoreDocument(uid, id, reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	storage.NextVersion(metadata)
+	err = fs.UpdateMetadata(uid, metadata)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("restored version %s of %s as version %d", versionID, id, metadata.Version)
+	return metadata, nil
+}
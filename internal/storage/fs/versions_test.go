@@ -0,0 +1,117 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+func TestDocumentVersions(t *testing.T) {
+	testuser := "test"
+	cfg := &config.Config{
+		DataDir:          t.TempDir(),
+		DocumentVersions: 2,
+	}
+	fs := NewStorage(cfg)
+	err := os.MkdirAll(fs.getUserPath(testuser), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := fs.CreateDocument(testuser, "doc.pdf", "", ioutil.NopCloser(strings.NewReader("dummy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the devices upload the content, then update the metadata
+	upload := func(content string) {
+		t.Helper()
+		err := fs.StoreDocument(testuser, doc.ID, ioutil.NopCloser(strings.NewReader(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := fs.GetMetadata(testuser, doc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata.Version++
+		err = fs.UpdateMetadata(testuser, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	upload("v2")
+	upload("v3")
+	upload("v4")
+
+	versions, err := fs.GetDocumentVersions(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 3 || versions[1].Version != 2 {
+		t.Fatalf("expected versions 3 and 2, got %+v", versions)
+	}
+	if versions[1].Size != 2 {
+		t.Errorf("wrong size of the version %d", versions[1].Size)
+	}
+	reader, err := fs.GetDocumentVersion(testuser, doc.ID, versions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	if string(content) != "v2" {
+		t.Errorf("wrong content of version 2 %q", content)
+	}
+	if _, err = fs.GetDocumentVersion(testuser, doc.ID, "../"+doc.ID); err != storage.ErrorNotFound {
+		t.Error("not a version ", err)
+	}
+
+	// the oldest version is restored, and pruned
+	metadata, err := fs.RestoreDocumentVersion(testuser, doc.ID, versions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Version != 5 {
+		t.Errorf("restored as version %d", metadata.Version)
+	}
+	reader, err = fs.GetDocument(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	if string(content) != "v2" {
+		t.Errorf("wrong restored content %q", content)
+	}
+	versions, err = fs.GetDocumentVersions(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 4 || versions[1].Version != 3 {
+		t.Fatalf("expected versions 4 and 3, got %+v", versions)
+	}
+
+	used, _ := fs.GetUsage(testuser)
+	err = fs.RemoveDocument(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.PurgeDocument(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, _ = fs.GetDocumentVersions(testuser, doc.ID)
+	if len(versions) != 0 {
+		t.Error("the versions were not purged")
+	}
+	after, _ := fs.GetUsage(testuser)
+	if after > used-4 {
+		t.Errorf("usage not reduced by the versions %d %d", used, after)
+	}
+	if calculated, _ := fs.calculateUsage(testuser); calculated != after {
+		t.Errorf("tracked usage %d differs from the files %d", after, calculated)
+	}
+}
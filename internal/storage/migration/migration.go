@@ -0,0 +1,341 @@
+// Package migration moves the documents of a user between the sync 1.0 and the sync 1.5 storage
+package migration
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// DocumentStorer the sync 1.0 documents
+type DocumentStorer interface {
+	GetAllMetadata(uid string) ([]*messages.RawMetadata, error)
+	UpdateMetadata(uid string, r *messages.RawMetadata) error
+	GetDocument(uid, docid string) (io.ReadCloser, error)
+	StoreDocument(uid, docid string, s io.ReadCloser) error
+}
+
+// BlobStorer the sync 1.5 blobs
+type BlobStorer interface {
+	GetTree(uid string) (*models.HashTree, error)
+	LoadBlob(uid, blobID string) (reader io.ReadCloser, gen int64, size int64, err error)
+	StoreBlob(uid, blobID string, s io.Reader, matchGeneration int64) (int64, error)
+}
+
+const rootBlob = "root"
+
+// ToSync15 converts every sync 1.0 document into blobs and publishes a new root,
+// the documents which are already in the tree are left alone
+func ToSync15(uid string, docs DocumentStorer, blobs BlobStorer) (*storage.MigrationReport, error) {
+	report := &storage.MigrationReport{
+		UserID:  uid,
+		Sync15:  true,
+		Skipped: []string{},
+	}
+
+	tree, err := blobs.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := docs.GetAllMetadata(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, meta := range metadata {
+		if _, err := tree.FindDoc(meta.ID); err == nil {
+			report.Skipped = append(report.Skipped, meta.ID)
+			continue
+		}
+		doc, err := documentToBlobs(uid, meta, tree.SchemaVersion, docs, blobs)
+		if err != nil {
+			log.Warnf("migration: skipping %s (%s), %v", meta.ID, meta.VissibleName, err)
+			report.Skipped = append(report.Skipped, meta.ID)
+			continue
+		}
+		err = tree.Add(doc)
+		if err != nil {
+			return nil, err
+		}
+		report.Migrated++
+	}
+
+	if report.Migrated == 0 {
+		return report, nil
+	}
+
+	rootIndex, err := tree.RootIndex()
+	if err != nil {
+		return nil, err
+	}
+	defer rootIndex.Close()
+	_, err = blobs.StoreBlob(uid, tree.Hash, rootIndex, 0)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := blobs.StoreBlob(uid, rootBlob, strings.NewReader(tree.Hash), tree.Generation)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("migrated %d documents of %s to sync15, generation %d", report.Migrated, uid, gen)
+	return report, nil
+}
+
+// documentToBlobs stores the metadata and every file of the zip as blobs,
+// the document index is written in the schema of the root
+func documentToBlobs(uid string, meta *messages.RawMetadata, schema string, docs DocumentStorer, blobs BlobStorer) (*models.HashDoc, error) {
+	metadataFile := models.MetadataFile{
+		DocumentName:   meta.VissibleName,
+		CollectionType: meta.Type,
+		Parent:         meta.Parent,
+		Version:        meta.Version,
+		LastModified:   toMillis(meta.ModifiedClient),
+		Synced:         true,
+	}
+	doc := models.NewHashDocMeta(meta.ID, metadataFile)
+	doc.SchemaVersion = schema
+
+	jsn, err := json.Marshal(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := storeBlob(uid, meta.ID+models.MetadataFileExt, blobs, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(jsn)), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc.AddFile(entry)
+
+	hasContent := false
+	archive, err := openDocument(uid, meta.ID, docs)
+	switch {
+	case err == nil:
+		defer archive.Close()
+		for _, f := range archive.File {
+			// the metadata is kept outside of the zip
+			if f.FileInfo().IsDir() || strings.HasSuffix(f.Name, models.MetadataFileExt) {
+				continue
+			}
+			entry, err := storeBlob(uid, f.Name, blobs, f.Open)
+			if err != nil {
+				return nil, err
+			}
+			doc.AddFile(entry)
+			hasContent = hasContent || strings.HasSuffix(f.Name, models.ContentFileExt)
+		}
+	case meta.Type == models.CollectionType:
+		// folders usually have no zip
+	default:
+		return nil, fmt.Errorf("cannot read the document, %w", err)
+	}
+
+	if !hasContent {
+		entry, err := storeBlob(uid, meta.ID+models.ContentFileExt, blobs, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("{}")), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		doc.AddFile(entry)
+	}
+
+	index, err := doc.IndexReader()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	_, err = blobs.StoreBlob(uid, doc.Hash, index, 0)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// storeBlob hashes the content and stores it under the hash, open is called twice
+func storeBlob(uid, entryName string, blobs BlobStorer, open func() (io.ReadCloser, error)) (*models.HashEntry, error) {
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	hash, size, err := models.Hash(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	_, err = blobs.StoreBlob(uid, hash, r, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := models.NewFileHashEntry(hash, entryName)
+	entry.Size = size
+	return entry, nil
+}
+
+// zipDocument a zip backed by a temp file
+type zipDocument struct {
+	*zip.Reader
+	file *os.File
+}
+
+func (z *zipDocument) Close() error {
+	defer os.Remove(z.file.Name())
+	return z.file.Close()
+}
+
+// openDocument copies the document to a temp file, a zip needs random access
+func openDocument(uid, id string, docs DocumentStorer) (*zipDocument, error) {
+	reader, err := docs.GetDocument(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tmp, err := ioutil.TempFile("", "migration")
+	if err != nil {
+		return nil, err
+	}
+	doc := &zipDocument{file: tmp}
+	size, err := io.Copy(tmp, reader)
+	if err == nil {
+		doc.Reader, err = zip.NewReader(tmp, size)
+	}
+	if err != nil {
+		doc.Close()
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ToSync10 packs the files of every document of the tree into a zip,
+// the documents which already exist are left alone, the metadata is
+// written with the documents of the user locked
+func ToSync10(uid string, docs DocumentStorer, blobs BlobStorer, locks *storage.DocumentLocks) (*storage.MigrationReport, error) {
+	report := &storage.MigrationReport{
+		UserID:  uid,
+		Skipped: []string{},
+	}
+
+	tree, err := blobs.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := docs.GetAllMetadata(uid)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, meta := range metadata {
+		existing[meta.ID] = true
+	}
+
+	for _, doc := range tree.Docs {
+		if existing[doc.EntryName] || doc.Deleted {
+			report.Skipped = append(report.Skipped, doc.EntryName)
+			continue
+		}
+		userDocs := locks.Lock(uid)
+		err = blobsToDocument(uid, doc, docs, blobs)
+		userDocs.Unlock()
+		if err != nil {
+			log.Warnf("migration: skipping %s (%s), %v", doc.EntryName, doc.DocumentName, err)
+			report.Skipped = append(report.Skipped, doc.EntryName)
+			continue
+		}
+		report.Migrated++
+	}
+	log.Infof("migrated %d documents of %s to sync10", report.Migrated, uid)
+	return report, nil
+}
+
+// blobsToDocument zips the files of the document and writes its metadata
+func blobsToDocument(uid string, doc *models.HashDoc, docs DocumentStorer, blobs BlobStorer) error {
+	tmp, err := ioutil.TempFile("", "migration")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := zip.NewWriter(tmp)
+	for _, f := range doc.Files {
+		if strings.HasSuffix(f.EntryName, models.MetadataFileExt) {
+			continue
+		}
+		err = copyBlob(uid, f, w, blobs)
+		if err != nil {
+			return fmt.Errorf("%s, %w", f.EntryName, err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = docs.StoreDocument(uid, doc.EntryName, ioutil.NopCloser(tmp))
+	if err != nil {
+		return err
+	}
+
+	return docs.UpdateMetadata(uid, &messages.RawMetadata{
+		ID:             doc.EntryName,
+		Version:        doc.Version,
+		ModifiedClient: fromMillis(doc.LastModified),
+		Type:           doc.CollectionType,
+		VissibleName:   doc.DocumentName,
+		Parent:         doc.Parent,
+	})
+}
+
+func copyBlob(uid string, f *models.HashEntry, w *zip.Writer, blobs BlobStorer) error {
+	reader, _, _, err := blobs.LoadBlob(uid, f.Hash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	entry, err := w.Create(f.EntryName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, reader)
+	return err
+}
+
+// toMillis sync15 keeps the modification time as unix milliseconds
+func toMillis(modified string) string {
+	t, err := time.Parse(time.RFC3339Nano, modified)
+	if err != nil {
+		t = time.Now()
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func fromMillis(millis string) string {
+	t := time.Now()
+	if ms, err := strconv.ParseInt(millis, 10, 64); err == nil {
+		t = time.UnixMilli(ms)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
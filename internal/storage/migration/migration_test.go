@@ -0,0 +1,126 @@
+package migration
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+func newTestStorage(t *testing.T, uid string) *fs.FileSystemStorage {
+	s := fs.NewStorage(&config.Config{
+		DataDir: t.TempDir(),
+	})
+	user, err := model.NewUser(uid, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRoundTrip(t *testing.T) {
+	testuser := "test"
+	sync10 := newTestStorage(t, testuser)
+
+	folder := &messages.RawMetadata{
+		ID:           "folder",
+		VissibleName: "Folder",
+		Version:      1,
+		Type:         models.CollectionType,
+	}
+	err := sync10.UpdateMetadata(testuser, folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := sync10.CreateDocument(testuser, "book.pdf", folder.ID, strings.NewReader("pdf content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ToSync15(testuser, sync10, sync10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 {
+		t.Errorf("expected 2 migrated documents, got %d, skipped %v", report.Migrated, report.Skipped)
+	}
+
+	tree, err := sync10.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashDoc, err := tree.FindDoc(doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashDoc.DocumentName != "book" || hashDoc.Parent != folder.ID {
+		t.Errorf("unexpected metadata %+v", hashDoc.MetadataFile)
+	}
+	if len(hashDoc.Files) != 4 {
+		t.Errorf("expected metadata, content, pagedata and pdf, got %d files", len(hashDoc.Files))
+	}
+
+	// a second run has nothing to do
+	report, err = ToSync15(testuser, sync10, sync10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 0 || len(report.Skipped) != 2 {
+		t.Errorf("unexpected second run %+v", report)
+	}
+
+	back := newTestStorage(t, testuser)
+	report, err = ToSync10(testuser, back, sync10, storage.NewDocumentLocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 {
+		t.Errorf("expected 2 migrated documents, got %d", report.Migrated)
+	}
+
+	meta, err := back.GetMetadata(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.VissibleName != "book" || meta.Parent != folder.ID || meta.Type != models.DocumentType {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+
+	reader, err := back.GetDocument(testuser, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range archive.File {
+		if f.Name == doc.ID+models.PdfFileExt {
+			r, _ := f.Open()
+			payload, _ := ioutil.ReadAll(r)
+			r.Close()
+			found = string(payload) == "pdf content"
+		}
+	}
+	if !found {
+		t.Error("the pdf was not migrated")
+	}
+}
@@ -0,0 +1,293 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RmDocFileExt a document archive exported by the reMarkable apps
+	RmDocFileExt = ".rmdoc"
+	// ThumbnailsExt the folder of the page thumbnails
+	ThumbnailsExt = ".thumbnails"
+)
+
+// IsDocumentArchive whether the extension is an archive of a reMarkable document or a page of one
+func IsDocumentArchive(ext string) bool {
+	return ext == ZipFileExt || ext == RmDocFileExt || ext == RmFileExt
+}
+
+// ArchiveFile a file of a document archive, named relative to the document
+type ArchiveFile struct {
+	Name string
+	Size int64
+	Open func() (io.ReadCloser, error)
+}
+
+// DocumentArchive the files of a reMarkable document, as packed by rmapi (.zip)
+// or the reMarkable apps (.rmdoc)
+type DocumentArchive struct {
+	ID string
+	// Metadata is only in .rmdoc archives
+	Metadata *MetadataFile
+	Files    []*ArchiveFile
+}
+
+// ReadDocumentArchive reads the files of a document archive, the id is taken
+// from the .content file, the files of other documents are rejected
+func ReadDocumentArchive(r io.ReaderAt, size int64) (*DocumentArchive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("not a document archive, %w", err)
+	}
+
+	a := &DocumentArchive{}
+	for _, f := range zr.File {
+		if path.Ext(f.Name) == ContentFileExt && !strings.Contains(f.Name, "/") {
+			a.ID = strings.TrimSuffix(f.Name, ContentFileExt)
+		}
+	}
+	if a.ID == "" {
+		return nil, errors.New("not a document archive, no .content")
+	}
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		// older archives have id//page.rm
+		name := path.Clean(f.Name)
+		rest := strings.TrimPrefix(name, a.ID)
+		if rest == name || (!strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "/")) || strings.Contains(rest, "..") {
+			return nil, fmt.Errorf("the archive of %s contains %s", a.ID, f.Name)
+		}
+		if name == a.ID+MetadataFileExt {
+			a.Metadata, err = readArchiveMetadata(f)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		a.Files = append(a.Files, &ArchiveFile{
+			Name: name,
+			Size: int64(f.UncompressedSize64),
+			Open: f.Open,
+		})
+	}
+	return a, nil
+}
+
+func readArchiveMetadata(f *zip.File) (*MetadataFile, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	metadata := &MetadataFile{}
+	err = json.NewDecoder(r).Decode(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the metadata, %w", err)
+	}
+	return metadata, nil
+}
+
+// OpenUploadedArchive reads an uploaded .zip, .rmdoc or .rm, the upload is
+// spooled to a temp file, which is removed by close
+func OpenUploadedArchive(ext string, stream io.Reader) (a *DocumentArchive, close func(), err error) {
+	if ext == RmFileExt {
+		page, err := ioutil.ReadAll(stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		return PageArchive(page), func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		return nil, nil, err
+	}
+	close = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, stream)
+	if err == nil {
+		a, err = ReadDocumentArchive(tmp, size)
+	}
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return a, close, nil
+}
+
+// inMemory a file of an archive built in memory
+func inMemory(name string, content []byte) *ArchiveFile {
+	return &ArchiveFile{
+		Name: name,
+		Size: int64(len(content)),
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		},
+	}
+}
+
+// PageArchive a notebook with a single page, from a .rm file
+func PageArchive(page []byte) *DocumentArchive {
+	id := uuid.NewString()
+	pageID := uuid.NewString()
+	content := map[string]interface{}{}
+	// the template is valid json
+	_ = json.Unmarshal([]byte(CreateContent("notebook")), &content)
+	content["pageCount"] = 1
+	content["pages"] = []string{pageID}
+	contentJSON, _ := json.MarshalIndent(content, "", "    ")
+	pagedata := "Blank\n"
+
+	return &DocumentArchive{
+		ID: id,
+		Files: []*ArchiveFile{
+			inMemory(id+ContentFileExt, contentJSON),
+			inMemory(id+PageFileExt, []byte(pagedata)),
+			inMemory(id+"/"+pageID+RmFileExt, page),
+		},
+	}
+}
+
+// Remap moves the files to a new document id
+func (a *DocumentArchive) Remap(id string) {
+	log.Infof("remapping document %s to %s", a.ID, id)
+	for _, f := range a.Files {
+		f.Name = id + strings.TrimPrefix(f.Name, a.ID)
+	}
+	a.ID = id
+}
+
+// Name the name of the document, from the metadata or the uploaded file
+func (a *DocumentArchive) Name(filename string) string {
+	if a.Metadata != nil && a.Metadata.DocumentName != "" {
+		return a.Metadata.DocumentName
+	}
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
+// HasFile whether the archive has a file with the extension
+func (a *DocumentArchive) HasFile(ext string) bool {
+	for _, f := range a.Files {
+		if f.Name == a.ID+ext {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteZip packs the files into a sync 1.0 zip, which has no metadata
+func (a *DocumentArchive) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, f := range a.Files {
+		entry, err := zw.Create(f.Name)
+		if err != nil {
+			return err
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// MetadataFile the sync 1.5 metadata of the imported document
+func (a *DocumentArchive) MetadataFile(filename, parent string) MetadataFile {
+	metadata := MetadataFile{}
+	if a.Metadata != nil {
+		metadata = *a.Metadata
+	}
+	metadata.DocumentName = a.Name(filename)
+	metadata.CollectionType = DocumentType
+	metadata.Parent = parent
+	metadata.Deleted = false
+	metadata.Synced = true
+	metadata.MetadataModified = true
+	if metadata.Version == 0 {
+		metadata.Version = 1
+	}
+	if metadata.LastModified == "" {
+		metadata.LastModified = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+	return metadata
+}
+
+// HashDoc stores the metadata and the files of the archive as blobs and
+// returns the document of them, to be added to the tree. The document keeps
+// its id unless it is not a uuid or already in the tree
+func (a *DocumentArchive) HashDoc(w BlobWriter, tree *HashTree, filename, parent string) (*HashDoc, error) {
+	_, err := tree.FindDoc(a.ID)
+	exists := err == nil
+	if _, err := uuid.Parse(a.ID); err != nil || exists {
+		a.Remap(uuid.NewString())
+	}
+
+	metadata := a.MetadataFile(filename, parent)
+	jsn, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	hashDoc := NewHashDocMeta(a.ID, metadata)
+	files := append([]*ArchiveFile{inMemory(a.ID+MetadataFileExt, jsn)}, a.Files...)
+	for _, f := range files {
+		fi, err := storeArchiveFile(w, f)
+		if err != nil {
+			return nil, err
+		}
+		err = hashDoc.AddFile(fi)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashDoc, nil
+}
+
+// storeArchiveFile stores a file of an archive under its hash, it is read
+// once to hash it and once to store it
+func storeArchiveFile(w BlobWriter, f *ArchiveFile) (*HashEntry, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	hash, size, err := Hash(r)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+	r, err = f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	err = w.Write(hash, r)
+	if err != nil {
+		return nil, err
+	}
+	fi := NewFileHashEntry(hash, f.Name)
+	fi.Size = size
+	return fi, nil
+}
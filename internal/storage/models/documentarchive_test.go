@@ -0,0 +1,160 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+const testArchiveID = "5bfa5a4e-2b3a-4ba4-b7aa-8f3c0c8e1b9e"
+
+func testArchive(t *testing.T, files map[string]string) *bytes.Reader {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadDocumentArchive(t *testing.T) {
+	r := testArchive(t, map[string]string{
+		testArchiveID + ".content":             "{}",
+		testArchiveID + ".metadata":            `{"visibleName":"Notes","type":"DocumentType"}`,
+		testArchiveID + "//page.rm":            "lines",
+		testArchiveID + ".pagedata":            "Blank\n",
+		testArchiveID + "/":                    "",
+		testArchiveID + ".thumbnails/page.jpg": "jpg",
+	})
+	a, err := ReadDocumentArchive(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != testArchiveID {
+		t.Errorf("id %s", a.ID)
+	}
+	if a.Name("upload.rmdoc") != "Notes" {
+		t.Errorf("name %s", a.Name("upload.rmdoc"))
+	}
+	if len(a.Files) != 4 {
+		t.Fatalf("files %d", len(a.Files))
+	}
+	if !a.HasFile("/page.rm") {
+		t.Error("the page name is not cleaned")
+	}
+
+	a.Remap("other")
+	if a.ID != "other" || !a.HasFile(ContentFileExt) || !a.HasFile("/page.rm") {
+		t.Error("not remapped")
+	}
+}
+
+func TestReadDocumentArchiveRejectsForeignFiles(t *testing.T) {
+	for _, name := range []string{"other.pdf", testArchiveID + "/../escape", testArchiveID + "x.pdf"} {
+		r := testArchive(t, map[string]string{
+			testArchiveID + ".content": "{}",
+			name:                       "",
+		})
+		if _, err := ReadDocumentArchive(r, r.Size()); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+
+	r := testArchive(t, map[string]string{"notes.pdf": ""})
+	if _, err := ReadDocumentArchive(r, r.Size()); err == nil {
+		t.Error("archive without content accepted")
+	}
+}
+
+func TestPageArchive(t *testing.T) {
+	a, closeArchive, err := OpenUploadedArchive(RmFileExt, bytes.NewReader([]byte("lines")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeArchive()
+	if a.Name("sketch.rm") != "sketch" {
+		t.Errorf("name %s", a.Name("sketch.rm"))
+	}
+
+	var buf bytes.Buffer
+	if err = a.WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadDocumentArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.ID != a.ID || len(read.Files) != 3 {
+		t.Fatalf("%s %d", read.ID, len(read.Files))
+	}
+	for _, f := range read.Files {
+		if f.Name == a.Files[2].Name {
+			r, _ := f.Open()
+			page, _ := ioutil.ReadAll(r)
+			if string(page) != "lines" {
+				t.Errorf("page %q", page)
+			}
+			return
+		}
+	}
+	t.Error("the page is missing")
+}
+
+// memoryBlobs stores the blobs in memory
+type memoryBlobs map[string][]byte
+
+func (m memoryBlobs) Write(hash string, r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[hash] = content
+	return nil
+}
+
+func TestArchiveHashDoc(t *testing.T) {
+	r := testArchive(t, map[string]string{
+		testArchiveID + ".content":  "{}",
+		testArchiveID + "/page.rm":  "lines",
+		testArchiveID + ".pagedata": "Blank\n",
+	})
+	a, err := ReadDocumentArchive(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &HashTree{}
+	tree.Docs = append(tree.Docs, NewHashDoc("other", testArchiveID, DocumentType))
+	blobs := memoryBlobs{}
+
+	doc, err := a.HashDoc(blobs, tree, "notes.zip", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the id is taken
+	if doc.EntryName == testArchiveID || doc.EntryName != a.ID {
+		t.Errorf("the document is %s", doc.EntryName)
+	}
+	if doc.DocumentName != "notes" || len(doc.Files) != 4 {
+		t.Errorf("the document %s has %d files", doc.DocumentName, len(doc.Files))
+	}
+	for _, f := range doc.Files {
+		content, ok := blobs[f.Hash]
+		if !ok {
+			t.Errorf("%s is not stored", f.EntryName)
+			continue
+		}
+		hash, size, _ := Hash(bytes.NewReader(content))
+		if hash != f.Hash || size != f.Size {
+			t.Errorf("%s is not stored under its hash", f.EntryName)
+		}
+	}
+}
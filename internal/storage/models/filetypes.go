@@ -3,6 +3,8 @@ package models
 const (
 	DocumentType   = "DocumentType"
 	CollectionType = "CollectionType"
+	//TrashParent the parent of the deleted documents
+	TrashParent = "trash"
 
 	MetadataFileExt = ".metadata"
 	PageFileExt     = ".pagedata"
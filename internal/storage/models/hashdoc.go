@@ -1,7 +1,6 @@
 package models
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
@@ -21,6 +20,8 @@ type HashDoc struct {
 	Files []*HashEntry
 	HashEntry
 	MetadataFile
+	// SchemaVersion the schema of the document index, the one the client used
+	SchemaVersion string `json:",omitempty"`
 }
 
 func NewHashDocMeta(documentID string, meta MetadataFile) *HashDoc {
@@ -46,8 +47,14 @@ func NewHashDoc(name, documentID, colType string) *HashDoc {
 }
 
 func (d *HashDoc) Rehash() error {
-
-	hash, err := HashEntries(d.Files)
+	var hash string
+	var err error
+	if d.SchemaVersion == SchemaVersionV4 {
+		sort.Slice(d.Files, func(i, j int) bool { return d.Files[i].EntryName < d.Files[j].EntryName })
+		hash, err = contentHash(d.writeIndex)
+	} else {
+		hash, err = HashEntries(d.Files)
+	}
 	if err != nil {
 		return err
 	}
@@ -56,6 +63,7 @@ func (d *HashDoc) Rehash() error {
 	return nil
 }
 
+// MetadataReader the metadata blob, the metadata entry is updated to it
 func (d *HashDoc) MetadataReader() (hash string, reader io.Reader, err error) {
 	jsn, err := json.Marshal(d.MetadataFile)
 	if err != nil {
@@ -70,6 +78,7 @@ func (d *HashDoc) MetadataReader() (hash string, reader io.Reader, err error) {
 	for _, f := range d.Files {
 		if strings.HasSuffix(f.EntryName, MetadataFileExt) {
 			f.Hash = hash
+			f.Size = int64(len(jsn))
 			found = true
 			break
 		}
@@ -86,11 +95,20 @@ func (d *HashDoc) AddFile(e *HashEntry) error {
 	return d.Rehash()
 }
 
+// Add adds the document, a new document gets the schema of the tree
 func (t *HashTree) Add(d *HashDoc) error {
 	if len(d.Files) == 0 {
 		return errors.New("no files")
 	}
+	if d.SchemaVersion == "" && t.SchemaVersion != "" {
+		d.SchemaVersion = t.SchemaVersion
+		err := d.Rehash()
+		if err != nil {
+			return err
+		}
+	}
 	t.Docs = append(t.Docs, d)
+	t.index = nil
 	return t.Rehash()
 }
 
@@ -99,20 +117,30 @@ func (d *HashDoc) IndexReader() (io.ReadCloser, error) {
 	if len(d.Files) == 0 {
 		return nil, errors.New("no files")
 	}
-	pipeReader, pipeWriter := io.Pipe()
-	w := bufio.NewWriter(pipeWriter)
-	go func() {
-		defer pipeWriter.Close()
-		w.WriteString(schemaVersion)
-		w.WriteString("\n")
-		for _, d := range d.Files {
-			w.WriteString(d.Line())
-			w.WriteString("\n")
-		}
-		w.Flush()
-	}()
+	var buf bytes.Buffer
+	err := d.writeIndex(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
 
-	return pipeReader, nil
+// writeIndex writes the document index in the schema of the document
+func (d *HashDoc) writeIndex(w io.Writer) error {
+	lines := make([]string, 0, len(d.Files))
+	for _, f := range d.Files {
+		lines = append(lines, f.Line())
+	}
+	return writeIndex(w, d.SchemaVersion, d.EntryName, lines, d.FilesSize())
+}
+
+// FilesSize the total size of the files of the document
+func (d *HashDoc) FilesSize() int64 {
+	var size int64
+	for _, f := range d.Files {
+		size += f.Size
+	}
+	return size
 }
 
 // ReadMetadata the documentname from metadata blob
@@ -144,6 +172,11 @@ func (d *HashDoc) ReadMetadata(fileEntry *HashEntry, r RemoteStorage) error {
 
 // Line index line
 func (d *HashDoc) Line() string {
+	return d.lineFor(SchemaVersionV3)
+}
+
+// lineFor the line in a root index of the schema, only schema 4 has the size
+func (d *HashDoc) lineFor(schema string) string {
 	var sb strings.Builder
 	if d.Hash == "" {
 		log.Print("missing hash for: ", d.EntryName)
@@ -158,7 +191,11 @@ func (d *HashDoc) Line() string {
 	numFilesStr := strconv.Itoa(len(d.Files))
 	sb.WriteString(numFilesStr)
 	sb.WriteRune(delimiter)
-	sb.WriteString("0")
+	if schema == SchemaVersionV4 {
+		sb.WriteString(strconv.FormatInt(d.FilesSize(), 10))
+	} else {
+		sb.WriteString("0")
+	}
 	return sb.String()
 }
 
@@ -170,10 +207,11 @@ func (d *HashDoc) Mirror(e *HashEntry, r RemoteStorage) error {
 		return err
 	}
 	defer entryIndex.Close()
-	entries, err := parseIndex(entryIndex)
+	schema, entries, err := ParseIndexSchema(entryIndex)
 	if err != nil {
 		return err
 	}
+	d.SchemaVersion = schema
 
 	head := make([]*HashEntry, 0)
 	current := make(map[string]*HashEntry)
@@ -192,6 +230,7 @@ func (d *HashDoc) Mirror(e *HashEntry, r RemoteStorage) error {
 					return err
 				}
 				currentEntry.Hash = newEntry.Hash
+				currentEntry.Size = newEntry.Size
 			}
 			head = append(head, currentEntry)
 			current[currentEntry.EntryName] = currentEntry
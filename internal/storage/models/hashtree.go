@@ -2,6 +2,7 @@ package models
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -16,7 +17,17 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const schemaVersion = "3"
+// the index schemas, the hash of a schema 3 index is the hash of its entries,
+// the hash of a schema 4 index is the hash of its content, which starts with
+// a header line with the id, the number of entries and their total size
+const (
+	SchemaVersionV3 = "3"
+	SchemaVersionV4 = "4"
+)
+
+// the id of the root index in the schema 4 header
+const rootIndexID = "."
+
 const docType = "80000000"
 const fileType = "0"
 const delimiter = ':'
@@ -61,6 +72,16 @@ func FileHashAndSize(file string) ([]byte, int64, error) {
 	return h, size, err
 }
 
+// IndexHash the hash of an index blob, which is the hash of its entries
+// and not of its content
+func IndexHash(r io.Reader) (string, error) {
+	entries, err := ParseIndex(r)
+	if err != nil {
+		return "", err
+	}
+	return HashEntries(entries)
+}
+
 // LoadTree loads
 func LoadTree(cacheFile string) (*HashTree, error) {
 	tree := HashTree{}
@@ -130,43 +151,119 @@ func parseEntry(line string) (*HashEntry, error) {
 	return &entry, nil
 }
 
-func parseIndex(f io.Reader) ([]*HashEntry, error) {
-	var entries []*HashEntry
+// ParseIndex reads the entries of an index blob
+func ParseIndex(f io.Reader) ([]*HashEntry, error) {
+	_, entries, err := ParseIndexSchema(f)
+	return entries, err
+}
+
+// ParseIndexSchema reads the schema and the entries of an index blob
+func ParseIndexSchema(f io.Reader) (schema string, entries []*HashEntry, err error) {
 	scanner := bufio.NewScanner(f)
 	scanner.Scan()
-	schema := scanner.Text()
+	schema = scanner.Text()
 
-	if schema != schemaVersion {
-		return nil, errors.New("wrong schema")
+	switch schema {
+	case SchemaVersionV3:
+	case SchemaVersionV4:
+		if !scanner.Scan() {
+			return "", nil, errors.New("missing schema 4 header")
+		}
+		header, err := parseHeader(scanner.Text())
+		if err != nil {
+			return "", nil, err
+		}
+		defer func() {
+			if err == nil && header.Subfiles != len(entries) {
+				log.Warnf("index %s announces %d entries, has %d", header.EntryName, header.Subfiles, len(entries))
+			}
+		}()
+	default:
+		return "", nil, errors.New("wrong schema")
 	}
 	for scanner.Scan() {
 		line := scanner.Text()
 		entry, err := parseEntry(line)
 		if err != nil {
-			return nil, fmt.Errorf("cant parse line '%s', %w", line, err)
+			return "", nil, fmt.Errorf("cant parse line '%s', %w", line, err)
 		}
 
 		entries = append(entries, entry)
 	}
-	return entries, nil
+	return schema, entries, scanner.Err()
+}
+
+// parseHeader reads the schema 4 header, 0:id:entries:size
+func parseHeader(line string) (*HashEntry, error) {
+	fields := NewFieldReader(line).fields
+	if len(fields) != 4 || fields[0] != "0" {
+		return nil, fmt.Errorf("wrong schema 4 header '%s'", line)
+	}
+	header := HashEntry{EntryName: fields[1]}
+	var err error
+	header.Subfiles, err = strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("cannot read entries of header '%s' %v", line, err)
+	}
+	header.Size, err = strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read size of header '%s' %v", line, err)
+	}
+	return &header, nil
+}
+
+// writeIndex writes an index in the schema, lines are the entries in order
+func writeIndex(w io.Writer, schema, id string, lines []string, size int64) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(schemaOrDefault(schema))
+	bw.WriteString("\n")
+	if schema == SchemaVersionV4 {
+		fmt.Fprintf(bw, "0%c%s%c%d%c%d\n", delimiter, id, delimiter, len(lines), delimiter, size)
+	}
+	for _, l := range lines {
+		bw.WriteString(l)
+		bw.WriteString("\n")
+	}
+	return bw.Flush()
+}
+
+// schemaOrDefault the indexes written before the schema was kept are schema 3
+func schemaOrDefault(schema string) string {
+	if schema == "" {
+		return SchemaVersionV3
+	}
+	return schema
+}
+
+// contentHash the hash of an index as it is written
+func contentHash(write func(io.Writer) error) (string, error) {
+	hasher := sha256.New()
+	err := write(hasher)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// writeRootIndex writes the root index in the schema of the tree
+func (t *HashTree) writeRootIndex(w io.Writer) error {
+	lines := make([]string, 0, len(t.Docs))
+	var size int64
+	for _, d := range t.Docs {
+		lines = append(lines, d.lineFor(t.SchemaVersion))
+		size += d.FilesSize()
+	}
+	return writeIndex(w, t.SchemaVersion, rootIndexID, lines, size)
 }
 
 // RootIndex reads the root index
 func (t *HashTree) RootIndex() (io.ReadCloser, error) {
-	pipeReader, pipeWriter := io.Pipe()
-	w := bufio.NewWriter(pipeWriter)
-	go func() {
-		defer pipeWriter.Close()
-		w.WriteString(schemaVersion)
-		w.WriteString("\n")
-		for _, d := range t.Docs {
-			w.WriteString(d.Line())
-			w.WriteString("\n")
-		}
-		w.Flush()
-	}()
-
-	return pipeReader, nil
+	var buf bytes.Buffer
+	err := t.writeRootIndex(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
 }
 
 // HashTree a syncing concept for faster diffing
@@ -174,19 +271,47 @@ type HashTree struct {
 	Hash       string
 	Generation int64
 	Docs       []*HashDoc
+	// SchemaVersion the schema of the root index, the one the client used
+	SchemaVersion string `json:",omitempty"`
+
+	// index the documents by id, built on the first lookup and dropped when the docs change
+	index map[string]*HashDoc
 }
 
 // FindDoc finds a document by its name
 func (t *HashTree) FindDoc(documentID string) (*HashDoc, error) {
-	//O(n)
-	for _, d := range t.Docs {
-		if d.EntryName == documentID {
-			return d, nil
+	if t.index == nil || len(t.index) != len(t.Docs) {
+		t.index = make(map[string]*HashDoc, len(t.Docs))
+		for _, d := range t.Docs {
+			t.index[d.EntryName] = d
 		}
 	}
+	if d, ok := t.index[documentID]; ok {
+		return d, nil
+	}
 	return nil, fmt.Errorf("doc %s not found", documentID)
 }
 
+// Clone a deep copy of the tree, which can be changed without affecting the original
+func (t *HashTree) Clone() *HashTree {
+	clone := &HashTree{
+		Hash:          t.Hash,
+		Generation:    t.Generation,
+		SchemaVersion: t.SchemaVersion,
+		Docs:          make([]*HashDoc, 0, len(t.Docs)),
+	}
+	for _, d := range t.Docs {
+		doc := *d
+		doc.Files = make([]*HashEntry, 0, len(d.Files))
+		for _, f := range d.Files {
+			file := *f
+			doc.Files = append(doc.Files, &file)
+		}
+		clone.Docs = append(clone.Docs, &doc)
+	}
+	return clone
+}
+
 // Remove removes
 func (t *HashTree) Remove(documentID string) error {
 	docIndex := -1
@@ -201,6 +326,7 @@ func (t *HashTree) Remove(documentID string) error {
 		length := len(t.Docs) - 1
 		t.Docs[docIndex] = t.Docs[length]
 		t.Docs = t.Docs[:length]
+		t.index = nil
 
 		t.Rehash()
 		return nil
@@ -210,11 +336,18 @@ func (t *HashTree) Remove(documentID string) error {
 
 // Rehash recalcualte the root hash from all docs
 func (t *HashTree) Rehash() error {
-	entries := []*HashEntry{}
-	for _, e := range t.Docs {
-		entries = append(entries, &e.HashEntry)
+	sort.Slice(t.Docs, func(i, j int) bool { return t.Docs[i].EntryName < t.Docs[j].EntryName })
+	var hash string
+	var err error
+	if t.SchemaVersion == SchemaVersionV4 {
+		hash, err = contentHash(t.writeRootIndex)
+	} else {
+		entries := []*HashEntry{}
+		for _, e := range t.Docs {
+			entries = append(entries, &e.HashEntry)
+		}
+		hash, err = HashEntries(entries)
 	}
-	hash, err := HashEntries(entries)
 	if err != nil {
 		return err
 	}
@@ -232,6 +365,7 @@ func (t *HashTree) Mirror(r RemoteStorage) (changed bool, err error) {
 	if rootHash == "" && gen == 0 {
 		log.Println("Empty cloud")
 		t.Docs = nil
+		t.index = nil
 		t.Generation = 0
 		return
 	}
@@ -251,7 +385,7 @@ func (t *HashTree) Mirror(r RemoteStorage) (changed bool, err error) {
 	}
 	defer rdr.Close()
 
-	entries, err := parseIndex(rdr)
+	schema, entries, err := ParseIndexSchema(rdr)
 	if err != nil {
 		return
 	}
@@ -287,44 +421,63 @@ func (t *HashTree) Mirror(r RemoteStorage) (changed bool, err error) {
 	}
 	sort.Slice(head, func(i, j int) bool { return head[i].EntryName < head[j].EntryName })
 	t.Docs = head
+	t.index = nil
 	t.Generation = gen
 	t.Hash = rootHash
+	t.SchemaVersion = schema
 	return true, nil
 }
 
 // BuildTree from remote storage
 func BuildTree(provider RemoteStorage) (*HashTree, error) {
-	tree := HashTree{}
-
 	rootHash, gen, err := provider.GetRootIndex()
-
 	if err != nil {
 		return nil, err
 	}
-	tree.Hash = rootHash
-	tree.Generation = gen
+	return BuildTreeFromRoot(provider, rootHash, gen)
+}
+
+// BuildTreeFromRoot builds the tree of the given root index, e.g. a historical one
+func BuildTreeFromRoot(provider RemoteStorage, rootHash string, gen int64) (*HashTree, error) {
+	tree := HashTree{
+		Hash:       rootHash,
+		Generation: gen,
+	}
 
 	rootIndex, err := provider.GetReader(rootHash)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("cannot read root index %s, %w", rootHash, err)
 	}
-
 	defer rootIndex.Close()
-	entries, _ := parseIndex(rootIndex)
 
-	for _, e := range entries {
-		f, _ := provider.GetReader(e.Hash)
-		defer f.Close()
+	schema, entries, err := ParseIndexSchema(rootIndex)
+	if err != nil {
+		return nil, err
+	}
+	tree.SchemaVersion = schema
 
+	for _, e := range entries {
 		doc := &HashDoc{}
 		doc.HashEntry = *e
-		tree.Docs = append(tree.Docs, doc)
 
-		items, _ := parseIndex(f)
+		f, err := provider.GetReader(e.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read index of %s, %w", e.EntryName, err)
+		}
+		schema, items, err := ParseIndexSchema(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		doc.SchemaVersion = schema
 		doc.Files = items
 		for _, i := range items {
-			doc.ReadMetadata(i, provider)
+			err = doc.ReadMetadata(i, provider)
+			if err != nil {
+				return nil, err
+			}
 		}
+		tree.Docs = append(tree.Docs, doc)
 	}
 
 	return &tree, nil
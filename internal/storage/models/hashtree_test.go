@@ -0,0 +1,227 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// hand written index samples in the layout of schema 3 (firmware 2.x) and
+// schema 4 (firmware 3.x). They are not captured from tablets: captures hold
+// the ids and the names of someone's documents and none is published with the
+// repository. The hashes of the indexes and of the metadata are real, those of
+// the other files are placeholders, e.g. the sha256 of "foo" and "bar"
+const (
+	rootV3 = "85f3b5d9e9b096c193a17f759edb5bdf72908e3bcae0e50599346b1b77b5da74"
+	docV3  = "ca7fcdae45380a3cd6fad93ac168bc8a0bf71c63a72bf29357c94b1273111219"
+	rootV4 = "a368ed0c287c6791c2965d204f37c79b18f8221552c0a45b3631c569d15663f0"
+	docV4  = "ca20e24041e4da61ecf82fb82f71c46e6be3b961c06835529fd9f9b955931a72"
+	dirV4  = "9ac73322b21457a3abe24147282e0b75464317f24560151fb713c65d1b0f1b2c"
+)
+
+// a redacted capture of a schema 3 document, the index published with the
+// tests of rmapi: the id is replaced, the metadata is rewritten in the
+// layout of firmware 2.x with a placeholder name and the hashes of the
+// metadata, the document and the root are recomputed. The content blob is
+// not needed to build the tree
+const (
+	capturedRootV3 = "baa72105d641328169316fd8b617c2e5a440081cf533dd1b30cd87f319ed7fdf"
+	capturedDocV3  = "66c5df6820c9e04e329912a5abcfc40bbf7266eb19f159a2d2f0f17a4b6617bc"
+)
+
+var sampleBlobs = map[string]string{
+	rootV3: `3
+ca7fcdae45380a3cd6fad93ac168bc8a0bf71c63a72bf29357c94b1273111219:80000000:5a7a4f5e-9c1b-4f0e-8a4f-3f1d2b9c7e11:4:0
+`,
+	docV3: `3
+4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945:0:5a7a4f5e-9c1b-4f0e-8a4f-3f1d2b9c7e11.content:0:1234
+daf51d95e72968bab23a23636a6f05030cb09b49db1d83496bf070f9c7dc2215:0:5a7a4f5e-9c1b-4f0e-8a4f-3f1d2b9c7e11.metadata:0:206
+e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855:0:5a7a4f5e-9c1b-4f0e-8a4f-3f1d2b9c7e11.pagedata:0:0
+a94a8fe5ccb19ba61c4c0873d391e987982fbbd3a47f5d6b42b4c0d8e1c6d0a2:0:5a7a4f5e-9c1b-4f0e-8a4f-3f1d2b9c7e11/0c1a2b3c-4d5e-6f70-8192-a3b4c5d6e7f8.rm:0:48213
+`,
+	rootV4: `4
+0:.:2:248114
+ca20e24041e4da61ecf82fb82f71c46e6be3b961c06835529fd9f9b955931a72:80000000:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10:4:247885
+9ac73322b21457a3abe24147282e0b75464317f24560151fb713c65d1b0f1b2c:80000000:c2f9a1d4-7e3b-4c58-b0a6-5d8e9f1a2b3c:2:229
+`,
+	docV4: `4
+0:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10:4:247885
+2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae:0:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10.content:0:1893
+16c866cd8e6accb4a002727bc75b3c4fcc0451a64f3414c529e44b09547b1207:0:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10.metadata:0:207
+baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096:0:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10.pagedata:0:24
+fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9:0:8d3b0c2e-61f4-4b7a-9a57-0e2c4d6f8a10.pdf:0:245761
+`,
+	dirV4: `4
+0:c2f9a1d4-7e3b-4c58-b0a6-5d8e9f1a2b3c:2:229
+60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752:0:c2f9a1d4-7e3b-4c58-b0a6-5d8e9f1a2b3c.content:0:23
+c3861e367a59c0bc14c89e4ace69608b1637fee3fce3673eb32bebdbef340d38:0:c2f9a1d4-7e3b-4c58-b0a6-5d8e9f1a2b3c.metadata:0:206
+`,
+	capturedRootV3: `3
+66c5df6820c9e04e329912a5abcfc40bbf7266eb19f159a2d2f0f17a4b6617bc:80000000:3e1f7a52-0b6d-4c8e-9f21-7a4d5c6b8e90:2:0
+`,
+	capturedDocV3: `3
+0f83178c4ebe6a60fae0360b74916ee9e1faa5de1c56ab3481eccdc5cb98754f:0:3e1f7a52-0b6d-4c8e-9f21-7a4d5c6b8e90.content:0:993
+1803f3b6a62e12175e18136b0b4958e9f5195ede5cbc0183fde4a23be207a2e4:0:3e1f7a52-0b6d-4c8e-9f21-7a4d5c6b8e90.metadata:0:312
+`,
+	"1803f3b6a62e12175e18136b0b4958e9f5195ede5cbc0183fde4a23be207a2e4": `{
+    "deleted": false,
+    "lastModified": "1641234567890",
+    "lastOpened": "1641234567890",
+    "lastOpenedPage": 0,
+    "metadatamodified": false,
+    "modified": false,
+    "parent": "",
+    "pinned": false,
+    "synced": true,
+    "type": "DocumentType",
+    "version": 2,
+    "visibleName": "Notebook"
+}
+`,
+	"daf51d95e72968bab23a23636a6f05030cb09b49db1d83496bf070f9c7dc2215": `{"visibleName":"Notebook","type":"DocumentType","parent":"","lastModified":"1700000000000","lastOpened":"","version":1,"pinned":false,"synced":true,"modified":false,"deleted":false,"metadatamodified":false}`,
+	"16c866cd8e6accb4a002727bc75b3c4fcc0451a64f3414c529e44b09547b1207": `{"visibleName":"Paper.pdf","type":"DocumentType","parent":"","lastModified":"1700000000000","lastOpened":"","version":1,"pinned":false,"synced":true,"modified":false,"deleted":false,"metadatamodified":false}`,
+	"c3861e367a59c0bc14c89e4ace69608b1637fee3fce3673eb32bebdbef340d38": `{"visibleName":"Folder","type":"CollectionType","parent":"","lastModified":"1700000000000","lastOpened":"","version":1,"pinned":false,"synced":true,"modified":false,"deleted":false,"metadatamodified":false}`,
+}
+
+// sampleStorage serves the samples, with the given root
+type sampleStorage struct {
+	root string
+}
+
+func (s *sampleStorage) GetRootIndex() (string, int64, error) {
+	return s.root, 1, nil
+}
+
+func (s *sampleStorage) GetReader(hash string) (io.ReadCloser, error) {
+	content, ok := sampleBlobs[hash]
+	if !ok {
+		return nil, fmt.Errorf("no blob %s, %w", hash, ErrorNotFound)
+	}
+	return ioutil.NopCloser(strings.NewReader(content)), nil
+}
+
+func readAll(t *testing.T, open func() (io.ReadCloser, error)) string {
+	r, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	for _, sample := range []struct {
+		schema string
+		root   string
+		docs   []string
+	}{
+		{SchemaVersionV3, rootV3, []string{docV3}},
+		{SchemaVersionV3, capturedRootV3, []string{capturedDocV3}},
+		{SchemaVersionV4, rootV4, []string{docV4, dirV4}},
+	} {
+		for _, build := range []string{"build", "mirror"} {
+			var tree *HashTree
+			var err error
+			if build == "build" {
+				tree, err = BuildTree(&sampleStorage{root: sample.root})
+			} else {
+				tree = &HashTree{}
+				_, err = tree.Mirror(&sampleStorage{root: sample.root})
+			}
+			if err != nil {
+				t.Fatalf("%s schema %s: %v", build, sample.schema, err)
+			}
+			if tree.SchemaVersion != sample.schema || len(tree.Docs) != len(sample.docs) {
+				t.Fatalf("%s schema %s: unexpected tree %+v", build, sample.schema, tree)
+			}
+
+			root := readAll(t, tree.RootIndex)
+			if root != sampleBlobs[sample.root] {
+				t.Errorf("%s schema %s: root index changed\n%s", build, sample.schema, root)
+			}
+			for i, doc := range tree.Docs {
+				if doc.SchemaVersion != sample.schema {
+					t.Errorf("%s schema %s: document has schema %s", build, sample.schema, doc.SchemaVersion)
+				}
+				index := readAll(t, doc.IndexReader)
+				if index != sampleBlobs[sample.docs[i]] {
+					t.Errorf("%s schema %s: document index changed\n%s", build, sample.schema, index)
+				}
+				err = doc.Rehash()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if doc.Hash != sample.docs[i] {
+					t.Errorf("%s schema %s: document hash %s, expected %s", build, sample.schema, doc.Hash, sample.docs[i])
+				}
+			}
+			err = tree.Rehash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tree.Hash != sample.root {
+				t.Errorf("%s schema %s: root hash %s, expected %s", build, sample.schema, tree.Hash, sample.root)
+			}
+		}
+	}
+}
+
+func TestAddKeepsSchema(t *testing.T) {
+	tree, err := BuildTree(&sampleStorage{root: rootV4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := NewHashDoc("new", "00000000-new", DocumentType)
+	file := NewFileHashEntry("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "00000000-new.content")
+	file.Size = 10
+	err = doc.AddFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Add(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.SchemaVersion != SchemaVersionV4 {
+		t.Errorf("new document has schema %s", doc.SchemaVersion)
+	}
+
+	root := readAll(t, tree.RootIndex)
+	if !strings.HasPrefix(root, "4\n0:.:3:248124\n") {
+		t.Errorf("wrong header\n%s", root)
+	}
+	schema, entries, err := ParseIndexSchema(strings.NewReader(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema != SchemaVersionV4 || len(entries) != 3 || entries[0].EntryName != doc.EntryName {
+		t.Errorf("unexpected entries %s %v", schema, entries)
+	}
+
+	index := readAll(t, doc.IndexReader)
+	hash, _, err := Hash(bytes.NewReader([]byte(index)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != doc.Hash {
+		t.Errorf("schema 4 document not named by its content hash")
+	}
+}
+
+func TestParseIndexRejectsUnknownSchema(t *testing.T) {
+	_, err := ParseIndex(strings.NewReader("5\n0:.:0:0\n"))
+	if err == nil {
+		t.Error("schema 5 accepted")
+	}
+	_, err = ParseIndex(strings.NewReader("4\nnot a header\n"))
+	if err == nil {
+		t.Error("broken schema 4 header accepted")
+	}
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MergeRootIndexes merges the entries of two root indexes which both changed
+// the base. A document changed on one side only takes that change, one
+// changed the same way on both sides is not a conflict. The conflicts are the
+// ids of the documents changed differently, nothing is merged then
+func MergeRootIndexes(base, ours, theirs []*HashEntry) (merged []*HashEntry, conflicts []string) {
+	baseDocs := entriesByName(base)
+	ourDocs := entriesByName(ours)
+	theirDocs := entriesByName(theirs)
+
+	ourChanges := changedEntries(baseDocs, ourDocs)
+	theirChanges := changedEntries(baseDocs, theirDocs)
+	for id := range ourChanges {
+		if _, changed := theirChanges[id]; !changed {
+			continue
+		}
+		if !sameEntry(ourDocs[id], theirDocs[id]) {
+			conflicts = append(conflicts, id)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, conflicts
+	}
+
+	result := theirDocs
+	for id := range ourChanges {
+		if e, ok := ourDocs[id]; ok {
+			result[id] = e
+		} else {
+			delete(result, id)
+		}
+	}
+	merged = make([]*HashEntry, 0, len(result))
+	for _, e := range result {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].EntryName < merged[j].EntryName })
+	return merged, nil
+}
+
+func entriesByName(entries []*HashEntry) map[string]*HashEntry {
+	byName := make(map[string]*HashEntry, len(entries))
+	for _, e := range entries {
+		byName[e.EntryName] = e
+	}
+	return byName
+}
+
+// changedEntries the names of the entries added, removed or changed since the base
+func changedEntries(base, changed map[string]*HashEntry) map[string]struct{} {
+	changes := map[string]struct{}{}
+	for id, e := range changed {
+		if !sameEntry(base[id], e) {
+			changes[id] = struct{}{}
+		}
+	}
+	for id := range base {
+		if _, ok := changed[id]; !ok {
+			changes[id] = struct{}{}
+		}
+	}
+	return changes
+}
+
+// sameEntry whether both are missing or have the same hash
+func sameEntry(a, b *HashEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash
+}
+
+// NewRootIndex writes a root index with the entries in the schema, the hash
+// is how the blob of the index is named
+func NewRootIndex(schema string, entries []*HashEntry) (hash string, content []byte, err error) {
+	lines := make([]string, 0, len(entries))
+	var size int64
+	for _, e := range entries {
+		lines = append(lines, indexLine(e))
+		size += e.Size
+	}
+	var buf bytes.Buffer
+	err = writeIndex(&buf, schema, rootIndexID, lines, size)
+	if err != nil {
+		return "", nil, err
+	}
+	if schemaOrDefault(schema) == SchemaVersionV3 {
+		hash, err = HashEntries(entries)
+	} else {
+		hash, _, err = Hash(bytes.NewReader(buf.Bytes()))
+	}
+	return hash, buf.Bytes(), err
+}
+
+// indexLine the line of the entry as it was parsed
+func indexLine(e *HashEntry) string {
+	return strings.Join([]string{
+		e.Hash,
+		e.Type,
+		e.EntryName,
+		strconv.Itoa(e.Subfiles),
+		strconv.FormatInt(e.Size, 10),
+	}, string(delimiter))
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewRootIndex(t *testing.T) {
+	for _, root := range []string{rootV3, capturedRootV3, rootV4} {
+		schema, entries, err := ParseIndexSchema(strings.NewReader(sampleBlobs[root]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, content, err := NewRootIndex(schema, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != root {
+			t.Errorf("schema %s: expected the hash %s, got %s", schema, root, hash)
+		}
+		_, parsed, err := ParseIndexSchema(strings.NewReader(string(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, entries) {
+			t.Errorf("schema %s: the entries changed", schema)
+		}
+	}
+}
+
+func rootEntries(docs ...string) []*HashEntry {
+	entries := []*HashEntry{}
+	for _, d := range docs {
+		id, hash := d[:1], d[2:]
+		entries = append(entries, &HashEntry{Hash: hash, Type: docType, EntryName: id, Subfiles: 1})
+	}
+	return entries
+}
+
+func entryNames(entries []*HashEntry) string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.EntryName+"="+e.Hash)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestMergeRootIndexes(t *testing.T) {
+	base := rootEntries("a=1", "b=1", "c=1")
+	for _, tc := range []struct {
+		name      string
+		ours      []*HashEntry
+		theirs    []*HashEntry
+		merged    string
+		conflicts []string
+	}{
+		{"disjoint changes", rootEntries("a=2", "b=1", "c=1"), rootEntries("a=1", "b=2", "c=1"), "a=2 b=2 c=1", nil},
+		{"added and removed", rootEntries("a=1", "b=1", "c=1", "d=1"), rootEntries("a=1", "b=1"), "a=1 b=1 d=1", nil},
+		{"same change", rootEntries("a=2", "b=1", "c=1"), rootEntries("a=2", "b=1"), "a=2 b=1", nil},
+		{"both removed", rootEntries("a=1", "b=1"), rootEntries("a=1", "b=1"), "a=1 b=1", nil},
+		{"different changes", rootEntries("a=2", "b=2", "c=1"), rootEntries("a=3", "b=2", "c=1"), "", []string{"a"}},
+		{"changed and removed", rootEntries("a=1", "b=1", "c=2"), rootEntries("a=1", "b=1"), "", []string{"c"}},
+	} {
+		merged, conflicts := MergeRootIndexes(base, tc.ours, tc.theirs)
+		if !reflect.DeepEqual(conflicts, tc.conflicts) {
+			t.Errorf("%s: expected the conflicts %v, got %v", tc.name, tc.conflicts, conflicts)
+			continue
+		}
+		if entryNames(merged) != tc.merged {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.merged, entryNames(merged))
+		}
+	}
+}
@@ -15,3 +15,8 @@ type RemoteStorageWriter interface {
 	WriteRootIndex(hash string, generation int64) (gen int64, err error)
 	Write(hash string, reader io.Reader) error
 }
+
+// BlobWriter stores blobs by their hash
+type BlobWriter interface {
+	Write(hash string, reader io.Reader) error
+}
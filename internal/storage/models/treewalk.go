@@ -0,0 +1,184 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorNotFound a blob is missing, the storages return it for missing blobs
+var ErrorNotFound = errors.New("not found")
+
+// maxRootSize a hash and some whitespace
+const maxRootSize = 1024
+
+// ReadRootHash reads the hash of a root uploaded by a device
+func ReadRootHash(r io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, maxRootSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(content) > maxRootSize {
+		return "", errors.New("the root is too large")
+	}
+	rootHash := strings.TrimSpace(string(content))
+	if rootHash == "" || strings.ContainsAny(rootHash, " \t\r\n") {
+		return "", errors.New("invalid root hash: " + rootHash)
+	}
+	return rootHash, nil
+}
+
+// ReadIndex parses an index blob, a missing blob has no entries
+func ReadIndex(r RemoteStorage, hash string) ([]*HashEntry, error) {
+	reader, err := r.GetReader(hash)
+	if errors.Is(err, ErrorNotFound) {
+		log.Warn("missing index blob ", hash)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ParseIndex(reader)
+}
+
+// RetainedRoots the current root hash and the last keep distinct ones of the
+// history, which is oldest first
+func RetainedRoots(current string, history []string, keep int) []string {
+	roots := []string{}
+	seen := make(map[string]bool)
+	if current != "" {
+		roots = append(roots, current)
+		seen[current] = true
+	}
+	for i := len(history) - 1; i >= 0 && keep > 0; i-- {
+		hash := history[i]
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		roots = append(roots, hash)
+		keep--
+	}
+	return roots
+}
+
+// Reachable the blobs of the roots, their document indexes and their files.
+// Missing blobs are skipped (nothing they reference can be found anyway),
+// but an unreadable index aborts, as its files would otherwise be swept
+func Reachable(r RemoteStorage, roots []string) (map[string]bool, error) {
+	marked := make(map[string]bool)
+	for _, rootHash := range roots {
+		err := markReachable(r, rootHash, marked)
+		if err != nil {
+			return nil, fmt.Errorf("cannot walk root %s, %w", rootHash, err)
+		}
+	}
+	return marked, nil
+}
+
+// markReachable marks the root index, the document indexes and their files
+func markReachable(r RemoteStorage, rootHash string, marked map[string]bool) error {
+	docs, err := ReadIndex(r, rootHash)
+	if err != nil {
+		return err
+	}
+	marked[rootHash] = true
+
+	for _, doc := range docs {
+		marked[doc.Hash] = true
+		files, err := ReadIndex(r, doc.Hash)
+		if err != nil {
+			return fmt.Errorf("document %s, %w", doc.EntryName, err)
+		}
+		for _, f := range files {
+			marked[f.Hash] = true
+		}
+	}
+	return nil
+}
+
+// IndexCheck the problems found in the indexes of a root
+type IndexCheck struct {
+	// Docs the entries of the root index
+	Docs         []*HashEntry
+	Documents    int
+	Dangling     []string
+	SizeMismatch []string
+	Unparsable   []string
+}
+
+// CheckIndexes checks that the root and the document indexes only reference
+// blobs of sizes, the intact blobs, and of the right size
+func CheckIndexes(r RemoteStorage, rootHash string, sizes map[string]int64) *IndexCheck {
+	check := &IndexCheck{}
+	check.Docs = check.index(r, "root", rootHash, sizes)
+	for _, doc := range check.Docs {
+		check.Documents++
+		files := check.index(r, doc.EntryName, doc.Hash, sizes)
+		for _, f := range files {
+			name := doc.EntryName + "/" + f.EntryName
+			size, ok := sizes[f.Hash]
+			if !ok {
+				check.Dangling = append(check.Dangling, name+" "+f.Hash)
+			} else if size != f.Size {
+				check.SizeMismatch = append(check.SizeMismatch, fmt.Sprintf("%s %d != %d", name, f.Size, size))
+			}
+		}
+	}
+	return check
+}
+
+// index parses an index blob, reporting it when it is missing or unreadable
+func (c *IndexCheck) index(r RemoteStorage, name, hash string, sizes map[string]int64) []*HashEntry {
+	if _, ok := sizes[hash]; !ok {
+		c.Dangling = append(c.Dangling, name+" "+hash)
+		return nil
+	}
+	reader, err := r.GetReader(hash)
+	if err != nil {
+		c.Unparsable = append(c.Unparsable, fmt.Sprintf("%s %s: %v", name, hash, err))
+		return nil
+	}
+	defer reader.Close()
+	entries, err := ParseIndex(reader)
+	if err != nil {
+		c.Unparsable = append(c.Unparsable, fmt.Sprintf("%s %s: %v", name, hash, err))
+		return nil
+	}
+	return entries
+}
+
+// MatchesRoot whether the tree has the root hash and the documents of the root index
+func (t *HashTree) MatchesRoot(rootHash string, docs []*HashEntry) bool {
+	if t.Hash != rootHash || len(t.Docs) != len(docs) {
+		return false
+	}
+	hashes := make(map[string]string, len(docs))
+	for _, d := range docs {
+		hashes[d.EntryName] = d.Hash
+	}
+	for _, d := range t.Docs {
+		if hashes[d.EntryName] != d.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// MissingFile the first file of the tree whose blob does not exist, e.g.
+// garbage collected since, the tree cannot be restored without it
+func (t *HashTree) MissingFile(exists func(hash string) bool) error {
+	for _, doc := range t.Docs {
+		for _, f := range doc.Files {
+			if !exists(f.Hash) {
+				return fmt.Errorf("%s of %s is missing", f.EntryName, doc.EntryName)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRetainedRoots(t *testing.T) {
+	history := []string{"a", "b", "c", "b"}
+	if roots := RetainedRoots("c", history, 1); !reflect.DeepEqual(roots, []string{"c", "b"}) {
+		t.Errorf("unexpected roots %v", roots)
+	}
+	if roots := RetainedRoots("c", history, 5); !reflect.DeepEqual(roots, []string{"c", "b", "a"}) {
+		t.Errorf("unexpected roots %v", roots)
+	}
+	if roots := RetainedRoots("", nil, 5); len(roots) != 0 {
+		t.Errorf("unexpected roots %v", roots)
+	}
+}
+
+func TestReachable(t *testing.T) {
+	// a missing root references nothing
+	marked, err := Reachable(&sampleStorage{}, []string{rootV4, "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{
+		rootV4, docV4, dirV4,
+		"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9",
+		"c3861e367a59c0bc14c89e4ace69608b1637fee3fce3673eb32bebdbef340d38",
+	} {
+		if !marked[hash] {
+			t.Errorf("%s is not reachable", hash)
+		}
+	}
+	if marked[rootV3] || marked[docV3] {
+		t.Error("the blobs of another root are reachable")
+	}
+}
+
+func TestCheckIndexes(t *testing.T) {
+	sizes := map[string]int64{
+		rootV4: 1,
+		docV4:  1,
+		// the content is intact, the metadata has another size and the
+		// pdf and the folder are missing
+		"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": 1893,
+		"16c866cd8e6accb4a002727bc75b3c4fcc0451a64f3414c529e44b09547b1207": 10,
+		"baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096": 24,
+	}
+	check := CheckIndexes(&sampleStorage{}, rootV4, sizes)
+	if check.Documents != 2 || len(check.Docs) != 2 {
+		t.Errorf("%d documents", check.Documents)
+	}
+	dangling := strings.Join(check.Dangling, "\n")
+	if len(check.Dangling) != 2 || !strings.Contains(dangling, dirV4) || !strings.Contains(dangling, ".pdf") {
+		t.Errorf("unexpected dangling %v", check.Dangling)
+	}
+	if len(check.SizeMismatch) != 1 || !strings.Contains(check.SizeMismatch[0], ".metadata 207 != 10") {
+		t.Errorf("unexpected size mismatches %v", check.SizeMismatch)
+	}
+	if len(check.Unparsable) != 0 {
+		t.Errorf("unexpected unparsable %v", check.Unparsable)
+	}
+
+	tree, err := BuildTreeFromRoot(&sampleStorage{}, rootV4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tree.MatchesRoot(rootV4, check.Docs) || tree.MatchesRoot(rootV3, check.Docs) {
+		t.Error("the tree does not match its root")
+	}
+	err = tree.MissingFile(func(hash string) bool {
+		_, ok := sizes[hash]
+		return ok
+	})
+	if err == nil {
+		t.Error("the missing pdf is not found")
+	}
+}
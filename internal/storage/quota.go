@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrorQuotaExceeded the user has no space left
+var ErrorQuotaExceeded = errors.New("quota exceeded")
+
+// ErrorTooLarge the upload is larger than the space left
+var ErrorTooLarge = errors.New("upload larger than the space left")
+
+// UsageTracker reports the bytes stored by a user
+type UsageTracker interface {
+	GetUsage(uid string) (int64, error)
+}
+
+// UsageCounter the bytes stored per user, the usage of a user is calculated
+// once and then kept up to date by the storage with every write and removal
+type UsageCounter struct {
+	mu        sync.Mutex
+	usage     map[string]int64
+	calculate func(uid string) (int64, error)
+}
+
+// NewUsageCounter a counter calculating the initial usage with calculate
+func NewUsageCounter(calculate func(uid string) (int64, error)) *UsageCounter {
+	return &UsageCounter{
+		usage:     make(map[string]int64),
+		calculate: calculate,
+	}
+}
+
+// Get the bytes stored by the user
+func (u *UsageCounter) Get(uid string) (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if used, ok := u.usage[uid]; ok {
+		return used, nil
+	}
+	used, err := u.calculate(uid)
+	if err != nil {
+		return 0, err
+	}
+	u.usage[uid] = used
+	return used, nil
+}
+
+// Add adjusts the usage after a write or removal, a usage that was
+// never calculated includes the change once it is
+func (u *UsageCounter) Add(uid string, delta int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if used, ok := u.usage[uid]; ok {
+		u.usage[uid] = used + delta
+	}
+}
+
+// Quota enforces the storage limit of the users
+type Quota struct {
+	users        UserStorer
+	usage        UsageTracker
+	defaultLimit int64
+}
+
+// NewQuota the limit of a user is its own quota or defaultLimit, 0 is unlimited
+func NewQuota(users UserStorer, usage UsageTracker, defaultLimit int64) *Quota {
+	return &Quota{
+		users:        users,
+		usage:        usage,
+		defaultLimit: defaultLimit,
+	}
+}
+
+// Usage the bytes used by the user and its limit, 0 is unlimited
+func (q *Quota) Usage(uid string) (used, limit int64, err error) {
+	user, err := q.users.GetUser(uid)
+	if err != nil {
+		return
+	}
+	switch {
+	case user.Quota < 0:
+		limit = 0
+	case user.Quota > 0:
+		limit = user.Quota
+	default:
+		limit = q.defaultLimit
+	}
+	used, err = q.usage.GetUsage(uid)
+	return
+}
+
+// Check whether an upload of size bytes fits in the user's quota,
+// a negative size is not known in advance and only needs some space left
+func (q *Quota) Check(uid string, size int64) error {
+	used, limit, err := q.Usage(uid)
+	if err != nil {
+		return err
+	}
+	if limit == 0 {
+		return nil
+	}
+	if used >= limit {
+		return ErrorQuotaExceeded
+	}
+	if size > limit-used {
+		return ErrorTooLarge
+	}
+	return nil
+}
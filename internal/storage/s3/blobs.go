@@ -0,0 +1,593 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
+	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// blobs younger than this are never collected, a device may have uploaded
+// them and not yet published the root that references them
+const gcGracePeriod = time.Hour
+
+// GetBlobURL return a url for a file to store, when presigning is enabled
+// the devices transfer the blobs directly from and to the bucket
+func (s *Storage) GetBlobURL(uid, blobid, scope, deviceID string) (string, time.Time, error) {
+	// the root has to go through the server, which checks the generation
+	if !s.cfg.S3.Presign || blobid == rootFile {
+		return fs.SignedBlobURL(s.cfg, uid, blobid, scope, deviceID)
+	}
+	method := http.MethodGet
+	if scope == "write" {
+		method = http.MethodPut
+	}
+	expires := time.Minute * config.ReadStorageExpirationInMinutes
+	return s.client.PresignURL(method, blobKey(uid, blobid), expires), time.Now().Add(expires), nil
+}
+
+// LoadBlob opens a blob by id, the generation is kept in the metadata of the root
+func (s *Storage) LoadBlob(uid, blobid string) (io.ReadCloser, int64, int64, error) {
+	reader, info, err := s.client.GetObject(blobKey(uid, blobid))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	generation := int64(0)
+	if blobid == rootFile {
+		generation, _ = strconv.ParseInt(info.Metadata[generationMeta], 10, 64)
+	}
+	return reader, generation, info.Size, nil
+}
+
+// StoreBlob stores a blob, the root is only replaced when the generation matches
+func (s *Storage) StoreBlob(uid, blobid string, stream io.Reader, lastGen int64) (int64, error) {
+	if blobid != rootFile {
+		return 1, s.putObject(uid, blobKey(uid, blobid), stream, -1)
+	}
+	return s.StoreRoot(uid, "", stream, lastGen)
+}
+
+// StoreRoot publishes a new root uploaded by the device
+func (s *Storage) StoreRoot(uid, deviceID string, stream io.Reader, lastGen int64) (int64, error) {
+	hash, err := models.ReadRootHash(stream)
+	if err != nil {
+		return 0, err
+	}
+	return s.writeRoot(uid, deviceID, lastGen, hash)
+}
+
+// writeRoot replaces the root with a conditional write, so that concurrent
+// updates cannot both succeed, and records the new generation in the history
+func (s *Storage) writeRoot(uid, deviceID string, lastGen int64, hash string) (int64, error) {
+	key := blobKey(uid, rootFile)
+	opts := PutOptions{}
+
+	currentGen := int64(0)
+	info, err := s.client.HeadObject(key)
+	switch err {
+	case nil:
+		currentGen, _ = strconv.ParseInt(info.Metadata[generationMeta], 10, 64)
+		opts.IfMatch = info.ETag
+	case storage.ErrorNotFound:
+		opts.IfNoneMatch = "*"
+	default:
+		return 0, err
+	}
+
+	if currentGen != lastGen && currentGen > 0 {
+		log.Warnf("wrong generation, server %d, client %d", currentGen, lastGen)
+		return currentGen, storage.ErrorWrongGeneration
+	}
+
+	generation := currentGen + 1
+	opts.Metadata = map[string]string{
+		generationMeta: strconv.FormatInt(generation, 10),
+	}
+	_, err = s.client.PutObject(key, strings.NewReader(hash), int64(len(hash)), opts)
+	if err == ErrorPreconditionFailed {
+		log.Warnf("root of %s changed concurrently", uid)
+		return currentGen, storage.ErrorWrongGeneration
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	entry := time.Now().UTC().Format(time.RFC3339) + " " + hash
+	if deviceID != "" {
+		entry += " " + deviceID
+	}
+	_, err = s.client.PutObject(historyKey(uid, generation, hash, deviceID), strings.NewReader(entry), int64(len(entry)), PutOptions{})
+	if err != nil {
+		// the root is already published, only the history is incomplete
+		log.Error("cannot write root history: ", err)
+	} else {
+		s.usage.Add(uid, int64(len(entry)))
+	}
+	return generation, nil
+}
+
+// GetTree returns the cached blob tree for the user
+func (s *Storage) GetTree(uid string) (*models.HashTree, error) {
+	tree := &models.HashTree{}
+
+	cached, _ := s.trees.Get(uid)
+	if cached != nil {
+		tree = cached
+	}
+
+	changed, err := tree.Mirror(&remoteStorage{s: s, uid: uid})
+	if err != nil {
+		return nil, err
+	}
+	if changed || cached == nil {
+		err = s.saveTree(uid, tree)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func (s *Storage) saveTree(uid string, tree *models.HashTree) error {
+	s.trees.Put(uid, tree)
+	return nil
+}
+
+// Export exports a document to the format
+func (s *Storage) Export(uid, docid string, format storage.ExportFormat, options storage.ExportOptions) (io.ReadCloser, error) {
+	if !exporter.IsFormat(format.Type) {
+		return nil, exporter.ErrorUnsupportedFormat
+	}
+	tree, err := s.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := tree.FindDoc(docid)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := models.ArchiveFromHashDoc(doc, &remoteStorage{s: s, uid: uid})
+	if err != nil {
+		return nil, err
+	}
+	err = exporter.CheckPages(archive, options.GeneratorOptions())
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer archive.Close()
+		err := exporter.Export(archive, format.Type, format.DPI, options.GeneratorOptions(), writer)
+		if err != nil {
+			log.Error(err)
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// putBlob stores content under its hash
+func (s *Storage) putBlob(uid, entryName string, content []byte) (*models.HashEntry, error) {
+	hash, size, err := models.Hash(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	err = s.putObject(uid, blobKey(uid, hash), bytes.NewReader(content), size)
+	if err != nil {
+		return nil, err
+	}
+	entry := models.NewFileHashEntry(hash, entryName)
+	entry.Size = size
+	return entry, nil
+}
+
+// CreateBlobDocument creates a new document
+func (s *Storage) CreateBlobDocument(uid, filename, parent string, stream io.Reader) (*storage.Document, error) {
+	ext := path.Ext(filename)
+	if models.IsDocumentArchive(ext) {
+		return s.importBlobArchive(uid, filename, parent, ext, stream)
+	}
+	switch ext {
+	case models.PdfFileExt:
+	case models.EpubFileExt:
+	default:
+		return nil, errors.New("unsupported extension: " + ext)
+	}
+
+	docid := uuid.New().String()
+	docName := strings.TrimSuffix(filename, ext)
+
+	tree, err := s.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := models.MetadataFile{
+		DocumentName:     docName,
+		CollectionType:   models.DocumentType,
+		Parent:           parent,
+		Version:          1,
+		LastModified:     strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Synced:           true,
+		MetadataModified: true,
+	}
+	jsn, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	hashDoc := models.NewHashDocMeta(docid, metadata)
+
+	fi, err := s.putBlob(uid, docid+models.MetadataFileExt, jsn)
+	if err != nil {
+		return nil, err
+	}
+	hashDoc.AddFile(fi)
+
+	fi, err = s.putBlob(uid, docid+models.ContentFileExt, []byte(models.CreateContent(ext)))
+	if err != nil {
+		return nil, err
+	}
+	hashDoc.AddFile(fi)
+
+	payload, size, err := spool(stream)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.Close()
+	payloadHash, _, err := models.Hash(payload)
+	if err != nil {
+		return nil, err
+	}
+	_, err = payload.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putObject(uid, blobKey(uid, payloadHash), payload, size)
+	if err != nil {
+		return nil, err
+	}
+	fi = models.NewFileHashEntry(payloadHash, docid+ext)
+	fi.Size = size
+	err = hashDoc.AddFile(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.publishDoc(uid, tree, hashDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.Document{
+		ID:     docid,
+		Type:   models.DocumentType,
+		Parent: parent,
+		Name:   docName,
+	}, nil
+}
+
+// CreateBlobFolder creates a new folder, which has a metadata and a content blob
+func (s *Storage) CreateBlobFolder(uid, name, parent string) (*storage.Document, error) {
+	docid := uuid.New().String()
+	tree, err := s.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := models.MetadataFile{
+		DocumentName:     name,
+		CollectionType:   models.CollectionType,
+		Parent:           parent,
+		Version:          1,
+		LastModified:     strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Synced:           true,
+		MetadataModified: true,
+	}
+	jsn, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	hashDoc := models.NewHashDocMeta(docid, metadata)
+
+	fi, err := s.putBlob(uid, docid+models.MetadataFileExt, jsn)
+	if err != nil {
+		return nil, err
+	}
+	err = hashDoc.AddFile(fi)
+	if err != nil {
+		return nil, err
+	}
+	fi, err = s.putBlob(uid, docid+models.ContentFileExt, []byte(models.FolderContent))
+	if err != nil {
+		return nil, err
+	}
+	err = hashDoc.AddFile(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.publishDoc(uid, tree, hashDoc)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Document{
+		ID:      docid,
+		Type:    models.CollectionType,
+		Parent:  parent,
+		Name:    name,
+		Version: 1,
+	}, nil
+}
+
+// UpdateBlobDocument stores the changed metadata of a document of the tree
+// and publishes the tree as a new root generation, which fails with
+// ErrorWrongGeneration when the tree changed in the meantime
+func (s *Storage) UpdateBlobDocument(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	metahash, reader, err := hashDoc.MetadataReader()
+	if err != nil {
+		return err
+	}
+	err = s.putObject(uid, blobKey(uid, metahash), reader, -1)
+	if err != nil {
+		return err
+	}
+	err = hashDoc.Rehash()
+	if err != nil {
+		return err
+	}
+	err = tree.Rehash()
+	if err != nil {
+		return err
+	}
+	return s.publishTree(uid, tree, hashDoc)
+}
+
+// putIndex stores an index blob
+func (s *Storage) putIndex(uid, hash string, indexReader func() (io.ReadCloser, error)) error {
+	r, err := indexReader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.putObject(uid, blobKey(uid, hash), r, -1)
+}
+
+// RemoveBlobDocuments removes documents from the tree and publishes the tree
+// as a new root generation, their blobs are left to the garbage collection
+func (s *Storage) RemoveBlobDocuments(uid string, tree *models.HashTree, docIDs ...string) error {
+	for _, docID := range docIDs {
+		if _, err := tree.FindDoc(docID); err != nil {
+			return storage.ErrorNotFound
+		}
+		err := tree.Remove(docID)
+		if err != nil {
+			return err
+		}
+	}
+	return s.publishRoot(uid, tree)
+}
+
+// publishDoc adds the document to the tree and makes the new root current
+func (s *Storage) publishDoc(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	err := tree.Add(hashDoc)
+	if err != nil {
+		return err
+	}
+	return s.publishTree(uid, tree, hashDoc)
+}
+
+// publishTree stores the indexes of the changed document and the tree and makes the new root current
+func (s *Storage) publishTree(uid string, tree *models.HashTree, hashDoc *models.HashDoc) error {
+	err := s.putIndex(uid, hashDoc.Hash, hashDoc.IndexReader)
+	if err != nil {
+		return err
+	}
+	return s.publishRoot(uid, tree)
+}
+
+// publishRoot stores the root index of the tree and makes it the current root
+func (s *Storage) publishRoot(uid string, tree *models.HashTree) error {
+	err := s.putIndex(uid, tree.Hash, tree.RootIndex)
+	if err != nil {
+		return err
+	}
+
+	gen, err := s.writeRoot(uid, "", tree.Generation, tree.Hash)
+	if err != nil {
+		return err
+	}
+	tree.Generation = gen
+	return s.saveTree(uid, tree)
+}
+
+// importBlobArchive stores the files of an uploaded .zip, .rmdoc or .rm as
+// blobs, the document keeps its id unless it is not a uuid or already taken
+func (s *Storage) importBlobArchive(uid, filename, parent, ext string, stream io.Reader) (*storage.Document, error) {
+	archive, closeArchive, err := models.OpenUploadedArchive(ext, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+
+	tree, err := s.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	hashDoc, err := archive.HashDoc(&remoteStorage{s: s, uid: uid}, tree, filename, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.publishDoc(uid, tree, hashDoc)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Document{
+		ID:     archive.ID,
+		Type:   models.DocumentType,
+		Parent: parent,
+		Name:   hashDoc.DocumentName,
+	}, nil
+}
+
+// CollectGarbage removes the blobs which are referenced neither by the current root
+// nor by the last keepRoots roots of the history
+func (s *Storage) CollectGarbage(uid string, keepRoots int, dryRun bool) (*storage.GarbageReport, error) {
+	roots, err := s.retainedRoots(uid, keepRoots)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := models.Reachable(&remoteStorage{s: s, uid: uid}, roots)
+	if err != nil {
+		return nil, err
+	}
+
+	// the delimiter leaves out the history
+	prefix := userPrefix(uid) + syncFolder + "/"
+	objects, err := s.client.ListObjects(prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &storage.GarbageReport{
+		UserID:       uid,
+		DryRun:       dryRun,
+		Unreferenced: []string{},
+	}
+	cutoff := time.Now().Add(-gcGracePeriod)
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, prefix)
+		if name == rootFile || strings.HasPrefix(name, ".") {
+			continue
+		}
+		report.Scanned++
+		if referenced[name] {
+			report.Referenced++
+			continue
+		}
+		if o.LastModified.After(cutoff) {
+			continue
+		}
+
+		report.Unreferenced = append(report.Unreferenced, name)
+		report.ReclaimableBytes += o.Size
+		if dryRun {
+			continue
+		}
+		err = s.client.DeleteObject(o.Key)
+		if err != nil {
+			return report, err
+		}
+		s.usage.Add(uid, -o.Size)
+	}
+	log.Infof("gc %s: scanned %d, unreferenced %d, %d bytes, dry run: %t",
+		uid, report.Scanned, len(report.Unreferenced), report.ReclaimableBytes, dryRun)
+
+	return report, nil
+}
+
+// retainedRoots the current root hash and the last keepRoots distinct ones from the history
+func (s *Storage) retainedRoots(uid string, keepRoots int) ([]string, error) {
+	current, _, err := (&remoteStorage{s: s, uid: uid}).GetRootIndex()
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.RootHistory(uid)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(history))
+	for _, h := range history {
+		hashes = append(hashes, h.Hash)
+	}
+	return models.RetainedRoots(current, hashes, keepRoots), nil
+}
+
+// RootHistory lists the generations of the user's root, oldest first
+func (s *Storage) RootHistory(uid string) ([]storage.RootGeneration, error) {
+	prefix := historyPrefix(uid)
+	objects, err := s.client.ListObjects(prefix, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]storage.RootGeneration, 0, len(objects))
+	for _, o := range objects {
+		parts := strings.SplitN(strings.TrimPrefix(o.Key, prefix), ".", 3)
+		if len(parts) < 2 {
+			log.Warn("skipping malformed root history key: ", o.Key)
+			continue
+		}
+		generation, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			log.Warn("skipping malformed root history key: ", o.Key)
+			continue
+		}
+		h := storage.RootGeneration{
+			Generation: generation,
+			Timestamp:  o.LastModified,
+			Hash:       parts[1],
+		}
+		if len(parts) == 3 {
+			h.DeviceID = parts[2]
+		}
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+// GetTreeAt rebuilds the tree as it was at the given generation
+func (s *Storage) GetTreeAt(uid string, generation int64) (*models.HashTree, error) {
+	history, err := s.RootHistory(uid)
+	if err != nil {
+		return nil, err
+	}
+	root, err := storage.FindGeneration(history, generation)
+	if err != nil {
+		return nil, err
+	}
+	return models.BuildTreeFromRoot(&remoteStorage{s: s, uid: uid}, root.Hash, root.Generation)
+}
+
+// RestoreRoot publishes the root of an older generation as a new generation
+func (s *Storage) RestoreRoot(uid string, generation int64) (int64, error) {
+	tree, err := s.GetTreeAt(uid, generation)
+	if err != nil {
+		return 0, fmt.Errorf("generation %d cannot be restored, %w", generation, err)
+	}
+	// the blobs may have been garbage collected
+	err = tree.MissingFile(func(hash string) bool {
+		_, err := s.client.HeadObject(blobKey(uid, hash))
+		return err == nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("generation %d cannot be restored, %w", generation, err)
+	}
+
+	_, currentGen, err := (&remoteStorage{s: s, uid: uid}).GetRootIndex()
+	if err != nil {
+		return 0, err
+	}
+	newGen, err := s.writeRoot(uid, "", currentGen, tree.Hash)
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("restored %s to generation %d as generation %d", uid, generation, newGen)
+	return newGen, nil
+}
@@ -0,0 +1,274 @@
+package s3
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+)
+
+const metaHeaderPrefix = "X-Amz-Meta-"
+
+// ErrorPreconditionFailed a conditional write did not match
+var ErrorPreconditionFailed = errors.New("precondition failed")
+
+// ObjectInfo the attributes of an object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// PutOptions conditions and user metadata of a write
+type PutOptions struct {
+	// IfMatch only write when the current object has this etag
+	IfMatch string
+	// IfNoneMatch "*" only write when the object does not exist
+	IfNoneMatch string
+	Metadata    map[string]string
+}
+
+// Client a minimal client for s3 compatible object storage, using path style addressing
+type Client struct {
+	endpoint *url.URL
+	bucket   string
+	signer   signer
+	http     *http.Client
+}
+
+// NewClient creates a client for the configured bucket
+func NewClient(cfg *config.S3Config) (*Client, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", cfg.Endpoint)
+	}
+	return &Client{
+		endpoint: endpoint,
+		bucket:   cfg.Bucket,
+		signer: signer{
+			accessKey: cfg.AccessKey,
+			secretKey: cfg.SecretKey,
+			region:    cfg.Region,
+		},
+		http: &http.Client{},
+	}, nil
+}
+
+func (c *Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	p := "/" + c.bucket
+	if key != "" {
+		p += "/" + key
+	}
+	u.Path = c.endpoint.Path + p
+	u.RawPath = c.endpoint.EscapedPath() + uriEncode(p, false)
+	return &u
+}
+
+func (c *Client) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := c.objectURL(key)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.signer.sign(req, unsignedPayload, time.Now())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, storage.ErrorNotFound
+	case http.StatusPreconditionFailed:
+		return nil, ErrorPreconditionFailed
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, res.Status, string(msg))
+}
+
+func objectInfo(key string, res *http.Response) *ObjectInfo {
+	info := &ObjectInfo{
+		Key:      key,
+		Size:     res.ContentLength,
+		ETag:     res.Header.Get("ETag"),
+		Metadata: make(map[string]string),
+	}
+	if lm, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lm
+	}
+	for k, v := range res.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) && len(v) > 0 {
+			info.Metadata[strings.ToLower(strings.TrimPrefix(k, metaHeaderPrefix))] = v[0]
+		}
+	}
+	return info
+}
+
+// GetObject opens an object for reading
+func (c *Client) GetObject(key string) (io.ReadCloser, *ObjectInfo, error) {
+	res, err := c.do(http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Body, objectInfo(key, res), nil
+}
+
+// HeadObject the attributes of an object
+func (c *Client) HeadObject(key string) (*ObjectInfo, error) {
+	res, err := c.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return objectInfo(key, res), nil
+}
+
+// PutObject writes an object, when the size is not known (-1) the body is spooled to a temp file first
+func (c *Client) PutObject(key string, body io.Reader, size int64, opts PutOptions) (etag string, err error) {
+	if size < 0 {
+		var tmp *os.File
+		tmp, err = ioutil.TempFile("", "s3put")
+		if err != nil {
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		size, err = io.Copy(tmp, body)
+		if err != nil {
+			return
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		body = tmp
+	}
+
+	header := http.Header{}
+	if opts.IfMatch != "" {
+		header.Set("If-Match", opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	for k, v := range opts.Metadata {
+		header.Set(metaHeaderPrefix+k, v)
+	}
+
+	res, err := c.do(http.MethodPut, key, nil, header, body, size)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+// CopyObject copies an object inside the bucket
+func (c *Client) CopyObject(src, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", uriEncode("/"+c.bucket+"/"+src, false))
+	res, err := c.do(http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// DeleteObject removes an object
+func (c *Client) DeleteObject(key string) error {
+	res, err := c.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+}
+
+// ListObjects lists the objects with the prefix, with a delimiter only the objects at that level
+func (c *Client) ListObjects(prefix, delimiter string) ([]ObjectInfo, error) {
+	result := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := c.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var list listBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range list.Contents {
+			result = append(result, ObjectInfo{
+				Key:          o.Key,
+				Size:         o.Size,
+				ETag:         o.ETag,
+				LastModified: o.LastModified,
+			})
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return result, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// PresignURL an url to get or put the object directly
+func (c *Client) PresignURL(method, key string, expires time.Duration) string {
+	return c.signer.presign(method, c.objectURL(key), expires, time.Now())
+}
@@ -0,0 +1,326 @@
+package s3
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/common"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
+	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+const cacheDir = ".cache"
+
+// GetDocument opens a document by id
+func (s *Storage) GetDocument(uid, id string) (io.ReadCloser, error) {
+	reader, _, err := s.client.GetObject(userKey(uid, id+models.ZipFileExt))
+	return reader, err
+}
+
+// StoreDocument stores a document, the content it replaces is kept as a version
+func (s *Storage) StoreDocument(uid, id string, stream io.ReadCloser) error {
+	err := s.keepVersion(uid, id)
+	if err != nil {
+		return err
+	}
+	err = s.putObject(uid, userKey(uid, id+models.ZipFileExt), stream, -1)
+	if err != nil {
+		return err
+	}
+	return s.pruneVersions(uid, id)
+}
+
+// RemoveDocument removes document (moves it to trash)
+func (s *Storage) RemoveDocument(uid, id string) error {
+	for _, name := range []string{id + models.MetadataFileExt, id + models.ZipFileExt} {
+		key := userKey(uid, name)
+		err := s.client.CopyObject(key, trashKey(uid, name))
+		// folders may have no content
+		if err == storage.ErrorNotFound && path.Ext(name) == models.ZipFileExt {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = s.client.DeleteObject(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStorageURL the storage url
+func (s *Storage) GetStorageURL(uid, id string) (string, time.Time, error) {
+	return fs.SignedStorageURL(s.cfg, uid, id)
+}
+
+// ExportDocument exports a document to the format, the result is cached in the bucket
+func (s *Storage) ExportDocument(uid, id string, format storage.ExportFormat, options storage.ExportOptions) (io.ReadCloser, error) {
+	if !exporter.IsFormat(format.Type) {
+		return nil, exporter.ErrorUnsupportedFormat
+	}
+
+	zipKey := userKey(uid, id+models.ZipFileExt)
+	cacheKey := userPrefix(uid) + cacheDir + "/" + common.Sanitize(id) + "-" + options.String() + "." + format.String()
+
+	raw, err := s.client.HeadObject(zipKey)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.client.HeadObject(cacheKey)
+	// exists and not older
+	if err == nil && !raw.LastModified.After(cached.LastModified) {
+		reader, _, err := s.client.GetObject(cacheKey)
+		return reader, err
+	}
+
+	reader, _, err := s.client.GetObject(zipKey)
+	if err != nil {
+		return nil, err
+	}
+	zipFile, size, err := spool(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer zipFile.Close()
+
+	arch := &exporter.MyArchive{}
+	err = arch.Read(zipFile, size)
+	if err != nil {
+		return nil, err
+	}
+	if arch.Payload != nil {
+		arch.PayloadReader = exporter.NewSeekCloser(arch.Payload)
+	}
+
+	tmp, err := ioutil.TempFile("", "s3export")
+	if err != nil {
+		return nil, err
+	}
+	output := &tempFile{tmp}
+	var outputSize int64
+	err = exporter.Export(arch, format.Type, format.DPI, options.GeneratorOptions(), output)
+	if err == nil {
+		outputSize, err = output.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = output.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = s.client.PutObject(cacheKey, output, outputSize, PutOptions{})
+	}
+	if err == nil {
+		_, err = output.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	return output, nil
+}
+
+// CreateDocument creates a new document
+func (s *Storage) CreateDocument(uid, filename, parent string, stream io.Reader) (*storage.Document, error) {
+	ext := path.Ext(filename)
+	if models.IsDocumentArchive(ext) {
+		return s.importArchive(uid, filename, parent, ext, stream)
+	}
+	switch ext {
+	case models.PdfFileExt:
+	case models.EpubFileExt:
+	default:
+		return nil, errors.New("unsupported extension: " + ext)
+	}
+	docid := uuid.New().String()
+
+	tmp, err := ioutil.TempFile("", "s3doc")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := zip.NewWriter(tmp)
+	entry, err := w.Create(docid + ext)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(entry, stream)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Create(docid + models.PageFileExt)
+	if err != nil {
+		return nil, err
+	}
+	entry, err = w.Create(docid + models.ContentFileExt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = entry.Write([]byte(models.CreateContent(ext)))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putObject(uid, userKey(uid, docid+models.ZipFileExt), tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createDocumentMetadata(uid, docid, strings.TrimSuffix(filename, ext), parent)
+}
+
+// CreateFolder creates a new folder, its zip only has the content
+func (s *Storage) CreateFolder(uid, name, parent string) (*storage.Document, error) {
+	docid := uuid.New().String()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	entry, err := w.Create(docid + models.ContentFileExt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = entry.Write([]byte(models.FolderContent))
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = s.putObject(uid, userKey(uid, docid+models.ZipFileExt), &buf, int64(buf.Len()))
+	if err != nil {
+		return nil, err
+	}
+	return s.saveDocumentMetadata(uid, docid, name, parent, models.CollectionType)
+}
+
+// importArchive stores the files of an uploaded .zip, .rmdoc or .rm, the
+// document keeps its id unless it is not a uuid or already taken
+func (s *Storage) importArchive(uid, filename, parent, ext string, stream io.Reader) (*storage.Document, error) {
+	archive, closeArchive, err := models.OpenUploadedArchive(ext, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+
+	_, taken := s.client.HeadObject(userKey(uid, archive.ID+models.MetadataFileExt))
+	if _, err := uuid.Parse(archive.ID); err != nil || taken == nil {
+		archive.Remap(uuid.NewString())
+	}
+
+	tmp, err := ioutil.TempFile("", "s3doc")
+	if err != nil {
+		return nil, err
+	}
+	output := &tempFile{tmp}
+	defer output.Close()
+	err = archive.WriteZip(output)
+	if err != nil {
+		return nil, err
+	}
+	size, err := output.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, err = output.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putObject(uid, userKey(uid, archive.ID+models.ZipFileExt), output, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createDocumentMetadata(uid, archive.ID, archive.Name(filename), parent)
+}
+
+// createDocumentMetadata saves the metadata of a new document
+func (s *Storage) createDocumentMetadata(uid, docid, name, parent string) (*storage.Document, error) {
+	return s.saveDocumentMetadata(uid, docid, name, parent, models.DocumentType)
+}
+
+// saveDocumentMetadata saves the metadata of a new document or folder
+func (s *Storage) saveDocumentMetadata(uid, docid, name, parent, docType string) (*storage.Document, error) {
+	metadata := &messages.RawMetadata{
+		ID:             docid,
+		VissibleName:   name,
+		Version:        1,
+		ModifiedClient: time.Now().UTC().Format(time.RFC3339Nano),
+		Type:           docType,
+		Parent:         parent,
+	}
+	err := s.UpdateMetadata(uid, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Document{
+		ID:      docid,
+		Type:    metadata.Type,
+		Parent:  parent,
+		Name:    name,
+		Version: 1,
+	}, nil
+}
+
+// GetAllMetadata load all metadata
+func (s *Storage) GetAllMetadata(uid string) ([]*messages.RawMetadata, error) {
+	result := []*messages.RawMetadata{}
+	objects, err := s.client.ListObjects(userPrefix(uid), "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		name := path.Base(o.Key)
+		if path.Ext(name) != models.MetadataFileExt {
+			continue
+		}
+		doc, err := s.GetMetadata(uid, strings.TrimSuffix(name, models.MetadataFileExt))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		result = append(result, doc)
+	}
+	return result, nil
+}
+
+// GetMetadata loads a document's metadata
+func (s *Storage) GetMetadata(uid, id string) (*messages.RawMetadata, error) {
+	response := messages.RawMetadata{}
+	err := s.getJSON(userKey(uid, id+models.MetadataFileExt), &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// UpdateMetadata updates the metadata of a document
+func (s *Storage) UpdateMetadata(uid string, r *messages.RawMetadata) error {
+	return s.putJSON(uid, userKey(uid, r.ID+models.MetadataFileExt), r)
+}
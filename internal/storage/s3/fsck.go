@@ -0,0 +1,149 @@
+package s3
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// corrupt blobs are moved here, out of the sync folder
+const quarantineDir = ".quarantine"
+
+// CheckBlobs verifies that every blob matches its hash, that the root and the
+// document indexes only reference existing blobs of the right size and that
+// the cached tree matches the root. With repair the corrupt blobs are
+// quarantined and the cached tree is rebuilt
+func (s *Storage) CheckBlobs(uid string, repair bool) (*storage.FsckReport, error) {
+	report := &storage.FsckReport{
+		UserID:       uid,
+		Repair:       repair,
+		Corrupt:      []string{},
+		Dangling:     []string{},
+		SizeMismatch: []string{},
+		Unparsable:   []string{},
+		Quarantined:  []string{},
+	}
+
+	sizes, err := s.checkBlobHashes(uid, report)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &remoteStorage{s: s, uid: uid}
+	rootHash, gen, err := rs.GetRootIndex()
+	if err != nil {
+		return nil, err
+	}
+	report.Root = rootHash
+	report.Generation = gen
+	if rootHash == "" {
+		return report, nil
+	}
+
+	check := models.CheckIndexes(rs, rootHash, sizes)
+	report.Documents = check.Documents
+	report.Dangling = append(report.Dangling, check.Dangling...)
+	report.SizeMismatch = append(report.SizeMismatch, check.SizeMismatch...)
+	report.Unparsable = append(report.Unparsable, check.Unparsable...)
+
+	s.checkTreeCache(uid, rootHash, gen, check.Docs, report)
+
+	log.Infof("fsck %s: scanned %d, documents %d, corrupt %d, dangling %d, size mismatches %d, unparsable %d, stale cache: %t",
+		uid, report.Scanned, report.Documents, len(report.Corrupt), len(report.Dangling),
+		len(report.SizeMismatch), len(report.Unparsable), report.StaleCache)
+	return report, nil
+}
+
+// checkBlobHashes hashes all blobs and returns the sizes of the intact ones,
+// the index blobs are named by the hash of their entries
+func (s *Storage) checkBlobHashes(uid string, report *storage.FsckReport) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	// the delimiter leaves out the history
+	prefix := userPrefix(uid) + syncFolder + "/"
+	objects, err := s.client.ListObjects(prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, prefix)
+		if name == rootFile || strings.HasPrefix(name, ".") {
+			continue
+		}
+		report.Scanned++
+		hash, size, err := s.blobHash(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		if hash == name || s.indexHash(o.Key) == name {
+			sizes[name] = size
+			continue
+		}
+
+		log.Warn("fsck: corrupt blob ", name)
+		report.Corrupt = append(report.Corrupt, name)
+		if !report.Repair {
+			continue
+		}
+		err = s.client.CopyObject(o.Key, userKey(uid, quarantineDir+"/"+name))
+		if err != nil {
+			return nil, err
+		}
+		err = s.client.DeleteObject(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		report.Quarantined = append(report.Quarantined, name)
+	}
+	return sizes, nil
+}
+
+// blobHash the hash of the content of the object
+func (s *Storage) blobHash(key string) (string, int64, error) {
+	reader, _, err := s.client.GetObject(key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	return models.Hash(reader)
+}
+
+// indexHash the hash of the entries of an index object, empty when it is not one
+func (s *Storage) indexHash(key string) string {
+	reader, _, err := s.client.GetObject(key)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	hash, err := models.IndexHash(reader)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// checkTreeCache compares the cached tree with the root index and rebuilds it on repair
+func (s *Storage) checkTreeCache(uid, rootHash string, gen int64, docs []*models.HashEntry, report *storage.FsckReport) {
+	tree, _ := s.trees.Get(uid)
+	// a missing cache is built on the next sync
+	if tree == nil {
+		return
+	}
+	report.StaleCache = !tree.MatchesRoot(rootHash, docs)
+	if !report.StaleCache || !report.Repair {
+		return
+	}
+
+	tree, err := models.BuildTreeFromRoot(&remoteStorage{s: s, uid: uid}, rootHash, gen)
+	if err != nil {
+		// the tree is rebuilt on the next sync once the blobs are back
+		log.Warn("fsck: cannot rebuild the tree of ", uid, ": ", err)
+		s.trees.Remove(uid)
+		return
+	}
+	// saving the in-memory cache does not fail
+	_ = s.saveTree(uid, tree)
+	report.CacheRebuilt = true
+}
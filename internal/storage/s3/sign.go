@@ -0,0 +1,164 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	amzDateFormat   = "20060102T150405Z"
+	scopeDateFormat = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	serviceName     = "s3"
+
+	headerDate          = "X-Amz-Date"
+	headerContentSha256 = "X-Amz-Content-Sha256"
+)
+
+// signer aws signature version 4
+type signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// uriEncode encodes everything but the unreserved characters
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			sb.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalHeaders the host and all the headers set on the request
+func canonicalHeaders(req *http.Request) (canonical, signed string) {
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k)
+		sb.WriteRune(':')
+		sb.WriteString(headers[k])
+		sb.WriteRune('\n')
+	}
+	return sb.String(), strings.Join(names, ";")
+}
+
+func (s *signer) scope(t time.Time) string {
+	return strings.Join([]string{t.Format(scopeDateFormat), s.region, serviceName, "aws4_request"}, "/")
+}
+
+func (s *signer) signature(t time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		t.Format(amzDateFormat),
+		s.scope(t),
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format(scopeDateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, serviceName)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the authorization header to the request
+func (s *signer) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set(headerDate, t.Format(amzDateFormat))
+	req.Header.Set(headerContentSha256, payloadHash)
+
+	headers, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, s.accessKey, s.scope(t), signedHeaders, s.signature(t, canonicalRequest)))
+}
+
+// presign adds the signature to the query, the url can be used without credentials until it expires
+func (s *signer) presign(method string, u *url.URL, expires time.Duration, t time.Time) string {
+	t = t.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", signAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(t))
+	query.Set("X-Amz-Date", t.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + s.signature(t, canonicalRequest)
+	return signed.String()
+}
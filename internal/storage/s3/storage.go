@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/zgs225/rmfakecloud/internal/common"
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
+)
+
+const (
+	userDir        = "users"
+	syncFolder     = "sync"
+	trashDir       = ".trash"
+	versionsDir    = ".versions"
+	historyDir     = ".root.history"
+	rootFile       = "root"
+	generationMeta = "generation"
+
+	// blobs smaller than this are kept in memory when read
+	spoolInMemory = 1 << 20
+)
+
+// Storage stores the documents and the sync15 blobs in an s3 compatible bucket,
+// the layout of the keys is the same as the one of the data dir
+type Storage struct {
+	cfg    *config.Config
+	client *Client
+
+	// trees of the users, mirrored on every access as other servers may share the bucket
+	trees *storage.TreeCache
+
+	usage *storage.UsageCounter
+}
+
+// NewStorage a storage using the configured bucket
+func NewStorage(cfg *config.Config) (*Storage, error) {
+	client, err := NewClient(cfg.S3)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		cfg:    cfg,
+		client: client,
+		trees:  storage.NewTreeCache(cfg.TreeCacheSize),
+	}
+	s.usage = storage.NewUsageCounter(s.calculateUsage)
+	return s, nil
+}
+
+func userPrefix(uid string) string {
+	return path.Join(userDir, path.Base(path.Clean("/"+uid))) + "/"
+}
+
+func userKey(uid, name string) string {
+	return userPrefix(uid) + path.Base(path.Clean("/"+name))
+}
+
+func blobKey(uid, blobid string) string {
+	return userPrefix(uid) + syncFolder + "/" + common.Sanitize(blobid)
+}
+
+func historyPrefix(uid string) string {
+	return userPrefix(uid) + syncFolder + "/" + historyDir + "/"
+}
+
+// the generation is zero padded so that the keys are listed in order,
+// the hash and the device are part of the key so the history can be listed without reading every entry
+func historyKey(uid string, generation int64, hash, deviceID string) string {
+	key := fmt.Sprintf("%s%020d.%s", historyPrefix(uid), generation, common.Sanitize(hash))
+	if deviceID != "" {
+		key += "." + common.Sanitize(deviceID)
+	}
+	return key
+}
+
+// spooled content that can be read at random
+type spooled interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// spool makes the reader seekable, keeping small content in memory
+func spool(r io.Reader) (spooled, int64, error) {
+	head, err := ioutil.ReadAll(io.LimitReader(r, spoolInMemory))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(head) < spoolInMemory {
+		return &exporter.SeekCloser{Reader: bytes.NewReader(head)}, int64(len(head)), nil
+	}
+
+	tmp, err := ioutil.TempFile("", "s3spool")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(head), r))
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, 0, err
+	}
+	return &tempFile{tmp}, size, nil
+}
+
+// tempFile removed when closed
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	defer os.Remove(t.Name())
+	return t.File.Close()
+}
+
+func (s *Storage) putJSON(uid, key string, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.putObject(uid, key, bytes.NewReader(js), int64(len(js)))
+}
+
+func (s *Storage) getJSON(key string, v interface{}) error {
+	reader, _, err := s.client.GetObject(key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(v)
+}
+
+// remoteStorage the blobs of a user as seen by the hash tree
+type remoteStorage struct {
+	s   *Storage
+	uid string
+}
+
+// GetRootIndex the hash of the root index
+func (r *remoteStorage) GetRootIndex() (string, int64, error) {
+	reader, gen, _, err := r.s.LoadBlob(r.uid, rootFile)
+	if err != nil {
+		if err == storage.ErrorNotFound {
+			return "", 0, nil
+		}
+		return "", 0, err
+	}
+	defer reader.Close()
+	hash, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSpace(string(hash)), gen, nil
+}
+
+// GetReader a seekable reader of the blob, the exporter needs to seek in pdfs
+func (r *remoteStorage) GetReader(hash string) (io.ReadCloser, error) {
+	reader, _, err := r.s.client.GetObject(blobKey(r.uid, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	seekable, _, err := spool(reader)
+	return seekable, err
+}
+
+// Write stores the reader in the hash
+func (r *remoteStorage) Write(hash string, reader io.Reader) error {
+	return r.s.putObject(r.uid, blobKey(r.uid, hash), reader, -1)
+}
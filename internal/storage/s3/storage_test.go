@@ -0,0 +1,273 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	meta     http.Header
+}
+
+// fakeBucket the part of the s3 api the storage uses
+type fakeBucket struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]*fakeObject
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.Header.Get("Authorization") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+b.bucket), "/")
+	obj := b.objects[key]
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		b.list(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodPut:
+		if m := r.Header.Get("If-Match"); m != "" && (obj == nil || obj.etag != m) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && obj != nil {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		var data []byte
+		meta := http.Header{}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			source := b.objects[strings.TrimPrefix(src, "/"+b.bucket+"/")]
+			if source == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			data, meta = source.data, source.meta
+		} else {
+			data, _ = ioutil.ReadAll(r.Body)
+			for k, v := range r.Header {
+				if strings.HasPrefix(k, metaHeaderPrefix) {
+					meta[k] = v
+				}
+			}
+		}
+		sum := md5.Sum(data)
+		b.objects[key] = &fakeObject{
+			data:     data,
+			etag:     `"` + hex.EncodeToString(sum[:]) + `"`,
+			modified: time.Now(),
+			meta:     meta,
+		}
+		w.Header().Set("ETag", b.objects[key].etag)
+	case r.Method == http.MethodDelete:
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *fakeBucket) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	keys := []string{}
+	for k := range b.objects {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(k, prefix), delimiter) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+	for _, k := range keys {
+		o := b.objects[k]
+		result.Contents = append(result.Contents, content{k, o.modified, o.etag, int64(len(o.data))})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestStorage(t *testing.T) (*Storage, *fakeBucket) {
+	bucket := &fakeBucket{
+		bucket:  "test",
+		objects: make(map[string]*fakeObject),
+	}
+	srv := httptest.NewServer(bucket)
+	t.Cleanup(srv.Close)
+
+	s, err := NewStorage(&config.Config{
+		S3: &config.S3Config{
+			Endpoint:  srv.URL,
+			Region:    "us-east-1",
+			Bucket:    bucket.bucket,
+			AccessKey: "key",
+			SecretKey: "secret",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, bucket
+}
+
+func storeTestBlob(t *testing.T, s *Storage, uid, content string) string {
+	hash, _, err := models.Hash(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StoreBlob(uid, hash, strings.NewReader(content), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestStoreRoot(t *testing.T) {
+	testuser := "test"
+	s, _ := newTestStorage(t)
+
+	var roots []string
+	for i, content := range []string{"first", "second"} {
+		file := storeTestBlob(t, s, testuser, content)
+		docIndex := storeTestBlob(t, s, testuser, "3\n"+file+":0:doc.content:0:5\n")
+		rootIndex := storeTestBlob(t, s, testuser, "3\n"+docIndex+":80000000:doc:1:0\n")
+		gen, err := s.StoreBlob(testuser, rootFile, strings.NewReader(rootIndex), int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gen != int64(i+1) {
+			t.Errorf("expected generation %d, got %d", i+1, gen)
+		}
+		roots = append(roots, rootIndex)
+	}
+
+	_, err := s.StoreBlob(testuser, rootFile, strings.NewReader(roots[0]), 1)
+	if err != storage.ErrorWrongGeneration {
+		t.Errorf("expected wrong generation, got %v", err)
+	}
+	// a root is only a hash
+	_, err = s.StoreBlob(testuser, rootFile, strings.NewReader(strings.Repeat("a", 2048)), 2)
+	if err == nil {
+		t.Error("an oversized root was stored")
+	}
+
+	reader, gen, _, err := s.LoadBlob(testuser, rootFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	current, _ := ioutil.ReadAll(reader)
+	if string(current) != roots[1] || gen != 2 {
+		t.Errorf("unexpected root %s at generation %d", current, gen)
+	}
+
+	tree, err := s.GetTree(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Docs) != 1 || tree.Generation != 2 {
+		t.Errorf("unexpected tree with %d docs at generation %d", len(tree.Docs), tree.Generation)
+	}
+
+	history, err := s.RootHistory(testuser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Hash != roots[0] || history[1].Generation != 2 {
+		t.Fatalf("unexpected history %v", history)
+	}
+
+	gen, err = s.RestoreRoot(testuser, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen != 3 {
+		t.Errorf("expected generation 3, got %d", gen)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	testuser := "test"
+	s, bucket := newTestStorage(t)
+
+	file := storeTestBlob(t, s, testuser, "page")
+	docIndex := storeTestBlob(t, s, testuser, "3\n"+file+":0:doc.content:0:4\n")
+	rootIndex := storeTestBlob(t, s, testuser, "3\n"+docIndex+":80000000:doc:1:0\n")
+	_, err := s.StoreBlob(testuser, rootFile, strings.NewReader(rootIndex), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := storeTestBlob(t, s, testuser, "orphan")
+	fresh := storeTestBlob(t, s, testuser, "fresh")
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	for _, o := range bucket.objects {
+		o.modified = old
+	}
+	bucket.objects[blobKey(testuser, fresh)].modified = time.Now()
+
+	report, err := s.CollectGarbage(testuser, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unreferenced) != 1 || report.Unreferenced[0] != orphan {
+		t.Errorf("unexpected unreferenced blobs %v", report.Unreferenced)
+	}
+	for _, hash := range []string{file, docIndex, rootIndex, fresh, rootFile} {
+		if bucket.objects[blobKey(testuser, hash)] == nil {
+			t.Errorf("%s was removed", hash)
+		}
+	}
+	if bucket.objects[blobKey(testuser, orphan)] != nil {
+		t.Error("orphan was not removed")
+	}
+}
@@ -0,0 +1,111 @@
+package s3
+
+import (
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// trashKey the key of a trashed file of the user
+func trashKey(uid, name string) string {
+	return userPrefix(uid) + trashDir + "/" + path.Base(path.Clean("/"+name))
+}
+
+// GetTrash the documents in the trash folder, the metadata was copied there
+// when the document was trashed
+func (s *Storage) GetTrash(uid string) ([]*storage.TrashedDocument, error) {
+	result := []*storage.TrashedDocument{}
+	objects, err := s.client.ListObjects(userPrefix(uid)+trashDir+"/", "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		name := path.Base(o.Key)
+		if path.Ext(name) != models.MetadataFileExt {
+			continue
+		}
+		metadata := &messages.RawMetadata{}
+		err = s.getJSON(o.Key, metadata)
+		if err != nil {
+			log.Warn("cannot read trashed ", name, ": ", err)
+			continue
+		}
+		result = append(result, &storage.TrashedDocument{
+			ID:      strings.TrimSuffix(name, models.MetadataFileExt),
+			Name:    metadata.VissibleName,
+			Type:    metadata.Type,
+			Trashed: o.LastModified,
+		})
+	}
+	return result, nil
+}
+
+// RestoreDocument moves a document from the trash folder back to the root
+func (s *Storage) RestoreDocument(uid, id string) error {
+	metaKey := trashKey(uid, id+models.MetadataFileExt)
+	metadata := &messages.RawMetadata{}
+	err := s.getJSON(metaKey, metadata)
+	if err != nil {
+		return err
+	}
+	if _, err = s.client.HeadObject(userKey(uid, id+models.MetadataFileExt)); err == nil {
+		return storage.ErrorExists
+	}
+
+	zipKey := trashKey(uid, id+models.ZipFileExt)
+	err = s.client.CopyObject(zipKey, userKey(uid, id+models.ZipFileExt))
+	if err != nil && err != storage.ErrorNotFound {
+		return err
+	}
+	if err == nil {
+		err = s.client.DeleteObject(zipKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the former parent may be gone
+	metadata.Parent = ""
+	storage.NextVersion(metadata)
+	err = s.UpdateMetadata(uid, metadata)
+	if err != nil {
+		return err
+	}
+	return s.deleteObject(uid, metaKey)
+}
+
+// PurgeDocument deletes a document from the trash folder
+func (s *Storage) PurgeDocument(uid, id string) error {
+	metaKey := trashKey(uid, id+models.MetadataFileExt)
+	if _, err := s.client.HeadObject(metaKey); err != nil {
+		return err
+	}
+	err := s.deleteObject(uid, trashKey(uid, id+models.ZipFileExt))
+	if err != nil && err != storage.ErrorNotFound {
+		return err
+	}
+	err = s.removeVersions(uid, id)
+	if err != nil {
+		return err
+	}
+	log.Info("purged ", id)
+	return s.deleteObject(uid, metaKey)
+}
+
+// deleteObject removes an object of the user and records the size change
+func (s *Storage) deleteObject(uid, key string) error {
+	info, err := s.client.HeadObject(key)
+	if err != nil {
+		return err
+	}
+	err = s.client.DeleteObject(key)
+	if err != nil {
+		return err
+	}
+	s.usage.Add(uid, -info.Size)
+	return nil
+}
@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"io"
+	"strings"
+)
+
+// GetUsage the bytes stored by the user
+func (s *Storage) GetUsage(uid string) (int64, error) {
+	return s.usage.Get(uid)
+}
+
+// calculateUsage sums the objects of the user, except the caches
+func (s *Storage) calculateUsage(uid string) (int64, error) {
+	objects, err := s.client.ListObjects(userPrefix(uid), "")
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, o := range objects {
+		if strings.HasPrefix(o.Key, userPrefix(uid)+cacheDir+"/") {
+			continue
+		}
+		used += o.Size
+	}
+	return used, nil
+}
+
+// putObject writes an object of the user and records the size change
+func (s *Storage) putObject(uid, key string, body io.Reader, size int64) error {
+	if size < 0 {
+		spooled, n, err := spool(body)
+		if err != nil {
+			return err
+		}
+		defer spooled.Close()
+		body, size = spooled, n
+	}
+
+	var before int64
+	if info, err := s.client.HeadObject(key); err == nil {
+		before = info.Size
+	}
+	_, err := s.client.PutObject(key, body, size, PutOptions{})
+	if err != nil {
+		return err
+	}
+	s.usage.Add(uid, size-before)
+	return nil
+}
@@ -0,0 +1,129 @@
+package s3
+
+import (
+	"io"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/common"
+	"github.com/zgs225/rmfakecloud/internal/messages"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// versionsPrefix the previous versions of a sync 1.0 document
+func versionsPrefix(uid, id string) string {
+	return userPrefix(uid) + versionsDir + "/" + common.Sanitize(id) + "/"
+}
+
+// keepVersion copies the current content of the document into its versions
+// before it is replaced, with the version of the current metadata
+func (s *Storage) keepVersion(uid, id string) error {
+	if s.cfg.DocumentVersions <= 0 {
+		return nil
+	}
+	current := userKey(uid, id+models.ZipFileExt)
+	info, err := s.client.HeadObject(current)
+	if err == storage.ErrorNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	version := 0
+	if metadata, err := s.GetMetadata(uid, id); err == nil {
+		version = metadata.Version
+	}
+	err = s.client.CopyObject(current, versionsPrefix(uid, id)+storage.VersionID(version, time.Now())+models.ZipFileExt)
+	if err != nil {
+		return err
+	}
+	s.usage.Add(uid, info.Size)
+	return nil
+}
+
+// pruneVersions removes the oldest versions of the document beyond the ones kept
+func (s *Storage) pruneVersions(uid, id string) error {
+	versions, err := s.GetDocumentVersions(uid, id)
+	if err != nil || len(versions) <= s.cfg.DocumentVersions {
+		return err
+	}
+	for _, v := range versions[s.cfg.DocumentVersions:] {
+		err = s.deleteObject(uid, versionsPrefix(uid, id)+v.ID+models.ZipFileExt)
+		if err != nil {
+			return err
+		}
+		log.Debug("pruned version ", v.ID, " of ", id)
+	}
+	return nil
+}
+
+// removeVersions removes all the versions of a purged document
+func (s *Storage) removeVersions(uid, id string) error {
+	versions, err := s.GetDocumentVersions(uid, id)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		err = s.deleteObject(uid, versionsPrefix(uid, id)+v.ID+models.ZipFileExt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDocumentVersions the previous versions of the document, newest first
+func (s *Storage) GetDocumentVersions(uid, id string) ([]*storage.DocumentVersion, error) {
+	result := []*storage.DocumentVersion{}
+	objects, err := s.client.ListObjects(versionsPrefix(uid, id), "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		version, err := storage.ParseVersionFile(path.Base(o.Key), o.Size)
+		if err != nil {
+			log.Warn("unexpected version object ", o.Key)
+			continue
+		}
+		result = append(result, version)
+	}
+	storage.SortVersions(result)
+	return result, nil
+}
+
+// GetDocumentVersion opens a previous version of the document
+func (s *Storage) GetDocumentVersion(uid, id, versionID string) (io.ReadCloser, error) {
+	if _, _, err := storage.ParseVersionID(versionID); err != nil {
+		return nil, storage.ErrorNotFound
+	}
+	reader, _, err := s.client.GetObject(versionsPrefix(uid, id) + versionID + models.ZipFileExt)
+	return reader, err
+}
+
+// RestoreDocumentVersion stores a previous version as the next version of
+// the document, the one it replaces is kept as a version
+func (s *Storage) RestoreDocumentVersion(uid, id, versionID string) (*messages.RawMetadata, error) {
+	metadata, err := s.GetMetadata(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := s.GetDocumentVersion(uid, id, versionID)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	err = s.StoreDocument(uid, id, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.NextVersion(metadata)
+	err = s.UpdateMetadata(uid, metadata)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("restored version %s of %s as version %d", versionID, id, metadata.Version)
+	return metadata, nil
+}
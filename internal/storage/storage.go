@@ -1,13 +1,33 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/messages"
 	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
 )
 
+// ErrorNotFound not found
+var ErrorNotFound = models.ErrorNotFound
+
+// ErrorWrongGeneration the generation did not match
+var ErrorWrongGeneration = errors.New("wrong generation")
+
+// ErrorExists a document with the id already exists
+var ErrorExists = errors.New("already exists")
+
+// ErrorHashMismatch the content of a blob does not match its hash
+var ErrorHashMismatch = errors.New("content does not match the hash")
+
 // ExportOption type of export
 type ExportOption int
 
@@ -16,24 +36,164 @@ const (
 	ExportOnlyAnnotations
 )
 
+// ExportFormat what a document is exported to
+type ExportFormat struct {
+	// Type pdf, png or svg
+	Type string
+	// DPI the resolution of the rendered pages, not used by pdf
+	DPI int
+}
+
+// String names the exports in the format, with the resolution of the rendered pages
+func (f ExportFormat) String() string {
+	if f.Type == "pdf" || f.DPI <= 0 {
+		return f.Type
+	}
+	return fmt.Sprintf("%ddpi.%s", f.DPI, f.Type)
+}
+
+// maxExportPages bounds the page ranges of an export
+const maxExportPages = 10000
+
+// ExportOptions what is exported of a document
+type ExportOptions struct {
+	// Annotations with or without the background
+	Annotations ExportOption
+	// AnnotatedOnly only the pages with annotations
+	AnnotatedOnly bool
+	// Pages the numbers of the pages, starting at 1, sorted; all when empty
+	Pages []int
+	// PageNumbers the pdf pages are numbered
+	PageNumbers bool
+}
+
+// String names the exports with the options, the defaults are "annotated"
+func (o ExportOptions) String() string {
+	name := "annotated"
+	if o.Annotations == ExportOnlyAnnotations {
+		name = "annotations"
+	}
+	if o.AnnotatedOnly {
+		name += "-annotatedpages"
+	}
+	if len(o.Pages) > 0 {
+		name += "-pages" + FormatPageRanges(o.Pages)
+	}
+	if o.PageNumbers {
+		name += "-numbered"
+	}
+	return name
+}
+
+// GeneratorOptions the options of the exporter
+func (o ExportOptions) GeneratorOptions() exporter.PdfGeneratorOptions {
+	return exporter.PdfGeneratorOptions{
+		AddPageNumbers:  o.PageNumbers,
+		AllPages:        !o.AnnotatedOnly,
+		AnnotationsOnly: o.Annotations == ExportOnlyAnnotations,
+		Pages:           o.Pages,
+	}
+}
+
+// ParsePageRanges the page numbers of ranges like 1-3,5 sorted, without duplicates
+func ParsePageRanges(ranges string) ([]int, error) {
+	selected := map[int]bool{}
+	for _, r := range strings.Split(ranges, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid page range %q", r)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid page range %q", r)
+			}
+		}
+		if first < 1 || last < first || last > maxExportPages {
+			return nil, fmt.Errorf("invalid page range %q", r)
+		}
+		for page := first; page <= last; page++ {
+			selected[page] = true
+		}
+	}
+	pages := make([]int, 0, len(selected))
+	for page := range selected {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+	return pages, nil
+}
+
+// FormatPageRanges the sorted pages as ranges, the reverse of ParsePageRanges
+func FormatPageRanges(pages []int) string {
+	ranges := []string{}
+	for i := 0; i < len(pages); {
+		j := i
+		for j+1 < len(pages) && pages[j+1] == pages[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(pages[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", pages[i], pages[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
 // DocumentStorer stores documents
 type DocumentStorer interface {
 	StoreDocument(uid, docid string, s io.ReadCloser) error
 	RemoveDocument(uid, docid string) error
 	GetDocument(uid, docid string) (io.ReadCloser, error)
-	ExportDocument(uid, docid, outputType string, exportOption ExportOption) (io.ReadCloser, error)
+	ExportDocument(uid, docid string, format ExportFormat, options ExportOptions) (io.ReadCloser, error)
 
 	GetStorageURL(uid, docid string) (string, time.Time, error)
 	CreateDocument(uid, name, parent string, stream io.Reader) (doc *Document, err error)
+	CreateFolder(uid, name, parent string) (doc *Document, err error)
 }
 
 // BlobStorage stuff for sync15
 type BlobStorage interface {
-	GetBlobURL(uid, docid, scope string) (string, time.Time, error)
+	// GetBlobURL the url is issued to the device, which is recorded with the root it uploads
+	GetBlobURL(uid, docid, scope, deviceID string) (string, time.Time, error)
 
 	StoreBlob(uid, blobID string, s io.Reader, matchGeneration int64) (int64, error)
+	StoreRoot(uid, deviceID string, s io.Reader, matchGeneration int64) (int64, error)
 	LoadBlob(uid, blobID string) (reader io.ReadCloser, gen int64, size int64, err error)
 	CreateBlobDocument(uid, name, parent string, stream io.Reader) (doc *Document, err error)
+	CreateBlobFolder(uid, name, parent string) (doc *Document, err error)
+}
+
+// BlobCollector removes sync15 blobs that are no longer referenced
+type BlobCollector interface {
+	CollectGarbage(uid string, keepRoots int, dryRun bool) (*GarbageReport, error)
+}
+
+// BlobChecker verifies the consistency of the sync15 blobs
+type BlobChecker interface {
+	CheckBlobs(uid string, repair bool) (*FsckReport, error)
+}
+
+// TrashStorer manages the documents removed by the sync 1.0 clients, which are
+// kept in the trash of the user until purged
+type TrashStorer interface {
+	GetTrash(uid string) ([]*TrashedDocument, error)
+	RestoreDocument(uid, docid string) error
+	PurgeDocument(uid, docid string) error
+}
+
+// VersionStorer keeps the previous versions of the sync 1.0 documents, which
+// are overwritten each time a device uploads a new version
+type VersionStorer interface {
+	GetDocumentVersions(uid, docid string) ([]*DocumentVersion, error)
+	GetDocumentVersion(uid, docid, versionID string) (io.ReadCloser, error)
+	// RestoreDocumentVersion stores the content of the version as a new
+	// version of the document, the devices will sync it
+	RestoreDocumentVersion(uid, docid, versionID string) (*messages.RawMetadata, error)
 }
 
 // MetadataStorer manages document metadata
@@ -60,3 +220,141 @@ type Document struct {
 	Name    string
 	Version int
 }
+
+// GarbageReport the result of a garbage collection run
+type GarbageReport struct {
+	UserID           string
+	DryRun           bool
+	Scanned          int
+	Referenced       int
+	Unreferenced     []string
+	ReclaimableBytes int64
+}
+
+// TrashedDocument a document removed from the sync
+type TrashedDocument struct {
+	ID      string
+	Name    string
+	Type    string
+	Trashed time.Time
+}
+
+// DocumentVersion a previous version of a sync 1.0 document
+type DocumentVersion struct {
+	// ID the version and when it was replaced, see VersionID
+	ID       string
+	Version  int
+	Replaced time.Time
+	Size     int64
+}
+
+// VersionID identifies the content of a document version, the devices may
+// upload several with the same version
+func VersionID(version int, replaced time.Time) string {
+	return fmt.Sprintf("%d-%d", version, replaced.UnixNano())
+}
+
+// ParseVersionID the version and when it was replaced
+func ParseVersionID(id string) (version int, replaced time.Time, err error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, time.Time{}, fmt.Errorf("invalid version %q", id)
+	}
+	version, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid version %q", id)
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid version %q", id)
+	}
+	return version, time.Unix(0, nanos), nil
+}
+
+// ParseVersionFile the version kept in the file, which is named by its
+// version id
+func ParseVersionFile(name string, size int64) (*DocumentVersion, error) {
+	if path.Ext(name) != models.ZipFileExt {
+		return nil, fmt.Errorf("not a version %q", name)
+	}
+	versionID := strings.TrimSuffix(name, models.ZipFileExt)
+	version, replaced, err := ParseVersionID(versionID)
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentVersion{
+		ID:       versionID,
+		Version:  version,
+		Replaced: replaced,
+		Size:     size,
+	}, nil
+}
+
+// SortVersions sorts the versions newest first
+func SortVersions(versions []*DocumentVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Replaced.After(versions[j].Replaced)
+	})
+}
+
+// NextVersion makes the metadata the next version of the document, for a
+// change made by the server
+func NextVersion(metadata *messages.RawMetadata) {
+	metadata.Version++
+	metadata.ModifiedClient = time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// RootGeneration a published sync15 root
+type RootGeneration struct {
+	Generation int64
+	Timestamp  time.Time
+	Hash       string
+	// DeviceID the device which uploaded the root, empty for the server
+	DeviceID string
+}
+
+// FindGeneration the generation in the history of a root
+func FindGeneration(history []RootGeneration, generation int64) (*RootGeneration, error) {
+	for _, h := range history {
+		if h.Generation == generation {
+			return &h, nil
+		}
+	}
+	return nil, fmt.Errorf("generation %d not found", generation)
+}
+
+// MigrationReport the result of moving a user's documents between the sync versions
+type MigrationReport struct {
+	UserID   string
+	Sync15   bool
+	Migrated int
+	Skipped  []string
+}
+
+// FsckReport the result of a consistency check of a user's sync15 blobs
+type FsckReport struct {
+	UserID     string
+	Repair     bool
+	Root       string
+	Generation int64
+	// Scanned the blobs whose content was hashed
+	Scanned   int
+	Documents int
+	// Corrupt the blobs whose content does not match their hash
+	Corrupt []string
+	// Dangling the index entries whose blob is missing
+	Dangling []string
+	// SizeMismatch the index entries whose size differs from their blob
+	SizeMismatch []string
+	// Unparsable the index blobs which cannot be read
+	Unparsable []string
+	// StaleCache the cached tree does not match the root
+	StaleCache   bool
+	CacheRebuilt bool
+	Quarantined  []string
+}
+
+// Healthy nothing is wrong with the blobs, the cache may still be stale
+func (r *FsckReport) Healthy() bool {
+	return len(r.Corrupt) == 0 && len(r.Dangling) == 0 && len(r.SizeMismatch) == 0 && len(r.Unparsable) == 0
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePageRanges(t *testing.T) {
+	pages, err := ParsePageRanges("5, 1-3,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pages, []int{1, 2, 3, 5}) {
+		t.Errorf("unexpected pages %v", pages)
+	}
+	if ranges := FormatPageRanges(pages); ranges != "1-3,5" {
+		t.Errorf("unexpected ranges %s", ranges)
+	}
+
+	for _, invalid := range []string{"", "0", "3-1", "a", "1-b", "1-100000"} {
+		if _, err := ParsePageRanges(invalid); err == nil {
+			t.Errorf("%q parsed", invalid)
+		}
+	}
+}
+
+func TestExportOptionsName(t *testing.T) {
+	if name := (ExportOptions{}).String(); name != "annotated" {
+		t.Errorf("the default exports are named %s", name)
+	}
+	options := ExportOptions{
+		Annotations:   ExportOnlyAnnotations,
+		AnnotatedOnly: true,
+		Pages:         []int{1, 2, 4},
+		PageNumbers:   true,
+	}
+	if name := options.String(); name != "annotations-annotatedpages-pages1-2,4-numbered" {
+		t.Errorf("unexpected name %s", name)
+	}
+}
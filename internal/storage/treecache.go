@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+// TreeCache keeps the sync15 trees of the most recently used users in memory,
+// the callers get copies, which they are free to change
+type TreeCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cachedTree struct {
+	uid  string
+	tree *models.HashTree
+	// latest the generation of the current root, the tree is stale when behind it
+	latest int64
+}
+
+// NewTreeCache a cache of the trees of up to size users
+func NewTreeCache(size int) *TreeCache {
+	if size < 1 {
+		size = 1
+	}
+	return &TreeCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get a copy of the cached tree of the user, nil when not cached. A stale tree
+// is behind the current root and has to be mirrored before it is used
+func (c *TreeCache) Get(uid string) (tree *models.HashTree, stale bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[uid]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	cached := e.Value.(*cachedTree)
+	if cached.tree == nil {
+		return nil, false
+	}
+	return cached.tree.Clone(), cached.tree.Generation < cached.latest
+}
+
+// Put caches a copy of the tree of the user, a tree older than the cached one
+// is ignored, it was mirrored concurrently
+func (c *TreeCache) Put(uid string, tree *models.HashTree) {
+	clone := tree.Clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entry(uid)
+	if cached.tree != nil && cached.tree.Generation > clone.Generation {
+		return
+	}
+	cached.tree = clone
+	if cached.latest < clone.Generation {
+		cached.latest = clone.Generation
+	}
+}
+
+// Invalidate records that the root of the user changed to the generation,
+// the cached tree is kept to be mirrored incrementally
+func (c *TreeCache) Invalidate(uid string, generation int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entry(uid)
+	if cached.latest < generation {
+		cached.latest = generation
+	}
+}
+
+// Remove drops the tree of the user
+func (c *TreeCache) Remove(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[uid]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, uid)
+	}
+}
+
+// entry the entry of the user, created and the least recently used one evicted if needed
+func (c *TreeCache) entry(uid string) *cachedTree {
+	if e, ok := c.entries[uid]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedTree)
+	}
+	cached := &cachedTree{uid: uid}
+	c.entries[uid] = c.lru.PushFront(cached)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedTree).uid)
+	}
+	return cached
+}
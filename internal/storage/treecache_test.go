@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+func TestTreeCache(t *testing.T) {
+	cache := NewTreeCache(2)
+	cache.Put("a", &models.HashTree{Hash: "a1", Generation: 1})
+	cache.Put("b", &models.HashTree{Hash: "b1", Generation: 1})
+
+	tree, stale := cache.Get("a")
+	if tree == nil || tree.Hash != "a1" || stale {
+		t.Fatalf("unexpected tree %+v %v", tree, stale)
+	}
+
+	// b is the least recently used
+	cache.Put("c", &models.HashTree{Hash: "c1", Generation: 1})
+	if tree, _ = cache.Get("b"); tree != nil {
+		t.Errorf("b not evicted")
+	}
+
+	cache.Invalidate("a", 2)
+	if _, stale = cache.Get("a"); !stale {
+		t.Errorf("a not stale")
+	}
+	// mirrored before the root changed
+	cache.Put("a", &models.HashTree{Hash: "a1", Generation: 1})
+	if _, stale = cache.Get("a"); !stale {
+		t.Errorf("an older tree made a fresh")
+	}
+	cache.Put("a", &models.HashTree{Hash: "a2", Generation: 2})
+	if tree, stale = cache.Get("a"); stale || tree.Hash != "a2" {
+		t.Errorf("unexpected tree %+v %v", tree, stale)
+	}
+
+	// a root stored before the tree was first cached
+	cache.Invalidate("d", 3)
+	cache.Put("d", &models.HashTree{Hash: "d2", Generation: 2})
+	if _, stale = cache.Get("d"); !stale {
+		t.Errorf("d not stale")
+	}
+}
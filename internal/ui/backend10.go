@@ -2,8 +2,10 @@ package ui
 
 import (
 	"io"
+	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/app/hub"
+	"github.com/zgs225/rmfakecloud/internal/messages"
 	"github.com/zgs225/rmfakecloud/internal/storage"
 	"github.com/zgs225/rmfakecloud/internal/storage/models"
 	"github.com/zgs225/rmfakecloud/internal/ui/viewmodel"
@@ -12,7 +14,10 @@ import (
 
 type backend10 struct {
 	documentHandler documentHandler
-	h               *hub.Hub
+	// documents the metadata is written with the user locked, like the
+	// devices do
+	documents *storage.DocumentLocks
+	h         *hub.Hub
 }
 
 func (d *backend10) Sync(uid string) {
@@ -20,6 +25,8 @@ func (d *backend10) Sync(uid string) {
 }
 
 func (d *backend10) CreateDocument(uid, filename, parent string, stream io.Reader) (doc *storage.Document, err error) {
+	docs := d.documents.Lock(uid)
+	defer docs.Unlock()
 	doc, err = d.documentHandler.CreateDocument(uid, filename, parent, stream)
 	if err != nil {
 		return
@@ -37,6 +44,203 @@ func (d *backend10) CreateDocument(uid, filename, parent string, stream io.Reade
 	return
 }
 
+func (d *backend10) CreateFolder(uid, name, parent string) (doc *storage.Document, err error) {
+	docs := d.documents.Lock(uid)
+	defer docs.Unlock()
+
+	documents, err := d.documentHandler.GetAllMetadata(uid)
+	if err != nil {
+		return nil, err
+	}
+	err = checkParent(parent, metadataFolders(documents))
+	if err != nil {
+		return nil, err
+	}
+	doc, err = d.documentHandler.CreateFolder(uid, name, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	ntf := hub.DocumentNotification{
+		ID:      doc.ID,
+		Type:    models.CollectionType,
+		Version: 1,
+		Parent:  parent,
+		Name:    doc.Name,
+	}
+	log.Info(uiLogger, "Created folder id", doc.ID)
+	d.h.Notify(uid, "web", ntf, hub.DocAddedEvent)
+	return doc, nil
+}
+
+// metadataFolders maps the id of every folder to its parent
+func metadataFolders(documents []*messages.RawMetadata) map[string]string {
+	folders := make(map[string]string)
+	for _, m := range documents {
+		if m.Type == models.CollectionType {
+			folders[m.ID] = m.Parent
+		}
+	}
+	return folders
+}
+
+func (d *backend10) UpdateDocument(uid, docID, name string, parent *string) error {
+	docs := d.documents.Lock(uid)
+	defer docs.Unlock()
+	return d.updateDocument(uid, docID, name, parent)
+}
+
+// updateDocument renames or moves the document, with the user locked, a nil
+// parent keeps the parent
+func (d *backend10) updateDocument(uid, docID, name string, parent *string) error {
+	documents, err := d.documentHandler.GetAllMetadata(uid)
+	if err != nil {
+		return err
+	}
+	var doc *messages.RawMetadata
+	for _, m := range documents {
+		if m.ID == docID {
+			doc = m
+		}
+	}
+	if doc == nil {
+		return storage.ErrorNotFound
+	}
+	if parent != nil {
+		err = checkMove(docID, *parent, metadataFolders(documents))
+		if err != nil {
+			return err
+		}
+		doc.Parent = *parent
+	}
+	if name != "" {
+		doc.VissibleName = name
+	}
+	storage.NextVersion(doc)
+	err = d.documentHandler.UpdateMetadata(uid, doc)
+	if err != nil {
+		return err
+	}
+
+	ntf := hub.DocumentNotification{
+		ID:      doc.ID,
+		Type:    doc.Type,
+		Version: doc.Version,
+		Parent:  doc.Parent,
+		Name:    doc.VissibleName,
+	}
+	log.Info(uiLogger, "Updated document id", doc.ID)
+	d.h.Notify(uid, "web", ntf, hub.DocAddedEvent)
+	return nil
+}
+
+func (d *backend10) GetTrash(uid string) ([]*viewmodel.TrashEntry, error) {
+	documents, err := d.documentHandler.GetAllMetadata(uid)
+	if err != nil {
+		return nil, err
+	}
+	trash := []*viewmodel.TrashEntry{}
+	for _, m := range documents {
+		if m.Parent != models.TrashParent {
+			continue
+		}
+		// the metadata was last changed when it was trashed
+		trashed, _ := time.Parse(time.RFC3339Nano, m.ModifiedClient)
+		trash = append(trash, &viewmodel.TrashEntry{
+			ID:      m.ID,
+			Name:    m.VissibleName,
+			Type:    m.Type,
+			Trashed: trashed,
+		})
+	}
+
+	removed, err := d.documentHandler.GetTrash(uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range removed {
+		trash = append(trash, &viewmodel.TrashEntry{
+			ID:      r.ID,
+			Name:    r.Name,
+			Type:    r.Type,
+			Trashed: r.Trashed,
+			Removed: true,
+		})
+	}
+	return trash, nil
+}
+
+func (d *backend10) RestoreDocument(uid, docID string) error {
+	docs := d.documents.Lock(uid)
+	defer docs.Unlock()
+
+	if metadata, err := d.documentHandler.GetMetadata(uid, docID); err == nil {
+		if metadata.Parent != models.TrashParent {
+			return storage.ErrorNotFound
+		}
+		root := ""
+		return d.updateDocument(uid, docID, "", &root)
+	}
+
+	err := d.documentHandler.RestoreDocument(uid, docID)
+	if err != nil {
+		return err
+	}
+	metadata, err := d.documentHandler.GetMetadata(uid, docID)
+	if err != nil {
+		return err
+	}
+	ntf := hub.DocumentNotification{
+		ID:      metadata.ID,
+		Type:    metadata.Type,
+		Version: metadata.Version,
+		Parent:  metadata.Parent,
+		Name:    metadata.VissibleName,
+	}
+	log.Info(uiLogger, "Restored document id", docID)
+	d.h.Notify(uid, "web", ntf, hub.DocAddedEvent)
+	return nil
+}
+
+func (d *backend10) PurgeDocument(uid, docID string) error {
+	docs := d.documents.Lock(uid)
+	defer docs.Unlock()
+
+	documents, err := d.documentHandler.GetAllMetadata(uid)
+	if err != nil {
+		return err
+	}
+	parents := make(map[string]string)
+	for _, m := range documents {
+		parents[m.ID] = m.Parent
+	}
+	if parents[docID] != models.TrashParent {
+		return d.documentHandler.PurgeDocument(uid, docID)
+	}
+
+	// the documents in a trashed folder go with it
+	for _, id := range withDescendants(docID, parents) {
+		err = d.documentHandler.RemoveDocument(uid, id)
+		if err != nil {
+			return err
+		}
+		err = d.documentHandler.PurgeDocument(uid, id)
+		if err != nil {
+			return err
+		}
+		ntf := hub.DocumentNotification{
+			ID: id,
+		}
+		log.Info(uiLogger, "Purged document id", id)
+		d.h.Notify(uid, "web", ntf, hub.DocDeletedEvent)
+	}
+	return nil
+}
+
+func (d *backend10) PurgeTrash(uid string, before time.Time) (int, error) {
+	return purgeTrash(d, uid, before)
+}
+
 func (d *backend10) GetDocumentTree(uid string) (tree *viewmodel.DocumentTree, err error) {
 	documents, err := d.documentHandler.GetAllMetadata(uid)
 	if err != nil {
@@ -45,6 +249,6 @@ func (d *backend10) GetDocumentTree(uid string) (tree *viewmodel.DocumentTree, e
 
 	return viewmodel.DocTreeFromRawMetadata(documents), nil
 }
-func (d *backend10) Export(uid, doc, exporttype string, opt storage.ExportOption) (stream io.ReadCloser, err error) {
-	return d.documentHandler.ExportDocument(uid, doc, exporttype, opt)
+func (d *backend10) Export(uid, doc string, format storage.ExportFormat, options storage.ExportOptions) (stream io.ReadCloser, err error) {
+	return d.documentHandler.ExportDocument(uid, doc, format, options)
 }
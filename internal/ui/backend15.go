@@ -2,9 +2,12 @@ package ui
 
 import (
 	"io"
+	"strconv"
+	"time"
 
 	"github.com/zgs225/rmfakecloud/internal/app/hub"
 	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
 	"github.com/zgs225/rmfakecloud/internal/ui/viewmodel"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -23,8 +26,8 @@ func (b *backend15) GetDocumentTree(uid string) (tree *viewmodel.DocumentTree, e
 
 	return viewmodel.DocTreeFromHashTree(hashTree), nil
 }
-func (b *backend15) Export(uid, docid, exporttype string, opt storage.ExportOption) (r io.ReadCloser, err error) {
-	r, err = b.blobHandler.Export(uid, docid)
+func (b *backend15) Export(uid, docid string, format storage.ExportFormat, options storage.ExportOptions) (r io.ReadCloser, err error) {
+	r, err = b.blobHandler.Export(uid, docid, format, options)
 	return
 }
 
@@ -33,6 +36,148 @@ func (b *backend15) CreateDocument(uid, filename, parent string, stream io.Reade
 	return
 }
 
+func (b *backend15) CreateFolder(uid, name, parent string) (doc *storage.Document, err error) {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	err = checkParent(parent, treeFolders(tree))
+	if err != nil {
+		return nil, err
+	}
+	return b.blobHandler.CreateBlobFolder(uid, name, parent)
+}
+
+// treeFolders maps the id of every folder of the tree to its parent
+func treeFolders(tree *models.HashTree) map[string]string {
+	folders := make(map[string]string)
+	for _, d := range tree.Docs {
+		if d.CollectionType == models.CollectionType {
+			folders[d.EntryName] = d.Parent
+		}
+	}
+	return folders
+}
+
+func (b *backend15) UpdateDocument(uid, docID, name string, parent *string) error {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return err
+	}
+	doc, err := tree.FindDoc(docID)
+	if err != nil {
+		return storage.ErrorNotFound
+	}
+	if parent != nil {
+		err = checkMove(docID, *parent, treeFolders(tree))
+		if err != nil {
+			return err
+		}
+		doc.Parent = *parent
+	}
+	if name != "" {
+		doc.DocumentName = name
+	}
+	doc.Version++
+	doc.LastModified = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	doc.MetadataModified = true
+	return b.blobHandler.UpdateBlobDocument(uid, tree, doc)
+}
+
+func (b *backend15) GetTrash(uid string) ([]*viewmodel.TrashEntry, error) {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return nil, err
+	}
+	trash := []*viewmodel.TrashEntry{}
+	for _, d := range tree.Docs {
+		if d.Parent != models.TrashParent {
+			continue
+		}
+		trash = append(trash, &viewmodel.TrashEntry{
+			ID:      d.EntryName,
+			Name:    d.DocumentName,
+			Type:    d.CollectionType,
+			Trashed: lastModified(d),
+		})
+	}
+	return trash, nil
+}
+
+// lastModified when the metadata was changed, the last time it was trashed
+func lastModified(d *models.HashDoc) time.Time {
+	millis, err := strconv.ParseInt(d.LastModified, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
+
+func (b *backend15) RestoreDocument(uid, docID string) error {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return err
+	}
+	doc, err := tree.FindDoc(docID)
+	if err != nil || doc.Parent != models.TrashParent {
+		return storage.ErrorNotFound
+	}
+	doc.Parent = ""
+	doc.Version++
+	doc.LastModified = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	doc.MetadataModified = true
+	return b.blobHandler.UpdateBlobDocument(uid, tree, doc)
+}
+
+func (b *backend15) PurgeDocument(uid, docID string) error {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return err
+	}
+	doc, err := tree.FindDoc(docID)
+	if err != nil || doc.Parent != models.TrashParent {
+		return storage.ErrorNotFound
+	}
+	// the documents in a trashed folder go with it
+	return b.blobHandler.RemoveBlobDocuments(uid, tree, withDescendants(docID, treeParents(tree))...)
+}
+
+func (b *backend15) PurgeTrash(uid string, before time.Time) (int, error) {
+	tree, err := b.blobHandler.GetTree(uid)
+	if err != nil {
+		return 0, err
+	}
+	parents := treeParents(tree)
+	expired := []string{}
+	purged := 0
+	for _, d := range tree.Docs {
+		trashed := lastModified(d)
+		if d.Parent != models.TrashParent || trashed.IsZero() || !trashed.Before(before) {
+			continue
+		}
+		expired = append(expired, withDescendants(d.EntryName, parents)...)
+		purged++
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	err = b.blobHandler.RemoveBlobDocuments(uid, tree, expired...)
+	if err != nil {
+		return 0, err
+	}
+	b.Sync(uid)
+	return purged, nil
+}
+
+// treeParents maps every document of the tree to its parent
+func treeParents(tree *models.HashTree) map[string]string {
+	parents := make(map[string]string)
+	for _, d := range tree.Docs {
+		parents[d.EntryName] = d.Parent
+	}
+	return parents
+}
+
 func (b *backend15) Sync(uid string) {
 	logrus.Info("notifying")
 	b.h.NotifySync(uid, uuid.NewString())
@@ -0,0 +1,79 @@
+package ui
+
+import (
+	"testing"
+
+	"github.com/zgs225/rmfakecloud/internal/app/hub"
+	"github.com/zgs225/rmfakecloud/internal/config"
+	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/fs"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+func TestRenameKeepsTheParent(t *testing.T) {
+	testuser := "test"
+	storer := fs.NewStorage(&config.Config{DataDir: t.TempDir()})
+	user, err := model.NewUser(testuser, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storer.RegisterUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hub.NewHub()
+	sync10 := &backend10{documentHandler: storer, documents: storage.NewDocumentLocks(), h: h}
+	sync15 := &backend15{blobHandler: storer, h: h}
+	parentOf := map[string]func(docID string) string{
+		"sync10": func(docID string) string {
+			metadata, err := storer.GetMetadata(testuser, docID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return metadata.Parent
+		},
+		"sync15": func(docID string) string {
+			tree, err := storer.GetTree(testuser)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := tree.FindDoc(docID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return doc.Parent
+		},
+	}
+
+	for name, b := range map[string]backend{"sync10": sync10, "sync15": sync15} {
+		folder, err := b.CreateFolder(testuser, "folder", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := b.CreateFolder(testuser, "doc", folder.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.UpdateDocument(testuser, doc.ID, "renamed", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent := parentOf[name](doc.ID); parent != folder.ID {
+			t.Errorf("%s: the renamed document moved to %q", name, parent)
+		}
+
+		trash := models.TrashParent
+		err = b.UpdateDocument(testuser, doc.ID, "", &trash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = b.UpdateDocument(testuser, doc.ID, "trashed", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent := parentOf[name](doc.ID); parent != models.TrashParent {
+			t.Errorf("%s: the renamed document left the trash for %q", name, parent)
+		}
+	}
+}
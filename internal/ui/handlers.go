@@ -1,17 +1,25 @@
 package ui
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/zgs225/rmfakecloud/internal/common"
-	"github.com/zgs225/rmfakecloud/internal/model"
-	"github.com/zgs225/rmfakecloud/internal/ui/viewmodel"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
+	"github.com/zgs225/rmfakecloud/internal/app/hub"
+	"github.com/zgs225/rmfakecloud/internal/common"
+	"github.com/zgs225/rmfakecloud/internal/model"
+	"github.com/zgs225/rmfakecloud/internal/storage"
+	"github.com/zgs225/rmfakecloud/internal/storage/exporter"
+	"github.com/zgs225/rmfakecloud/internal/storage/migration"
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+	"github.com/zgs225/rmfakecloud/internal/ui/viewmodel"
 )
 
 const (
@@ -22,6 +30,17 @@ const (
 	uiLogger            = "[ui] "
 	useridParam         = "userid"
 	cookieName          = ".Authrmfakecloud"
+	dryRunParam         = "dryrun"
+	repairParam         = "repair"
+	generationParam     = "generation"
+	versionParam        = "version"
+	formatParam         = "format"
+	dpiParam            = "dpi"
+	annotationsParam    = "annotationsonly"
+	annotatedParam      = "annotatedpages"
+	pagesParam          = "pages"
+	pageNumbersParam    = "pagenumbers"
+	migrateToParam      = "to"
 )
 
 func (app *ReactAppWrapper) register(c *gin.Context) {
@@ -221,6 +240,35 @@ func (app *ReactAppWrapper) newCode(c *gin.Context) {
 	c.JSON(http.StatusOK, code)
 }
 
+func (app *ReactAppWrapper) getProfile(c *gin.Context) {
+	uid := c.GetString(userIDContextKey)
+
+	user, err := app.userStorer.GetUser(uid)
+	if err != nil {
+		log.Error("Unable to find user: ", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	profile := &viewmodel.User{
+		ID:        user.ID,
+		Email:     user.Email,
+		Name:      user.Name,
+		CreatedAt: user.CreatedAt,
+	}
+	for _, i := range user.Integrations {
+		profile.Integrations = append(profile.Integrations, i.Name)
+	}
+	profile.Usage, profile.Quota, err = app.quota.Usage(uid)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
 func getBackend(c *gin.Context) backend {
 	blah, ok := c.Get("backend")
 	if !ok {
@@ -246,9 +294,43 @@ func (app *ReactAppWrapper) listDocuments(c *gin.Context) {
 func (app *ReactAppWrapper) getDocument(c *gin.Context) {
 	uid := c.GetString(userIDContextKey)
 	docid := common.ParamS(docIDParam, c)
-	log.Info("exporting ", docid)
+	format := storage.ExportFormat{
+		Type: c.DefaultQuery(formatParam, exporter.FormatPDF),
+		DPI:  exporter.DefaultDPI,
+	}
+	if !exporter.IsFormat(format.Type) {
+		badReq(c, "the format has to be pdf, png or svg")
+		return
+	}
+	if dpi := c.Query(dpiParam); dpi != "" {
+		var err error
+		format.DPI, err = strconv.Atoi(dpi)
+		if err != nil || format.DPI < 1 || format.DPI > exporter.MaxDPI {
+			badReq(c, fmt.Sprintf("the dpi has to be between 1 and %d", exporter.MaxDPI))
+			return
+		}
+	}
+	options := storage.ExportOptions{}
+	if annotationsOnly, _ := strconv.ParseBool(c.Query(annotationsParam)); annotationsOnly {
+		options.Annotations = storage.ExportOnlyAnnotations
+	}
+	options.AnnotatedOnly, _ = strconv.ParseBool(c.Query(annotatedParam))
+	options.PageNumbers, _ = strconv.ParseBool(c.Query(pageNumbersParam))
+	if pages := c.Query(pagesParam); pages != "" {
+		var err error
+		options.Pages, err = storage.ParsePageRanges(pages)
+		if err != nil {
+			badReq(c, err.Error())
+			return
+		}
+	}
+	log.Info("exporting ", docid, " as ", format, " ", options)
 	backend := getBackend(c)
-	reader, err := backend.Export(uid, docid, "pdf", 0)
+	reader, err := backend.Export(uid, docid, format, options)
+	if errors.Is(err, exporter.ErrorNoPages) {
+		badReq(c, err.Error())
+		return
+	}
 	if err != nil {
 		log.Error(err)
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -256,7 +338,23 @@ func (app *ReactAppWrapper) getDocument(c *gin.Context) {
 	}
 
 	defer reader.Close()
-	c.DataFromReader(http.StatusOK, -1, "application/octet-stream", reader, nil)
+	buffered := bufio.NewReader(reader)
+	c.DataFromReader(http.StatusOK, -1, exportContentType(format.Type, buffered), buffered, nil)
+}
+
+// exportContentType the type of the export, the pages rendered as images
+// are zipped when there are several
+func exportContentType(format string, r *bufio.Reader) string {
+	if format == exporter.FormatPDF {
+		return "application/octet-stream"
+	}
+	if magic, _ := r.Peek(4); string(magic) == "PK\x03\x04" {
+		return "application/zip"
+	}
+	if format == exporter.FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
 }
 
 func (app *ReactAppWrapper) updateDocument(c *gin.Context) {
@@ -266,17 +364,169 @@ func (app *ReactAppWrapper) updateDocument(c *gin.Context) {
 		badReq(c, err.Error())
 		return
 	}
-	// uid := c.GetString(userID)
-	// docid := c.Param("docid")
+	uid := c.GetString(userIDContextKey)
+	log.Info(uiLogger, "updating document ", upd.DocumentID)
 
+	backend := getBackend(c)
+	err := backend.UpdateDocument(uid, upd.DocumentID, upd.Name, upd.ParentID)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	backend.Sync(uid)
 	c.Status(http.StatusOK)
 }
+
+// abortOnDocumentError aborts with the status of the error, if any
+func abortOnDocumentError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case storage.ErrorNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errorNotAFolder, errorMoveCycle:
+		badReq(c, err.Error())
+	case storage.ErrorWrongGeneration, storage.ErrorExists:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+	return true
+}
+
+// deleteDocument moves the document to the trash
 func (app *ReactAppWrapper) deleteDocument(c *gin.Context) {
-	// uid := c.GetString(userID)
-	// docid := c.Param("docid")
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+	log.Info(uiLogger, "trashing document ", docid)
+
+	backend := getBackend(c)
+	trash := models.TrashParent
+	err := backend.UpdateDocument(uid, docid, "", &trash)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	backend.Sync(uid)
+	c.Status(http.StatusOK)
+}
+
+func (app *ReactAppWrapper) listTrash(c *gin.Context) {
+	uid := c.GetString(userIDContextKey)
+	trash, err := getBackend(c).GetTrash(uid)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, trash)
+}
+
+func (app *ReactAppWrapper) restoreDocument(c *gin.Context) {
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+	log.Info(uiLogger, "restoring document ", docid)
+
+	backend := getBackend(c)
+	err := backend.RestoreDocument(uid, docid)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	backend.Sync(uid)
+	c.Status(http.StatusOK)
+}
+
+// purgeDocument deletes a trashed document for good
+func (app *ReactAppWrapper) purgeDocument(c *gin.Context) {
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+	log.Info(uiLogger, "purging document ", docid)
 
+	backend := getBackend(c)
+	err := backend.PurgeDocument(uid, docid)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	backend.Sync(uid)
 	c.Status(http.StatusOK)
 }
+
+// abortOnSync15 the sync 1.5 documents have no versions, their roots have a history
+func abortOnSync15(c *gin.Context) bool {
+	if c.GetBool(isSync15Key) {
+		badReq(c, "versions are only kept for sync 1.0 documents")
+		return true
+	}
+	return false
+}
+
+func (app *ReactAppWrapper) listDocumentVersions(c *gin.Context) {
+	if abortOnSync15(c) {
+		return
+	}
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+
+	versions, err := app.documentHandler.GetDocumentVersions(uid, docid)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	result := make([]viewmodel.DocumentVersion, 0, len(versions))
+	for _, v := range versions {
+		result = append(result, viewmodel.DocumentVersion{
+			ID:       v.ID,
+			Version:  v.Version,
+			Replaced: v.Replaced,
+			Size:     v.Size,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// getDocumentVersion downloads the zip of a previous version
+func (app *ReactAppWrapper) getDocumentVersion(c *gin.Context) {
+	if abortOnSync15(c) {
+		return
+	}
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+	version := common.ParamS(versionParam, c)
+
+	reader, err := app.documentHandler.GetDocumentVersion(uid, docid, version)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	defer reader.Close()
+	c.DataFromReader(http.StatusOK, -1, "application/zip", reader, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s-%s.zip"`, docid, version),
+	})
+}
+
+func (app *ReactAppWrapper) restoreDocumentVersion(c *gin.Context) {
+	if abortOnSync15(c) {
+		return
+	}
+	uid := c.GetString(userIDContextKey)
+	docid := common.ParamS(docIDParam, c)
+	version := common.ParamS(versionParam, c)
+	log.Info(uiLogger, "restoring version ", version, " of ", docid)
+
+	docs := app.documents.Lock(uid)
+	metadata, err := app.documentHandler.RestoreDocumentVersion(uid, docid, version)
+	docs.Unlock()
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	ntf := hub.DocumentNotification{
+		ID:      metadata.ID,
+		Type:    metadata.Type,
+		Version: metadata.Version,
+		Parent:  metadata.Parent,
+		Name:    metadata.VissibleName,
+	}
+	app.h.Notify(uid, "web", ntf, hub.DocAddedEvent)
+	c.JSON(http.StatusOK, gin.H{"version": metadata.Version})
+}
+
 func (app *ReactAppWrapper) createDocument(c *gin.Context) {
 	uid := c.GetString(userIDContextKey)
 	_ = c.GetBool(isSync15Key)
@@ -296,6 +546,14 @@ func (app *ReactAppWrapper) createDocument(c *gin.Context) {
 	}
 	log.Info("Parent: " + parentID)
 
+	var size int64
+	for _, file := range form.File["file"] {
+		size += file.Size
+	}
+	if !common.CheckQuota(c, app.quota, uid, size) {
+		return
+	}
+
 	for _, file := range form.File["file"] {
 		f, err := file.Open()
 		if err != nil {
@@ -319,6 +577,29 @@ func (app *ReactAppWrapper) createDocument(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
+func (app *ReactAppWrapper) createFolder(c *gin.Context) {
+	folder := viewmodel.NewFolder{}
+	if err := c.ShouldBindJSON(&folder); err != nil {
+		log.Error(err)
+		badReq(c, err.Error())
+		return
+	}
+	uid := c.GetString(userIDContextKey)
+	log.Info(uiLogger, "creating folder ", folder.Name, " in: ", folder.ParentID)
+
+	backend := getBackend(c)
+	doc, err := backend.CreateFolder(uid, folder.Name, folder.ParentID)
+	if abortOnDocumentError(c, err) {
+		return
+	}
+	backend.Sync(uid)
+	c.JSON(http.StatusOK, &viewmodel.Directory{
+		ID:      doc.ID,
+		Name:    doc.Name,
+		Entries: []viewmodel.Entry{},
+	})
+}
+
 func (app *ReactAppWrapper) getAppUsers(c *gin.Context) {
 	// Try to find the user
 	users, err := app.userStorer.GetUsers()
@@ -337,6 +618,10 @@ func (app *ReactAppWrapper) getAppUsers(c *gin.Context) {
 			Name:      u.Name,
 			CreatedAt: u.CreatedAt,
 		}
+		usr.Usage, usr.Quota, err = app.quota.Usage(u.ID)
+		if err != nil {
+			log.Warn(uiLogger, "no usage for ", u.ID, " ", err)
+		}
 		uilist = append(uilist, usr)
 	}
 	c.JSON(http.StatusOK, uilist)
@@ -403,6 +688,10 @@ func (app *ReactAppWrapper) updateUser(c *gin.Context) {
 		user.Email = req.Email
 	}
 
+	if req.NewQuota != nil {
+		user.Quota = *req.NewQuota
+	}
+
 	err = app.userStorer.UpdateUser(user)
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -451,3 +740,194 @@ func (app *ReactAppWrapper) createUser(c *gin.Context) {
 	}
 	c.Status(http.StatusCreated)
 }
+
+func (app *ReactAppWrapper) collectGarbage(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query(dryRunParam))
+
+	var uids []string
+	if uid := c.Query(useridParam); uid != "" {
+		uids = append(uids, uid)
+	} else {
+		users, err := app.userStorer.GetUsers()
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, u := range users {
+			if u.Sync15 {
+				uids = append(uids, u.ID)
+			}
+		}
+	}
+
+	reports := make([]viewmodel.GarbageReport, 0)
+	for _, uid := range uids {
+		report, err := app.blobHandler.CollectGarbage(uid, app.cfg.GCKeepRoots, dryRun)
+		if err != nil {
+			log.Error(uiLogger, "gc ", uid, " ", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, viewmodel.GarbageReport{
+			UserID:           report.UserID,
+			DryRun:           report.DryRun,
+			Scanned:          report.Scanned,
+			Referenced:       report.Referenced,
+			Unreferenced:     report.Unreferenced,
+			ReclaimableBytes: report.ReclaimableBytes,
+		})
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+func (app *ReactAppWrapper) checkBlobs(c *gin.Context) {
+	repair, _ := strconv.ParseBool(c.Query(repairParam))
+
+	var uids []string
+	if uid := c.Query(useridParam); uid != "" {
+		uids = append(uids, uid)
+	} else {
+		users, err := app.userStorer.GetUsers()
+		if err != nil {
+			log.Error(err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, u := range users {
+			if u.Sync15 {
+				uids = append(uids, u.ID)
+			}
+		}
+	}
+
+	reports := make([]viewmodel.FsckReport, 0)
+	for _, uid := range uids {
+		report, err := app.blobHandler.CheckBlobs(uid, repair)
+		if err != nil {
+			log.Error(uiLogger, "fsck ", uid, " ", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, viewmodel.FsckReport{
+			UserID:       report.UserID,
+			Repair:       report.Repair,
+			Healthy:      report.Healthy(),
+			Root:         report.Root,
+			Generation:   report.Generation,
+			Scanned:      report.Scanned,
+			Documents:    report.Documents,
+			Corrupt:      report.Corrupt,
+			Dangling:     report.Dangling,
+			SizeMismatch: report.SizeMismatch,
+			Unparsable:   report.Unparsable,
+			StaleCache:   report.StaleCache,
+			CacheRebuilt: report.CacheRebuilt,
+			Quarantined:  report.Quarantined,
+		})
+	}
+	c.JSON(http.StatusOK, reports)
+}
+
+func (app *ReactAppWrapper) listRootHistory(c *gin.Context) {
+	uid := c.Param(useridParam)
+
+	history, err := app.blobHandler.RootHistory(uid)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]viewmodel.RootGeneration, 0, len(history))
+	for _, h := range history {
+		result = append(result, viewmodel.RootGeneration{
+			Generation: h.Generation,
+			Timestamp:  h.Timestamp,
+			Hash:       h.Hash,
+			DeviceID:   h.DeviceID,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (app *ReactAppWrapper) getGenerationDocuments(c *gin.Context) {
+	uid := c.Param(useridParam)
+	generation, err := strconv.ParseInt(c.Param(generationParam), 10, 64)
+	if err != nil {
+		badReq(c, "invalid generation")
+		return
+	}
+
+	tree, err := app.blobHandler.GetTreeAt(uid, generation)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, viewmodel.DocTreeFromHashTree(tree))
+}
+
+func (app *ReactAppWrapper) restoreGeneration(c *gin.Context) {
+	uid := c.Param(useridParam)
+	generation, err := strconv.ParseInt(c.Param(generationParam), 10, 64)
+	if err != nil {
+		badReq(c, "invalid generation")
+		return
+	}
+
+	newGeneration, err := app.blobHandler.RestoreRoot(uid, generation)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	app.h.NotifySync(uid, uuid.NewString())
+	c.JSON(http.StatusOK, gin.H{"generation": newGeneration})
+}
+
+func (app *ReactAppWrapper) migrateUser(c *gin.Context) {
+	uid := c.Param(useridParam)
+	to := c.Query(migrateToParam)
+	if to != "10" && to != "15" {
+		badReq(c, "the target sync version has to be 10 or 15")
+		return
+	}
+
+	user, err := app.userStorer.GetUser(uid)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatusJSON(http.StatusNotFound, "Invalid user")
+		return
+	}
+
+	var report *storage.MigrationReport
+	if to == "15" {
+		report, err = migration.ToSync15(uid, app.documentHandler, app.blobHandler)
+	} else {
+		report, err = migration.ToSync10(uid, app.documentHandler, app.blobHandler, app.documents)
+	}
+	if err != nil {
+		log.Error(uiLogger, "migrate ", uid, " ", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.Sync15 = report.Sync15
+	err = app.userStorer.UpdateUser(user)
+	if err != nil {
+		log.Error(err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if report.Sync15 {
+		app.h.NotifySync(uid, uuid.NewString())
+	}
+
+	c.JSON(http.StatusOK, viewmodel.MigrationReport{
+		UserID:   report.UserID,
+		Sync15:   report.Sync15,
+		Migrated: report.Migrated,
+		Skipped:  report.Skipped,
+	})
+}
@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"errors"
+	"time"
+
+	"github.com/zgs225/rmfakecloud/internal/storage/models"
+)
+
+var (
+	errorNotAFolder = errors.New("the parent is not a folder")
+	errorMoveCycle  = errors.New("a folder cannot be moved into itself")
+)
+
+// checkMove whether the document can be moved to the parent, folders maps
+// the id of every folder to its parent
+func checkMove(docID, parent string, folders map[string]string) error {
+	seen := make(map[string]bool)
+	for id := parent; id != "" && id != models.TrashParent; id = folders[id] {
+		if id == docID || seen[id] {
+			return errorMoveCycle
+		}
+		if _, ok := folders[id]; !ok {
+			return errorNotAFolder
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// checkParent whether a new document can be created in the parent, the root or a folder
+func checkParent(parent string, folders map[string]string) error {
+	if parent == models.TrashParent {
+		return errorNotAFolder
+	}
+	return checkMove("", parent, folders)
+}
+
+// withDescendants the document followed by everything in it, parents maps
+// the id of every document to its parent
+func withDescendants(docID string, parents map[string]string) []string {
+	children := make(map[string][]string)
+	for id, parent := range parents {
+		children[parent] = append(children[parent], id)
+	}
+	result := []string{}
+	seen := make(map[string]bool)
+	queue := []string{docID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+		queue = append(queue, children[id]...)
+	}
+	return result
+}
+
+// purgeTrash purges the documents trashed before the time, one by one
+func purgeTrash(b backend, uid string, before time.Time) (int, error) {
+	trash, err := b.GetTrash(uid)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, t := range trash {
+		if t.Trashed.IsZero() || !t.Trashed.Before(before) {
+			continue
+		}
+		err = b.PurgeDocument(uid, t.ID)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -49,7 +49,7 @@ func (app *ReactAppWrapper) RegisterRoutes(router *gin.Engine) {
 	})
 
 	auth.GET("newcode", app.newCode)
-	auth.GET("profile", app.newCode)
+	auth.GET("profile", app.getProfile)
 	auth.POST("changePassword", app.changePassword)
 	auth.POST("changeEmail", app.changePassword)
 
@@ -57,8 +57,15 @@ func (app *ReactAppWrapper) RegisterRoutes(router *gin.Engine) {
 	auth.GET("documents/:docid", app.getDocument)
 	auth.POST("documents/upload", app.createDocument)
 	auth.DELETE("documents/:docid", app.deleteDocument)
+	auth.GET("documents/:docid/versions", app.listDocumentVersions)
+	auth.GET("documents/:docid/versions/:version", app.getDocumentVersion)
+	auth.POST("documents/:docid/versions/:version/restore", app.restoreDocumentVersion)
 	//move, rename
 	auth.PUT("documents", app.updateDocument)
+	auth.POST("folders", app.createFolder)
+	auth.GET("trash", app.listTrash)
+	auth.POST("trash/:docid/restore", app.restoreDocument)
+	auth.DELETE("trash/:docid", app.purgeDocument)
 
 	//admin
 	admin := auth.Group("")
@@ -68,4 +75,10 @@ func (app *ReactAppWrapper) RegisterRoutes(router *gin.Engine) {
 	admin.PUT("users", app.updateUser)
 	admin.POST("users", app.createUser)
 	admin.GET("users", app.getAppUsers)
+	admin.POST("gc", app.collectGarbage)
+	admin.POST("fsck", app.checkBlobs)
+	admin.GET("users/:userid/history", app.listRootHistory)
+	admin.GET("users/:userid/history/:generation", app.getGenerationDocuments)
+	admin.POST("users/:userid/history/:generation/restore", app.restoreGeneration)
+	admin.POST("users/:userid/migrate", app.migrateUser)
 }
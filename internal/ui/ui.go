@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"path"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/zgs225/rmfakecloud/internal/app/hub"
@@ -19,8 +20,14 @@ import (
 
 type backend interface {
 	GetDocumentTree(uid string) (tree *viewmodel.DocumentTree, err error)
-	Export(uid, doc, exporttype string, opt storage.ExportOption) (stream io.ReadCloser, err error)
+	Export(uid, doc string, format storage.ExportFormat, options storage.ExportOptions) (stream io.ReadCloser, err error)
 	CreateDocument(uid, name, parent string, stream io.Reader) (doc *storage.Document, err error)
+	CreateFolder(uid, name, parent string) (doc *storage.Document, err error)
+	UpdateDocument(uid, docID, name string, parent *string) error
+	GetTrash(uid string) ([]*viewmodel.TrashEntry, error)
+	RestoreDocument(uid, docID string) error
+	PurgeDocument(uid, docID string) error
+	PurgeTrash(uid string, before time.Time) (int, error)
 	Sync(uid string)
 }
 type codeGenerator interface {
@@ -29,14 +36,32 @@ type codeGenerator interface {
 
 type documentHandler interface {
 	CreateDocument(uid, name, parent string, stream io.Reader) (doc *storage.Document, err error)
+	CreateFolder(uid, name, parent string) (doc *storage.Document, err error)
 	GetAllMetadata(uid string) (do []*messages.RawMetadata, err error)
-	ExportDocument(uid, id, format string, exportOption storage.ExportOption) (stream io.ReadCloser, err error)
+	ExportDocument(uid, id string, format storage.ExportFormat, options storage.ExportOptions) (stream io.ReadCloser, err error)
+	UpdateMetadata(uid string, r *messages.RawMetadata) error
+	GetMetadata(uid, docid string) (*messages.RawMetadata, error)
+	RemoveDocument(uid, docid string) error
+	storage.TrashStorer
+	storage.VersionStorer
+	GetDocument(uid, docid string) (io.ReadCloser, error)
+	StoreDocument(uid, docid string, s io.ReadCloser) error
 }
 
 type blobHandler interface {
 	GetTree(uid string) (tree *models.HashTree, err error)
 	CreateBlobDocument(uid, name, parent string, reader io.Reader) (doc *storage.Document, err error)
-	Export(uid, docid string) (io.ReadCloser, error)
+	CreateBlobFolder(uid, name, parent string) (doc *storage.Document, err error)
+	UpdateBlobDocument(uid string, tree *models.HashTree, doc *models.HashDoc) error
+	RemoveBlobDocuments(uid string, tree *models.HashTree, docIDs ...string) error
+	Export(uid, docid string, format storage.ExportFormat, options storage.ExportOptions) (io.ReadCloser, error)
+	CollectGarbage(uid string, keepRoots int, dryRun bool) (*storage.GarbageReport, error)
+	CheckBlobs(uid string, repair bool) (*storage.FsckReport, error)
+	RootHistory(uid string) ([]storage.RootGeneration, error)
+	GetTreeAt(uid string, generation int64) (*models.HashTree, error)
+	RestoreRoot(uid string, generation int64) (int64, error)
+	LoadBlob(uid, blobID string) (reader io.ReadCloser, gen int64, size int64, err error)
+	StoreBlob(uid, blobID string, s io.Reader, matchGeneration int64) (int64, error)
 }
 
 // ReactAppWrapper encapsulates an app
@@ -49,6 +74,9 @@ type ReactAppWrapper struct {
 	codeConnector   codeGenerator
 	h               *hub.Hub
 	documentHandler documentHandler
+	blobHandler     blobHandler
+	quota           *storage.Quota
+	documents       *storage.DocumentLocks
 	backend15       backend
 	backend10       backend
 }
@@ -62,7 +90,9 @@ func New(cfg *config.Config,
 	codeConnector codeGenerator,
 	h *hub.Hub,
 	docHandler documentHandler,
-	blobHandler blobHandler) *ReactAppWrapper {
+	blobHandler blobHandler,
+	quota *storage.Quota,
+	documents *storage.DocumentLocks) *ReactAppWrapper {
 
 	sub, err := fs.Sub(webui.Assets, "dist")
 	if err != nil {
@@ -81,12 +111,16 @@ func New(cfg *config.Config,
 		codeConnector:   codeConnector,
 		h:               h,
 		documentHandler: docHandler,
+		blobHandler:     blobHandler,
+		quota:           quota,
+		documents:       documents,
 		backend15: &backend15{
 			blobHandler: blobHandler,
 			h:           h,
 		},
 		backend10: &backend10{
 			documentHandler: docHandler,
+			documents:       documents,
 			h:               h,
 		},
 	}
@@ -107,6 +141,14 @@ func (w ReactAppWrapper) Open(filepath string) (http.File, error) {
 	f, err := w.fs.Open(fullpath)
 	return f, err
 }
+// PurgeTrash purges the documents the user trashed before the time
+func (w ReactAppWrapper) PurgeTrash(uid string, sync15 bool, before time.Time) (int, error) {
+	if sync15 {
+		return w.backend15.PurgeTrash(uid, before)
+	}
+	return w.backend10.PurgeTrash(uid, before)
+}
+
 func badReq(c *gin.Context, message string) {
 	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": message})
 }
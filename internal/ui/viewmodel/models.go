@@ -54,7 +54,7 @@ func makeDocument(d *messages.RawMetadata) (entry Entry) {
 	return
 }
 
-const trashID = "trash"
+const trashID = models.TrashParent
 
 // DocTreeFromHashTree from hash tree
 func DocTreeFromHashTree(tree *models.HashTree) *DocumentTree {
@@ -170,6 +170,31 @@ type Document struct {
 	Size         int
 }
 
+// NewFolder creates a folder, an empty parent is the root
+type NewFolder struct {
+	Name     string `json:"name" binding:"required"`
+	ParentID string `json:"parentId"`
+}
+
+// TrashEntry a trashed document
+type TrashEntry struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Trashed time.Time `json:"trashed"`
+	// Removed the document was removed from the sync and is only kept on
+	// the server, otherwise it is in the trash folder of the devices
+	Removed bool `json:"removed"`
+}
+
+// DocumentVersion a previous version of a sync 1.0 document
+type DocumentVersion struct {
+	ID       string    `json:"id"`
+	Version  int       `json:"version"`
+	Replaced time.Time `json:"replaced"`
+	Size     int64     `json:"size"`
+}
+
 // DocumentList is a list of documents
 type DocumentList struct {
 	Documents []Document `json:"entries"`
@@ -183,6 +208,48 @@ type User struct {
 	NewPassword  string `json:"newpassword,omitempty"`
 	CreatedAt    time.Time
 	Integrations []string `json:"integrations,omitempty"`
+	// Usage the bytes stored
+	Usage int64 `json:"usage"`
+	// Quota the storage limit in bytes, 0 is unlimited
+	Quota int64 `json:"quota"`
+	// NewQuota sets the user's own quota, 0 uses the default and -1 is unlimited
+	NewQuota *int64 `json:"newquota,omitempty"`
+}
+
+// GarbageReport the result of a garbage collection run
+type GarbageReport struct {
+	UserID           string   `json:"userid"`
+	DryRun           bool     `json:"dryRun"`
+	Scanned          int      `json:"scanned"`
+	Referenced       int      `json:"referenced"`
+	Unreferenced     []string `json:"unreferenced"`
+	ReclaimableBytes int64    `json:"reclaimableBytes"`
+}
+
+// FsckReport the result of a consistency check of the sync15 blobs
+type FsckReport struct {
+	UserID       string   `json:"userid"`
+	Repair       bool     `json:"repair"`
+	Healthy      bool     `json:"healthy"`
+	Root         string   `json:"root"`
+	Generation   int64    `json:"generation"`
+	Scanned      int      `json:"scanned"`
+	Documents    int      `json:"documents"`
+	Corrupt      []string `json:"corrupt"`
+	Dangling     []string `json:"dangling"`
+	SizeMismatch []string `json:"sizeMismatch"`
+	Unparsable   []string `json:"unparsable"`
+	StaleCache   bool     `json:"staleCache"`
+	CacheRebuilt bool     `json:"cacheRebuilt"`
+	Quarantined  []string `json:"quarantined"`
+}
+
+// RootGeneration a published root of the sync15 storage
+type RootGeneration struct {
+	Generation int64     `json:"generation"`
+	Timestamp  time.Time `json:"timestamp"`
+	Hash       string    `json:"hash"`
+	DeviceID   string    `json:"device"`
 }
 
 // NewUser new user creation
@@ -192,9 +259,18 @@ type NewUser struct {
 	NewPassword string `json:"newpassword" binding:"required"`
 }
 
-// UpdateDoc with somethin
+// UpdateDoc renames and moves a document, an empty name keeps the name, a
+// missing parent keeps the parent and an empty one is the root
 type UpdateDoc struct {
-	DocumentID string `json:"documentId" binding:"required"`
-	ParentID   string `json:"parentId"`
-	Name       string `json:"name"`
+	DocumentID string  `json:"documentId" binding:"required"`
+	ParentID   *string `json:"parentId"`
+	Name       string  `json:"name"`
+}
+
+// MigrationReport the result of moving the documents of a user to the other sync version
+type MigrationReport struct {
+	UserID   string   `json:"userid"`
+	Sync15   bool     `json:"sync15"`
+	Migrated int      `json:"migrated"`
+	Skipped  []string `json:"skipped"`
 }
@@ -7,6 +7,8 @@ import UserProfile from "./components/UserProfile";
 import Home from "./components/Home";
 import Documents from "./components/Documents";
 import NoMatch from "./components/NoMatch";
+import History from "./components/History";
+import Trash from "./components/Trash";
 
 import { BrowserRouter as Router, Route, Switch } from "react-router-dom";
 import { AuthProvider } from "./common/useAuthContext";
@@ -32,8 +34,10 @@ export default function App() {
           <Switch>
             <PrivateRoute exact path="/" component={Home} />
             <PrivateRoute path="/documents" component={Documents} />
+            <PrivateRoute path="/trash" component={Trash} />
             <PrivateRoute path="/generatecode" component={CodeGenerator} />
             <PrivateRoute path="/resetPassword" component={ResetPassword} />
+            <PrivateRoute path="/users/:userid/history" roles={[Role.Admin]} component={History} />
             <PrivateRoute path="/users/:userid" component={UserProfile} /> 
             <PrivateRoute path="/users" roles={[Role.Admin]} component={UserList} />
             <Route path="/login" component={Login} />
@@ -56,7 +56,7 @@ export default function StyledDropzone(props) {
     isDragActive,
     isDragAccept,
     isDragReject
-  } = useDropzone({ accept: 'application/pdf, application/zip, application/epub+zip', onDropAccepted: onDrop });
+  } = useDropzone({ accept: 'application/pdf, application/zip, application/epub+zip, .rmdoc, .rm', onDropAccepted: onDrop });
 
   const style = useMemo(() => ({
     ...baseStyle,
@@ -0,0 +1,155 @@
+import React, { useState } from "react";
+import { useParams } from "react-router-dom";
+import { Alert, Button, Card, Col, Container, Row, Table } from "react-bootstrap";
+import { toast } from "react-toastify";
+import useFetch from "../hooks/useFetch";
+import Spinner from "./Spinner";
+import apiService from "../services/api.service";
+import { formatDate } from "../common/date";
+
+// the documents of a generation, the folders with their children
+function Entries({ entries }) {
+  if (!entries || !entries.length) {
+    return null;
+  }
+  return (
+    <ul>
+      {entries.map((x) => (
+        <li key={x.id}>
+          {x.name}
+          {x.type && <small className="text-muted"> {x.type}</small>}
+          <Entries entries={x.children} />
+        </li>
+      ))}
+    </ul>
+  );
+}
+
+function GenerationDocuments({ userid, generation }) {
+  const { data: tree, error, loading } = useFetch(`users/${userid}/history/${generation}`, generation);
+
+  if (loading) {
+    return <Spinner />;
+  }
+  if (error) {
+    return (
+      <Alert variant="danger">
+        {`Generation ${generation} cannot be read, its blobs may be garbage collected`}
+      </Alert>
+    );
+  }
+  if (!tree.Entries.length && !tree.Trash.length) {
+    return <div>No documents</div>;
+  }
+  return (
+    <>
+      <Entries entries={tree.Entries} />
+      {tree.Trash.length > 0 && (
+        <>
+          <h6>Trash</h6>
+          <Entries entries={tree.Trash} />
+        </>
+      )}
+    </>
+  );
+}
+
+export default function History() {
+  const { userid } = useParams();
+  const [index, setIndex] = useState(0);
+  const [selected, setSelected] = useState(null);
+  const { data: history, error, loading } = useFetch(`users/${userid}/history`, index);
+
+  const restore = async (e, generation) => {
+    e.stopPropagation();
+    if (!window.confirm(`Restore the documents of ${userid} to generation ${generation}? The devices will sync to it.`))
+      return;
+
+    try {
+      const result = await apiService.restoreGeneration(userid, generation);
+      toast.success(`Restored as generation ${result.generation}`);
+      setSelected(null);
+      setIndex((previous) => previous + 1);
+    } catch (e) {
+      toast.error("Error: " + e);
+    }
+  };
+
+  if (loading) {
+    return <Spinner />;
+  }
+
+  if (error) {
+    return (
+      <Alert variant="danger">
+        <Alert.Heading>An Error Occurred</Alert.Heading>
+        {`Error ${error.status}: ${error.statusText}`}
+      </Alert>
+    );
+  }
+
+  if (!history.length) {
+    return <div>No root history, {userid} does not use sync 1.5</div>;
+  }
+
+  // the newest first, the last one is current
+  const current = history[history.length - 1].generation;
+  const generations = [...history].reverse();
+
+  return (
+    <Container fluid>
+      <Row>
+        <Col md={7}>
+          <Card bg="dark" text="white">
+            <Card.Header>History of {userid}</Card.Header>
+            <Table striped bordered hover className="table-dark">
+              <thead>
+                <tr>
+                  <th>Generation</th>
+                  <th>Published</th>
+                  <th>Device</th>
+                  <th>Root</th>
+                  <th></th>
+                </tr>
+              </thead>
+              <tbody>
+                {generations.map((x) => (
+                  <tr
+                    key={x.generation}
+                    onClick={() => setSelected(x.generation)}
+                    className={x.generation === selected ? "table-active" : ""}
+                    style={{ cursor: "pointer" }}
+                  >
+                    <td>{x.generation}</td>
+                    <td>{formatDate(x.timestamp)}</td>
+                    <td>{x.device || "server"}</td>
+                    <td title={x.hash}>{x.hash.substring(0, 12)}</td>
+                    <td>
+                      {x.generation === current ? (
+                        "current"
+                      ) : (
+                        <Button variant="warning" onClick={(e) => restore(e, x.generation)}>
+                          Restore
+                        </Button>
+                      )}
+                    </td>
+                  </tr>
+                ))}
+              </tbody>
+            </Table>
+          </Card>
+        </Col>
+        <Col md={5}>
+          {selected !== null && (
+            <Card bg="dark" text="white">
+              <Card.Header>Documents at generation {selected}</Card.Header>
+              <Card.Body>
+                <GenerationDocuments userid={userid} generation={selected} />
+              </Card.Body>
+            </Card>
+          )}
+        </Col>
+      </Row>
+    </Container>
+  );
+}
@@ -30,6 +30,9 @@ const NavigationBar = () => {
                   Documents
                 </Nav.Link>
               </Nav.Item>
+              <Nav.Item>
+                <Nav.Link as={NavLink} to="/trash">Trash</Nav.Link>
+              </Nav.Item>
               {isAdmin(user) && (
                 <Nav.Item>
                   <Nav.Link as={NavLink} to="/users">Users</Nav.Link>
@@ -0,0 +1,92 @@
+import React, { useState } from "react";
+import { Alert, Button, Card, Table } from "react-bootstrap";
+import { toast } from "react-toastify";
+import useFetch from "../hooks/useFetch";
+import Spinner from "./Spinner";
+import apiService from "../services/api.service";
+import { formatDate } from "../common/date";
+
+export default function Trash() {
+  const [index, setIndex] = useState(0);
+  const { data: trash, error, loading } = useFetch("trash", index);
+
+  const refresh = () => {
+    setIndex((previous) => previous + 1);
+  };
+
+  const restore = async (x) => {
+    try {
+      await apiService.restoreTrashed(x.id);
+      toast.success(`Restored ${x.name}`);
+      refresh();
+    } catch (e) {
+      // 409: a document with the id is back already
+      toast.error(e === 409 ? `${x.name} already exists` : "Error: " + e);
+    }
+  };
+
+  const purge = async (x) => {
+    if (!window.confirm(`Are you sure you want to delete ${x.name} for good?`))
+      return;
+
+    try {
+      await apiService.purgeTrashed(x.id);
+      refresh();
+    } catch (e) {
+      toast.error("Error: " + e);
+    }
+  };
+
+  if (loading) {
+    return <Spinner />;
+  }
+
+  if (error) {
+    return (
+      <Alert variant="danger">
+        <Alert.Heading>An Error Occurred</Alert.Heading>
+        {`Error ${error.status}: ${error.statusText}`}
+      </Alert>
+    );
+  }
+
+  return (
+    <Card bg="dark" text="white">
+      <Card.Header>Trash</Card.Header>
+      {!trash.length ? (
+        <Card.Body>The trash is empty</Card.Body>
+      ) : (
+        <Table striped bordered hover className="table-dark">
+          <thead>
+            <tr>
+              <th>Name</th>
+              <th>Type</th>
+              <th>Trashed</th>
+              <th></th>
+            </tr>
+          </thead>
+          <tbody>
+            {trash.map((x) => (
+              <tr key={x.id}>
+                <td>
+                  {x.name}
+                  {x.removed && (
+                    <small className="text-muted" title="removed from the tablets, only kept on the server">
+                      {" "}removed
+                    </small>
+                  )}
+                </td>
+                <td>{x.type === "CollectionType" ? "folder" : "document"}</td>
+                <td>{formatDate(x.trashed)}</td>
+                <td>
+                  <Button onClick={() => restore(x)}>Restore</Button>{" "}
+                  <Button variant="danger" onClick={() => purge(x)}>Purge</Button>
+                </td>
+              </tr>
+            ))}
+          </tbody>
+        </Table>
+      )}
+    </Card>
+  );
+}
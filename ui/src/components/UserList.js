@@ -7,6 +7,7 @@ import NewUserModal from "./NewUserModal";
 import apiService from "../services/api.service";
 import {formatDate} from "../common/date";
 import { toast } from "react-toastify";
+import { useHistory } from "react-router-dom";
 const userListUrl = "users";
 
 const NewUser = 1;
@@ -15,6 +16,7 @@ export default function UserList() {
   const [index, setIndex] = useState(false);
   const { data: userList, error, loading } = useFetch(`${userListUrl}`, index);
   const [ state, setState ] = useState({showModal: 0, modalUser: null});
+  const history = useHistory();
   const refresh = () =>{
     setIndex(previous => previous+1)
   }
@@ -61,6 +63,11 @@ export default function UserList() {
     refresh();
   }
 
+  const showHistory = (e, id) => {
+    e.stopPropagation()
+    history.push(`/users/${id}/history`)
+  }
+
   const remove = async (e, id) => {
     e.preventDefault()
     e.stopPropagation()
@@ -117,7 +124,10 @@ export default function UserList() {
               <td>{x.email}</td>
               <td>{x.Name}</td>
               <td>{formatDate(x.CreatedAt)}</td>
-              <td><Button variant="danger" onClick={(e) => remove(e,x.userid)}>Delete</Button></td>
+              <td>
+                <Button variant="secondary" onClick={(e) => showHistory(e, x.userid)}>History</Button>{" "}
+                <Button variant="danger" onClick={(e) => remove(e,x.userid)}>Delete</Button>
+              </td>
             </tr>
           ))}
         </tbody>
@@ -109,6 +109,31 @@ class ApiServices {
       headers: this.header(),
     }).then((r) => handleError(r));
   }
+  restoreTrashed(id) {
+    return fetch(`${constants.ROOT_URL}/trash/${id}/restore`, {
+      method: "POST",
+      headers: this.header(),
+    }).then((r) => handleError(r));
+  }
+  purgeTrashed(id) {
+    return fetch(`${constants.ROOT_URL}/trash/${id}`, {
+      method: "DELETE",
+      headers: this.header(),
+    }).then((r) => handleError(r));
+  }
+  restoreGeneration(userid, generation) {
+    return fetch(`${constants.ROOT_URL}/users/${userid}/history/${generation}/restore`, {
+      method: "POST",
+      headers: this.header(),
+    }).then((r) => {
+      // the generation cannot be restored, e.g. its blobs were collected
+      if (r.status === 409) {
+        return r.json().then((e) => { throw new Error(e.error) });
+      }
+      handleError(r);
+      return r.json();
+    });
+  }
 }
 
 function removeUser(){